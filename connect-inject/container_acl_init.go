@@ -0,0 +1,179 @@
+package connectinject
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// aclInitLoginAttempts is the number of times the ACL init container
+	// tries to log in before it fails. Logging in fails until the Consul
+	// client agent on the node is reachable.
+	aclInitLoginAttempts = 30
+
+	// aclInitLoginRetrySeconds is the time to wait between login attempts.
+	aclInitLoginRetrySeconds = 2
+)
+
+type aclInitCommandData struct {
+	AuthMethod string
+	// ConsulHTTPAddr is the address of the Consul client agent's HTTP API.
+	ConsulHTTPAddr string
+	// ConsulCACert is the CA certificate to write to the shared volume
+	// if the agent is reached over TLS.
+	ConsulCACert  string
+	LoginAttempts int
+	RetrySeconds  int
+	// Partition is the Consul Enterprise admin partition to log in to. It
+	// is empty if partitions aren't used.
+	Partition string
+	// Namespace is the Consul Enterprise namespace to log in to. It is
+	// empty if namespaces aren't used.
+	Namespace string
+	// BearerTokenFile is the service account token to log in with, and
+	// Audience the audience it is bound to, if it is a projected token.
+	BearerTokenFile string
+	Audience        string
+}
+
+// containerACLInit returns the init container spec for logging in with
+// the auth method. It writes the ACL token to the shared volume so that
+// the other init container and the sidecar can use it. It must run before
+// the other init container.
+func (h *Handler) containerACLInit(pod *corev1.Pod) (corev1.Container, error) {
+	tls, err := h.consulTLS(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	data := aclInitCommandData{
+		AuthMethod:    h.AuthMethod,
+		LoginAttempts: aclInitLoginAttempts,
+		RetrySeconds:  aclInitLoginRetrySeconds,
+		Partition:     h.ConsulPartition,
+	}
+	if tls {
+		data.ConsulCACert = h.ConsulCACert
+	}
+	data.ConsulHTTPAddr, err = h.consulHTTPAddr(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	data.Namespace, err = h.consulNamespace(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	// The login uses a bound token projected into the token volume if the
+	// handler has an audience for it, or else the pod's auto-mounted token.
+	volMounts := []corev1.VolumeMount{
+		{
+			Name:      volumeName,
+			MountPath: "/consul/connect-inject",
+		},
+	}
+	if h.ServiceAccountTokenAudience != "" {
+		data.BearerTokenFile = tokenMountPath + "/token"
+		data.Audience = h.ServiceAccountTokenAudience
+		volMounts = append(volMounts, corev1.VolumeMount{
+			Name:      tokenVolumeName,
+			ReadOnly:  true,
+			MountPath: tokenMountPath,
+		})
+	} else {
+		saTokenVolumeMount, err := findServiceAccountVolumeMount(pod)
+		if err != nil {
+			return corev1.Container{}, err
+		}
+		data.BearerTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+		volMounts = append(volMounts, saTokenVolumeMount)
+	}
+
+	// Render the command
+	var buf bytes.Buffer
+	tpl := template.Must(template.New("root").Parse(strings.TrimSpace(
+		aclInitCommandTpl)))
+	err = tpl.Execute(&buf, &data)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	env := []corev1.EnvVar{
+		{
+			Name: "HOST_IP",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
+			},
+		},
+		{
+			Name: "POD_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+			},
+		},
+		{
+			Name: "POD_NAMESPACE",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+			},
+		},
+	}
+	if tls {
+		env = append(env, corev1.EnvVar{
+			Name:  "CONSUL_CACERT",
+			Value: consulCACertPath,
+		})
+	}
+	env = append(env, h.partitionEnvVars()...)
+
+	return corev1.Container{
+		Name:         "consul-connect-inject-acl-init",
+		Image:        h.ImageConsul,
+		Env:          env,
+		VolumeMounts: volMounts,
+		Command:      []string{"/bin/sh", "-ec", buf.String()},
+	}, nil
+}
+
+// aclInitCommandTpl is the template for the command executed by
+// the ACL init container.
+const aclInitCommandTpl = hostAddrCommand + `
+export CONSUL_HTTP_ADDR="{{ .ConsulHTTPAddr }}"
+{{- if .ConsulCACert }}
+
+cat <<EOF >/consul/connect-inject/consul-ca.pem
+{{ .ConsulCACert }}
+EOF
+{{- end }}
+
+# Log in with the auth method. The Consul client agent on the node may
+# not be reachable yet, so retry for a while before giving up.
+attempt=1
+until /bin/consul login -method="{{ .AuthMethod }}" \
+  {{- if .Partition }}
+  -partition="{{ .Partition }}" \
+  {{- end }}
+  {{- if .Namespace }}
+  -namespace="{{ .Namespace }}" \
+  {{- end }}
+  -bearer-token-file="{{ .BearerTokenFile }}" \
+  -token-sink-file="/consul/connect-inject/acl-token" \
+  -meta="pod=${POD_NAMESPACE}/${POD_NAME}"
+do
+  if [ "${attempt}" -ge {{ .LoginAttempts }} ]; then
+    echo "ERROR: unable to log in with auth method {{ .AuthMethod }} at ${CONSUL_HTTP_ADDR} after ${attempt} attempts"
+    {{- if .Audience }}
+    echo "ERROR: the service account token is bound to the audience {{ .Audience }}, which the auth method must accept"
+    {{- end }}
+    exit 1
+  fi
+  attempt=$((attempt + 1))
+  sleep {{ .RetrySeconds }}
+done
+
+# The sidecar may run as a different user and needs to read the token
+# to deregister the services.
+chmod 444 /consul/connect-inject/acl-token
+`
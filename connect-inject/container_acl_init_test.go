@@ -0,0 +1,189 @@
+package connectinject
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHandlerContainerACLInit(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Handler Handler
+		Cmd     string // Strings.Contains test
+		CmdNot  string // Not contains
+	}{
+		{
+			"auth method",
+			Handler{AuthMethod: "release-name-consul-k8s-auth-method"},
+			`export CONSUL_HTTP_ADDR="${HOST_ADDR}:8500"
+
+# Log in with the auth method. The Consul client agent on the node may
+# not be reachable yet, so retry for a while before giving up.
+attempt=1
+until /bin/consul login -method="release-name-consul-k8s-auth-method" \
+  -bearer-token-file="/var/run/secrets/kubernetes.io/serviceaccount/token" \
+  -token-sink-file="/consul/connect-inject/acl-token" \
+  -meta="pod=${POD_NAMESPACE}/${POD_NAME}"
+do
+  if [ "${attempt}" -ge 30 ]; then
+    echo "ERROR: unable to log in with auth method release-name-consul-k8s-auth-method at ${CONSUL_HTTP_ADDR} after ${attempt} attempts"
+    exit 1
+  fi
+  attempt=$((attempt + 1))
+  sleep 2
+done
+
+# The sidecar may run as a different user and needs to read the token
+# to deregister the services.
+chmod 444 /consul/connect-inject/acl-token`,
+			"consul-ca.pem",
+		},
+
+		{
+			"namespace",
+			Handler{AuthMethod: "auth-method", ConsulDestinationNamespace: "dest"},
+			`until /bin/consul login -method="auth-method" \
+  -namespace="dest" \
+  -bearer-token-file="/var/run/secrets/kubernetes.io/serviceaccount/token" \`,
+			"",
+		},
+
+		{
+			"partition",
+			Handler{AuthMethod: "auth-method", ConsulPartition: "part", ConsulDestinationNamespace: "dest"},
+			`until /bin/consul login -method="auth-method" \
+  -partition="part" \
+  -namespace="dest" \
+  -bearer-token-file="/var/run/secrets/kubernetes.io/serviceaccount/token" \`,
+			"",
+		},
+
+		{
+			"CA cert",
+			Handler{AuthMethod: "auth-method", ConsulCACert: "consul-ca-cert"},
+			`export CONSUL_HTTP_ADDR="https://${HOST_ADDR}:8501"
+
+cat <<EOF >/consul/connect-inject/consul-ca.pem
+consul-ca-cert
+EOF`,
+			"",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "foo",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "default-token-podid",
+									ReadOnly:  true,
+									MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+								},
+							},
+						},
+					},
+				},
+			}
+
+			container, err := tt.Handler.containerACLInit(pod)
+			require.NoError(err)
+			require.Equal("consul-connect-inject-acl-init", container.Name)
+			if tt.Handler.ConsulPartition != "" {
+				require.Contains(container.Env, corev1.EnvVar{
+					Name:  "CONSUL_PARTITION",
+					Value: tt.Handler.ConsulPartition,
+				})
+			}
+			require.Contains(container.VolumeMounts, corev1.VolumeMount{
+				Name:      "default-token-podid",
+				ReadOnly:  true,
+				MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+			})
+			actual := strings.Join(container.Command, " ")
+			require.Contains(actual, tt.Cmd)
+			if tt.CmdNot != "" {
+				require.NotContains(actual, tt.CmdNot)
+			}
+		})
+	}
+}
+
+func TestHandlerContainerACLInit_noServiceAccountToken(t *testing.T) {
+	require := require.New(t)
+	h := Handler{AuthMethod: "auth-method"}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService: "foo",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+
+	_, err := h.containerACLInit(pod)
+	require.Error(err)
+}
+
+// Test that the login uses the projected token if the handler has an
+// audience for it, and that the pod doesn't need the auto-mounted token.
+func TestHandlerContainerACLInit_boundServiceAccountToken(t *testing.T) {
+	require := require.New(t)
+	h := Handler{
+		AuthMethod:                  "auth-method",
+		ServiceAccountTokenAudience: "consul",
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService: "foo",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+
+	container, err := h.containerACLInit(pod)
+	require.NoError(err)
+	require.Equal([]corev1.VolumeMount{
+		{
+			Name:      volumeName,
+			MountPath: "/consul/connect-inject",
+		},
+		{
+			Name:      tokenVolumeName,
+			ReadOnly:  true,
+			MountPath: "/consul/connect-inject-token",
+		},
+	}, container.VolumeMounts)
+	actual := strings.Join(container.Command, " ")
+	require.Contains(actual, `-bearer-token-file="/consul/connect-inject-token/token" \`)
+	require.Contains(actual, `echo "ERROR: the service account token is bound to the audience consul, which the auth method must accept"`)
+}
@@ -4,16 +4,38 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 )
 
+// These mirror the limits Consul enforces on service metadata so that
+// invalid metadata is rejected at admission rather than failing the
+// registration in the init container.
+const (
+	metaMaxKeyPairs       = 64
+	metaKeyMaxLength      = 128
+	metaValueMaxLength    = 512
+	metaKeyReservedPrefix = "consul-"
+)
+
+var metaKeyFormat = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// upstreamNameFormat is the format of the names of the pod's services, and
+// of the service names, prepared query names and datacenters of upstreams.
+var upstreamNameFormat = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
 type initContainerCommandData struct {
-	ServiceName      string
-	ProxyServiceName string
-	ServicePort      int32
+	// Services are the services, and their sidecar proxies, that are
+	// registered for the pod.
+	Services []initContainerCommandServiceData
 	// ServiceProtocol is the protocol for the service-defaults config
 	// that will be written if WriteServiceDefaults is true.
 	ServiceProtocol string
@@ -21,9 +43,63 @@ type initContainerCommandData struct {
 	// WriteServiceDefaults controls whether a service-defaults config is
 	// written for this service.
 	WriteServiceDefaults bool
-	Upstreams            []initContainerCommandUpstreamData
-	Tags                 string
-	Meta                 map[string]string
+	// ConsulHTTPAddr is the address of the Consul client agent's HTTP API.
+	ConsulHTTPAddr string
+	// ConsulCACert is the CA certificate to write to the shared volume
+	// if the agent is reached over TLS.
+	ConsulCACert string
+	// Partition is the Consul Enterprise admin partition to register the
+	// services in. It is empty if partitions aren't used.
+	Partition string
+	// Namespace is the Consul Enterprise namespace to register the
+	// services in. It is empty if namespaces aren't used.
+	Namespace string
+	// LocalServiceAddress is the address the proxies connect to the
+	// application on. If it is empty, 127.0.0.1 is used for services
+	// with a port.
+	LocalServiceAddress string
+	// CheckInterval, CheckTimeout and CheckDeregisterCriticalAfter are
+	// the durations of the proxies' health checks. CheckTimeout is empty
+	// if Consul's default is used.
+	CheckInterval                string
+	CheckTimeout                 string
+	CheckDeregisterCriticalAfter string
+	// TProxyOutboundListenerPort is the port of the proxy's outbound
+	// listener in transparent proxy mode. It is zero if the pod's traffic
+	// isn't transparently redirected.
+	TProxyOutboundListenerPort int
+	// ServiceOnly is true if only the services are registered, without
+	// sidecar proxies or their Envoy bootstrap configs.
+	ServiceOnly bool
+}
+
+type initContainerCommandServiceData struct {
+	Name      string
+	ProxyName string
+	Port      int32
+	// IDEnvVar and ProxyIDEnvVar are the names of the init container's
+	// environment variables that hold the IDs of the service and its proxy.
+	IDEnvVar      string
+	ProxyIDEnvVar string
+	// ProxyPort is the port of the proxy's public listener.
+	ProxyPort int32
+	// AdminBind is the address of the Envoy admin API. It must be unique
+	// for every proxy in the pod, so it is only empty (the default
+	// address) for the first one.
+	AdminBind string
+	// Suffix is appended to the names of the files and containers that
+	// exist for each proxy in the pod. It is empty for the first one.
+	Suffix string
+	// ProxyConfig is the opaque config of the proxy, with the values
+	// already rendered as HCL.
+	ProxyConfig map[string]string
+	// ExposePaths are the probes the proxy serves through expose paths.
+	ExposePaths []exposedProbe
+	Upstreams   []initContainerCommandUpstreamData
+	Tags        string
+	// Meta is the metadata of the service, with the values already
+	// rendered as HCL.
+	Meta map[string]string
 }
 
 type initContainerCommandUpstreamData struct {
@@ -38,92 +114,195 @@ type initContainerCommandUpstreamData struct {
 func (h *Handler) containerInit(pod *corev1.Pod) (corev1.Container, error) {
 	protocol := h.DefaultProtocol
 	if annoProtocol, ok := pod.Annotations[annotationProtocol]; ok {
+		if !ValidProtocol(annoProtocol) {
+			return corev1.Container{}, fmt.Errorf(
+				"%s annotation value of %q is not a valid protocol, must be one of %s",
+				annotationProtocol, annoProtocol, strings.Join(validProtocols, ", "))
+		}
 		protocol = annoProtocol
 	}
+	serviceOnly, err := h.serviceOnly(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
 	// We only write a service-defaults config if central config is enabled
 	// and a protocol is specified. Previously, we would write a config when
 	// the protocol was empty. This is the same as setting it to tcp. This
 	// would then override any global proxy-defaults config. Now, we only
-	// write the config if a protocol is explicitly set.
-	writeServiceDefaults := h.WriteServiceDefaults && protocol != ""
+	// write the config if a protocol is explicitly set. The protocol only
+	// matters to proxies, so services without them don't write it.
+	writeServiceDefaults := h.WriteServiceDefaults && protocol != "" && !serviceOnly
 	data := initContainerCommandData{
-		ServiceName:          pod.Annotations[annotationService],
-		ProxyServiceName:     fmt.Sprintf("%s-sidecar-proxy", pod.Annotations[annotationService]),
 		ServiceProtocol:      protocol,
 		AuthMethod:           h.AuthMethod,
 		WriteServiceDefaults: writeServiceDefaults,
+		Partition:            h.ConsulPartition,
+		ServiceOnly:          serviceOnly,
 	}
-	if data.ServiceName == "" {
+	if pod.Annotations[annotationService] == "" {
 		// Assertion, since we call defaultAnnotations above and do
 		// not mutate pods without a service specified.
 		panic("No service found. This should be impossible since we default it.")
 	}
 
-	// If a port is specified, then we determine the value of that port
-	// and register that port for the host service.
-	if raw, ok := pod.Annotations[annotationPort]; ok && raw != "" {
-		if port, _ := portValue(pod, raw); port > 0 {
-			data.ServicePort = port
+	tls, err := h.consulTLS(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	if tls {
+		data.ConsulCACert = h.ConsulCACert
+	}
+	data.ConsulHTTPAddr, err = h.consulHTTPAddr(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	data.Namespace, err = h.consulNamespace(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	data.Services, err = h.podServices(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	if raw, ok := pod.Annotations[annotationLocalServiceAddress]; ok && raw != "" {
+		if net.ParseIP(raw) == nil {
+			return corev1.Container{}, fmt.Errorf("%s annotation value of %q is not a valid IP address",
+				annotationLocalServiceAddress, raw)
 		}
+		data.LocalServiceAddress = raw
 	}
 
-	var tags []string
+	data.CheckInterval, data.CheckTimeout, data.CheckDeregisterCriticalAfter, err =
+		h.checkDurations(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	tproxy, err := h.transparentProxy(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	if tproxy {
+		data.TProxyOutboundListenerPort, err = h.tproxyOutboundListenerPort(pod)
+		if err != nil {
+			return corev1.Container{}, err
+		}
+	}
+
+	// Upstreams, tags, metadata, proxy config, metrics and tracing only
+	// apply to the first service if the pod registers multiple services.
+	service := &data.Services[0]
+
+	service.ProxyConfig, err = h.proxyConfig(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	metricsPort, _, err := h.prometheusMetrics(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	if metricsPort > 0 {
+		for _, other := range data.Services {
+			if other.ProxyPort == metricsPort {
+				return corev1.Container{}, fmt.Errorf(
+					"metrics port %d is already used by the proxy of %s", metricsPort, other.Name)
+			}
+		}
+		h.setProxyConfig(service.ProxyConfig, "envoy_prometheus_bind_addr",
+			fmt.Sprintf("0.0.0.0:%d", metricsPort))
+	}
+
+	tracing, err := h.tracingEnabled(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	if tracing {
+		tracingJSON, clustersJSON, err := h.tracingConfig(service.Name, pod.Namespace)
+		if err != nil {
+			return corev1.Container{}, err
+		}
+		h.setProxyConfig(service.ProxyConfig, "envoy_tracing_json", tracingJSON)
+		h.setProxyConfig(service.ProxyConfig, "envoy_extra_static_clusters_json", clustersJSON)
+	}
+
+	service.ExposePaths, err = h.exposedProbes(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	// The handler's default tags come first and apply to all services,
+	// the tags from the annotations only to the first. Duplicate tags are
+	// dropped.
+	defaultTags := appendUnique(nil, h.DefaultServiceTags...)
+	tags := defaultTags
 	if raw, ok := pod.Annotations[annotationTags]; ok && raw != "" {
-		tags = strings.Split(raw, ",")
+		tags = appendUnique(tags, splitTags(raw)...)
 	}
 	// Get the tags from the deprecated tags annotation and combine.
 	if raw, ok := pod.Annotations[annotationConnectTags]; ok && raw != "" {
-		tags = append(tags, strings.Split(raw, ",")...)
+		tags = appendUnique(tags, splitTags(raw)...)
 	}
 
-	if len(tags) > 0 {
+	for i := range data.Services {
+		serviceTags := defaultTags
+		if i == 0 {
+			serviceTags = tags
+		}
+		if len(serviceTags) == 0 {
+			continue
+		}
+
 		// Create json array from the annotations since we're going to output
-		// this in an HCL config file and HCL arrays are json formatted.
-		jsonTags, err := json.Marshal(tags)
+		// this in an HCL config file and HCL arrays are json formatted. The
+		// array is escaped for the heredoc the service file is written with.
+		jsonTags, err := json.Marshal(serviceTags)
 		if err != nil {
-			h.Log.Error("Error json marshaling tags", "Error", err, "Tags", tags)
+			h.Log.Error("Error json marshaling tags", "Error", err, "Tags", serviceTags)
 		} else {
-			data.Tags = string(jsonTags)
+			data.Services[i].Tags = heredocEscape(string(jsonTags))
 		}
 	}
 
 	// If there is metadata specified split into a map and create.
-	data.Meta = make(map[string]string)
+	service.Meta = make(map[string]string)
 	for k, v := range pod.Annotations {
 		if strings.HasPrefix(k, annotationMeta) && strings.TrimPrefix(k, annotationMeta) != "" {
-			data.Meta[strings.TrimPrefix(k, annotationMeta)] = v
+			service.Meta[strings.TrimPrefix(k, annotationMeta)] = v
 		}
 	}
+	// Copy the configured labels of the pod into the metadata, unless a
+	// meta annotation sets the same key. Label values are too short for
+	// Consul's limit, but are cut to it anyway to be safe.
+	for label, key := range h.CopyLabelsToMeta {
+		value, ok := pod.Labels[label]
+		if !ok {
+			continue
+		}
+		if _, ok := service.Meta[key]; ok {
+			continue
+		}
+		if len(value) > metaValueMaxLength {
+			h.Log.Warn("Truncating service metadata copied from pod label",
+				"Label", label, "Key", key, "Length", len(value))
+			value = value[:metaValueMaxLength]
+		}
+		service.Meta[key] = value
+	}
+	if err := validateMeta(service.Meta); err != nil {
+		return corev1.Container{}, err
+	}
+	for key, value := range service.Meta {
+		service.Meta[key] = hclString(value)
+	}
 
 	// If upstreams are specified, configure those
-	if raw, ok := pod.Annotations[annotationUpstreams]; ok && raw != "" {
-		for _, raw := range strings.Split(raw, ",") {
-			parts := strings.SplitN(raw, ":", 3)
-
-			var datacenter, service_name, prepared_query string
-			var port int32
-			if parts[0] == "prepared_query" {
-				port, _ = portValue(pod, strings.TrimSpace(parts[2]))
-				prepared_query = strings.TrimSpace(parts[1])
-			} else {
-				port, _ = portValue(pod, strings.TrimSpace(parts[1]))
-				service_name = strings.TrimSpace(parts[0])
-
-				// parse the optional datacenter
-				if len(parts) > 2 {
-					datacenter = strings.TrimSpace(parts[2])
-				}
-			}
-
-			if port > 0 {
-				data.Upstreams = append(data.Upstreams, initContainerCommandUpstreamData{
-					Name:       service_name,
-					LocalPort:  port,
-					Datacenter: datacenter,
-					Query:      prepared_query,
-				})
-			}
-		}
+	service.Upstreams, err = parseUpstreams(pod)
+	if err != nil {
+		return corev1.Container{}, err
 	}
 
 	// Create expected volume mounts
@@ -134,114 +313,692 @@ func (h *Handler) containerInit(pod *corev1.Pod) (corev1.Container, error) {
 		},
 	}
 
-	if h.AuthMethod != "" {
-		// Extract the service account token's volume mount
-		saTokenVolumeMount, err := findServiceAccountVolumeMount(pod)
-		if err != nil {
-			return corev1.Container{}, err
-		}
-
-		// Append to volume mounts
-		volMounts = append(volMounts, saTokenVolumeMount)
-	}
-
 	// Render the command
 	var buf bytes.Buffer
-	tpl := template.Must(template.New("root").Parse(strings.TrimSpace(
-		initContainerCommandTpl)))
-	err := tpl.Execute(&buf, &data)
+	tpl := template.Must(template.New("root").Funcs(template.FuncMap{
+		"hclString": hclString,
+	}).Parse(strings.TrimSpace(initContainerCommandTpl)))
+	err = tpl.Execute(&buf, &data)
 	if err != nil {
 		return corev1.Container{}, err
 	}
 
-	return corev1.Container{
-		Name:  "consul-connect-inject-init",
-		Image: h.ImageConsul,
-		Env: []corev1.EnvVar{
-			{
-				Name: "HOST_IP",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
-				},
-			},
-			{
-				Name: "POD_IP",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"},
-				},
-			},
-			{
-				Name: "POD_NAME",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
-				},
+	env := []corev1.EnvVar{
+		{
+			Name: "HOST_IP",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
 			},
-			{
-				Name: "POD_NAMESPACE",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
-				},
+		},
+		// The services and proxies are registered with the pod's IP rather
+		// than the agent's address, which other pods may not reach. Pods
+		// that use the host network have the node's IP as their IP.
+		{
+			Name: "POD_IP",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"},
 			},
-			{
-				Name:  "SERVICE_ID",
-				Value: fmt.Sprintf("$(POD_NAME)-%s", data.ServiceName),
+		},
+		{
+			Name: "POD_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
 			},
-			{
-				Name:  "PROXY_SERVICE_ID",
-				Value: fmt.Sprintf("$(POD_NAME)-%s", data.ProxyServiceName),
+		},
+		{
+			Name: "POD_NAMESPACE",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
 			},
 		},
+	}
+	for _, service := range data.Services {
+		env = append(env, corev1.EnvVar{
+			Name:  service.IDEnvVar,
+			Value: fmt.Sprintf("$(POD_NAME)-%s", service.Name),
+		})
+		if !serviceOnly {
+			env = append(env, corev1.EnvVar{
+				Name:  service.ProxyIDEnvVar,
+				Value: fmt.Sprintf("$(POD_NAME)-%s", service.ProxyName),
+			})
+		}
+	}
+	if tls {
+		env = append(env, corev1.EnvVar{
+			Name:  "CONSUL_CACERT",
+			Value: consulCACertPath,
+		})
+	}
+	env = append(env, h.partitionEnvVars()...)
+
+	return corev1.Container{
+		Name:         "consul-connect-inject-init",
+		Image:        h.ImageConsul,
+		Env:          env,
 		VolumeMounts: volMounts,
 		Command:      []string{"/bin/sh", "-ec", buf.String()},
 	}, nil
 }
 
+// podServices returns the services, and their sidecar proxies, that are
+// registered for the pod. A pod can register multiple services by setting
+// the service and port annotations to comma-separated lists of equal length.
+// The proxy ports are zero if the services are registered without proxies.
+func (h *Handler) podServices(pod *corev1.Pod) ([]initContainerCommandServiceData, error) {
+	names := strings.Split(pod.Annotations[annotationService], ",")
+
+	var ports []string
+	if raw, ok := pod.Annotations[annotationPort]; ok && raw != "" {
+		ports = strings.Split(raw, ",")
+		if len(ports) != len(names) {
+			return nil, fmt.Errorf("%s annotation has %d entries and %s annotation has %d, "+
+				"they must be of equal length",
+				annotationService, len(names), annotationPort, len(ports))
+		}
+	}
+
+	serviceOnly, err := h.serviceOnly(pod)
+	if err != nil {
+		return nil, err
+	}
+	var proxyPort int32
+	if !serviceOnly {
+		proxyPort, err = h.proxyPort(pod, len(names))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seen := make(map[string]bool)
+	var services []initContainerCommandServiceData
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("%s annotation value of %q contains an empty service name",
+				annotationService, pod.Annotations[annotationService])
+		}
+		if !upstreamNameFormat.MatchString(name) {
+			return nil, fmt.Errorf("%s annotation contains invalid service name %q, "+
+				"it must only contain alphanumeric, '.', '-' or '_' characters",
+				annotationService, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s annotation contains service %q more than once",
+				annotationService, name)
+		}
+		seen[name] = true
+
+		service := initContainerCommandServiceData{
+			Name:          name,
+			ProxyName:     fmt.Sprintf("%s-sidecar-proxy", name),
+			IDEnvVar:      "SERVICE_ID",
+			ProxyIDEnvVar: "PROXY_SERVICE_ID",
+		}
+		if !serviceOnly {
+			service.ProxyPort = proxyPort + int32(i)
+		}
+		if i > 0 {
+			service.IDEnvVar = fmt.Sprintf("SERVICE_ID_%d", i)
+			service.ProxyIDEnvVar = fmt.Sprintf("PROXY_SERVICE_ID_%d", i)
+			service.AdminBind = fmt.Sprintf("127.0.0.1:%d", 19000+i)
+			service.Suffix = fmt.Sprintf("-%d", i)
+		}
+
+		// If a port is specified, then we determine the value of that port
+		// and register that port for the host service.
+		if ports != nil {
+			port, err := portValue(pod, strings.TrimSpace(ports[i]))
+			if err != nil {
+				return nil, fmt.Errorf("%s annotation value of %q is invalid: %s",
+					annotationPort, pod.Annotations[annotationPort], err)
+			}
+			if port < 1 || port > 65535 {
+				return nil, fmt.Errorf("%s annotation value of %q is invalid: "+
+					"%d is not a valid port", annotationPort,
+					pod.Annotations[annotationPort], port)
+			}
+			service.Port = port
+		}
+
+		services = append(services, service)
+	}
+
+	// The services may listen on ports that the containers don't declare,
+	// so check them against the proxy ports too.
+	if serviceOnly {
+		return services, nil
+	}
+	for _, service := range services {
+		for _, other := range services {
+			if service.Port == other.ProxyPort {
+				return nil, fmt.Errorf("%s annotation value of %q is invalid: "+
+					"port %d of service %s is also the proxy port of service %s",
+					annotationPort, pod.Annotations[annotationPort], service.Port,
+					service.Name, other.Name)
+			}
+		}
+	}
+
+	return services, nil
+}
+
+// checkDurations returns the interval, timeout and deregister-after
+// durations of the generated health checks, formatted for service.hcl. The
+// annotations of the pod override the defaults of the handler. The timeout
+// is empty if neither sets it.
+func (h *Handler) checkDurations(pod *corev1.Pod) (string, string, string, error) {
+	interval, timeout, deregister := h.CheckInterval, h.CheckTimeout, h.CheckDeregisterCriticalAfter
+	if interval == 0 {
+		interval = DefaultCheckInterval
+	}
+	if deregister == 0 {
+		deregister = DefaultCheckDeregisterCriticalAfter
+	}
+
+	for _, d := range []struct {
+		annotation string
+		value      *time.Duration
+	}{
+		{annotationCheckInterval, &interval},
+		{annotationCheckTimeout, &timeout},
+		{annotationCheckDeregisterCriticalAfter, &deregister},
+	} {
+		raw, ok := pod.Annotations[d.annotation]
+		if !ok {
+			continue
+		}
+		value, err := time.ParseDuration(raw)
+		if err != nil || value <= 0 {
+			return "", "", "", fmt.Errorf("%s annotation value of %q is not a valid positive duration",
+				d.annotation, raw)
+		}
+		*d.value = value
+	}
+	if deregister < minCheckDeregisterCriticalAfter {
+		return "", "", "", fmt.Errorf("%s of %s must be at least %s",
+			annotationCheckDeregisterCriticalAfter, hclDuration(deregister),
+			hclDuration(minCheckDeregisterCriticalAfter))
+	}
+
+	var timeoutStr string
+	if timeout > 0 {
+		timeoutStr = hclDuration(timeout)
+	}
+	return hclDuration(interval), timeoutStr, hclDuration(deregister), nil
+}
+
+// hclDuration formats d like time.Duration.String but leaves out trailing
+// zero units, so that ten minutes is "10m" rather than "10m0s".
+func hclDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// proxyPort returns the port of the public listener of the first sidecar
+// proxy in the pod. The proxies of the other services in the pod use the
+// ports following it. The proxies share the pod's network namespace with
+// its containers, so the ports must not collide with the containers' ports.
+//
+// Pods that use the host network share the node's ports with the node and
+// with each other, so they must choose the port explicitly and it must not
+// collide with the ports of the Consul client agent either.
+func (h *Handler) proxyPort(pod *corev1.Pod, count int) (int32, error) {
+	port := int64(h.DefaultProxyPort)
+	if port == 0 {
+		port = DefaultProxyPort
+	}
+	raw, annotated := pod.Annotations[annotationProxyPort]
+	if annotated {
+		var err error
+		port, err = strconv.ParseInt(raw, 10, 32)
+		if err != nil || port < 1 || port+int64(count)-1 > 65535 {
+			return 0, fmt.Errorf("%s annotation value of %q is not a valid port",
+				annotationProxyPort, raw)
+		}
+	} else if port+int64(count)-1 > 65535 {
+		return 0, fmt.Errorf("default proxy port %d leaves no ports for the proxies of %d services, "+
+			"set the %s annotation to choose another port", port, count, annotationProxyPort)
+	}
+	if pod.Spec.HostNetwork && !annotated {
+		return 0, fmt.Errorf("%s annotation must be set for pods that use the host network",
+			annotationProxyPort)
+	}
+
+	used := make(map[int32]string)
+	if pod.Spec.HostNetwork {
+		consulHTTPPort, err := h.consulHTTPPort(pod)
+		if err != nil {
+			return 0, err
+		}
+		consulHTTPSPort := h.ConsulHTTPSPort
+		if consulHTTPSPort == 0 {
+			consulHTTPSPort = DefaultConsulHTTPSPort
+		}
+		used[int32(consulHTTPPort)] = "the Consul HTTP API on the host network"
+		used[int32(consulHTTPSPort)] = "the Consul HTTPS API on the host network"
+		used[consulGRPCPort] = "the Consul gRPC API on the host network"
+	}
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			used[p.ContainerPort] = fmt.Sprintf("container %s", c.Name)
+		}
+	}
+	for i := int32(0); i < int32(count); i++ {
+		user, ok := used[int32(port)+i]
+		if !ok {
+			continue
+		}
+		if annotated {
+			return 0, fmt.Errorf("%s annotation value of %q is invalid: "+
+				"proxy port %d is already used by %s",
+				annotationProxyPort, raw, int32(port)+i, user)
+		}
+		return 0, fmt.Errorf("proxy port %d is already used by %s, "+
+			"set the %s annotation to choose another port",
+			int32(port)+i, user, annotationProxyPort)
+	}
+
+	return int32(port), nil
+}
+
+// parseUpstreams parses the upstreams annotation of the pod. Each upstream
+// is either `<service>:<local-port>[:<datacenter>]` or
+// `prepared_query:<query>:<local-port>`, where the local port can also be
+// the name of a container port.
+func parseUpstreams(pod *corev1.Pod) ([]initContainerCommandUpstreamData, error) {
+	raw, ok := pod.Annotations[annotationUpstreams]
+	if !ok || raw == "" {
+		return nil, nil
+	}
+
+	var upstreams []initContainerCommandUpstreamData
+	localPorts := make(map[int32]string)
+	// The environment variables of upstream services are named after the
+	// service only, so each service can only be an upstream once.
+	services := make(map[string]string)
+	for _, raw := range strings.Split(raw, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		parts := strings.Split(raw, ":")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+
+		var upstream initContainerCommandUpstreamData
+		var rawPort string
+		switch {
+		case parts[0] == "prepared_query" && len(parts) == 3:
+			upstream.Query = parts[1]
+			rawPort = parts[2]
+		case parts[0] != "prepared_query" && (len(parts) == 2 || len(parts) == 3):
+			upstream.Name = parts[0]
+			rawPort = parts[1]
+
+			// parse the optional datacenter
+			if len(parts) == 3 {
+				upstream.Datacenter = parts[2]
+			}
+		default:
+			return nil, fmt.Errorf("%s: upstream %q must be in the format "+
+				"<service>:<port>[:<datacenter>] or prepared_query:<query>:<port>",
+				annotationUpstreams, raw)
+		}
+		if upstream.Name == "" && upstream.Query == "" {
+			return nil, fmt.Errorf("%s: upstream %q is missing a destination name",
+				annotationUpstreams, raw)
+		}
+		if name := upstream.Name + upstream.Query; !upstreamNameFormat.MatchString(name) {
+			return nil, fmt.Errorf("%s: upstream %q has an invalid destination name %q, "+
+				"it must only contain alphanumeric, '.', '-' or '_' characters",
+				annotationUpstreams, raw, name)
+		}
+		if len(parts) == 3 && upstream.Name != "" && !upstreamNameFormat.MatchString(upstream.Datacenter) {
+			return nil, fmt.Errorf("%s: upstream %q has an invalid datacenter %q, "+
+				"it must only contain alphanumeric, '.', '-' or '_' characters",
+				annotationUpstreams, raw, upstream.Datacenter)
+		}
+
+		port, err := portValue(pod, rawPort)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("%s: upstream %q has an invalid local port %q",
+				annotationUpstreams, raw, rawPort)
+		}
+		if other, ok := localPorts[port]; ok {
+			return nil, fmt.Errorf("%s: upstreams %q and %q use the same local port %d",
+				annotationUpstreams, other, raw, port)
+		}
+		localPorts[port] = raw
+		upstream.LocalPort = port
+		if upstream.Name != "" {
+			if other, ok := services[upstream.Name]; ok {
+				return nil, fmt.Errorf("%s: upstreams %q and %q have the same service %q, "+
+					"a service can only be an upstream once",
+					annotationUpstreams, other, raw, upstream.Name)
+			}
+			services[upstream.Name] = raw
+		}
+
+		upstreams = append(upstreams, upstream)
+	}
+
+	return upstreams, nil
+}
+
+// validateMeta validates service metadata collected from the meta
+// annotations against the rules Consul applies to service metadata. The
+// keys are validated in order so that the same error is returned for a
+// pod every time.
+func validateMeta(meta map[string]string) error {
+	if len(meta) > metaMaxKeyPairs {
+		return fmt.Errorf("service metadata cannot contain more than %d key/value pairs",
+			metaMaxKeyPairs)
+	}
+
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := meta[key]
+		annotation := annotationMeta + key
+		if len(key) > metaKeyMaxLength {
+			return fmt.Errorf("%s: key is longer than %d characters", annotation,
+				metaKeyMaxLength)
+		}
+		if !metaKeyFormat.MatchString(key) {
+			return fmt.Errorf("%s: key must only contain alphanumeric, "+
+				"'-' or '_' characters", annotation)
+		}
+		if strings.HasPrefix(strings.ToLower(key), metaKeyReservedPrefix) {
+			return fmt.Errorf("%s: key prefix %q is reserved for Consul", annotation,
+				metaKeyReservedPrefix)
+		}
+		if len(value) > metaValueMaxLength {
+			return fmt.Errorf("%s: value is longer than %d characters", annotation,
+				metaValueMaxLength)
+		}
+	}
+
+	return nil
+}
+
+// ParseCopyLabelsToMeta parses the labels to copy into service metadata,
+// each given as labelKey=metaKey or as a bare label key that is also the
+// metadata key. It returns a map of label keys to metadata keys. The
+// metadata keys must be valid keys of Consul service metadata.
+func ParseCopyLabelsToMeta(values []string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, raw := range values {
+		label, key := raw, raw
+		if i := strings.Index(raw, "="); i >= 0 {
+			label, key = raw[:i], raw[i+1:]
+		}
+		if label == "" || key == "" {
+			return nil, fmt.Errorf("%q must be a label key or labelKey=metaKey", raw)
+		}
+		if len(key) > metaKeyMaxLength {
+			return nil, fmt.Errorf("%q: metadata key is longer than %d characters",
+				raw, metaKeyMaxLength)
+		}
+		if !metaKeyFormat.MatchString(key) {
+			return nil, fmt.Errorf("%q: metadata key must only contain alphanumeric, "+
+				"'-' or '_' characters, use labelKey=metaKey to choose another key", raw)
+		}
+		if strings.HasPrefix(strings.ToLower(key), metaKeyReservedPrefix) {
+			return nil, fmt.Errorf("%q: metadata key prefix %q is reserved for Consul",
+				raw, metaKeyReservedPrefix)
+		}
+		result[label] = key
+	}
+
+	return result, nil
+}
+
+// proxyConfig returns the opaque config of the first proxy from the
+// proxy-config annotation, with the values rendered as HCL that can be
+// written to the service file.
+func (h *Handler) proxyConfig(pod *corev1.Pod) (map[string]string, error) {
+	config := make(map[string]string)
+	raw, ok := pod.Annotations[annotationProxyConfig]
+	if !ok {
+		return config, nil
+	}
+
+	// The decoder stops after the first JSON value, so anything following
+	// it is an error too.
+	var values map[string]interface{}
+	var extra interface{}
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil || values == nil ||
+		decoder.Decode(&extra) != io.EOF {
+		return nil, fmt.Errorf("%s annotation value of %q is not a JSON object",
+			annotationProxyConfig, raw)
+	}
+	for key, value := range values {
+		hcl, err := hclValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s annotation: key %q: %s", annotationProxyConfig, key, err)
+		}
+		config[hclKey(key)] = hcl
+	}
+
+	return config, nil
+}
+
+// setProxyConfig sets a string value of the proxy config that the injector
+// manages, replacing the value from the proxy-config annotation if any.
+func (h *Handler) setProxyConfig(config map[string]string, key, value string) {
+	hcl, _ := hclValue(value)
+	if old, ok := config[key]; ok && old != hcl {
+		h.Log.Warn("Overriding proxy config from annotation", "Key", key,
+			"Annotation", annotationProxyConfig)
+	}
+	config[key] = hcl
+}
+
+// hclKey returns the key as an HCL object key, quoted unless it is an
+// identifier.
+func hclKey(key string) string {
+	if hclIdentifier.MatchString(key) {
+		return key
+	}
+	return hclString(key)
+}
+
+var hclIdentifier = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// hclValue renders a value decoded from JSON as HCL. The service file is
+// written with an unquoted heredoc, so strings are escaped for the shell
+// too.
+func hclValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return hclString(v), nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			hcl, err := hclValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, hcl)
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case map[string]interface{}:
+		var keys []string
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var items []string
+		for _, key := range keys {
+			hcl, err := hclValue(v[key])
+			if err != nil {
+				return "", err
+			}
+			items = append(items, fmt.Sprintf("%s = %s", hclKey(key), hcl))
+		}
+		return "{ " + strings.Join(items, ", ") + " }", nil
+	default:
+		return "", fmt.Errorf("null values are not supported")
+	}
+}
+
+// hclString quotes a string for HCL and escapes it for the heredoc the
+// service file is written with.
+func hclString(s string) string {
+	return heredocEscape(strconv.Quote(s))
+}
+
+// heredocEscape escapes the characters that the shell expands in an
+// unquoted heredoc, so that s is written to the file as is.
+func heredocEscape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `$`, `\$`, -1)
+	s = strings.Replace(s, "`", "\\`", -1)
+	return s
+}
+
+// splitTags splits the comma-separated value of a tags annotation. A comma
+// that is part of a tag can be escaped with a backslash. Whitespace around
+// each tag is trimmed and empty tags are dropped.
+func splitTags(raw string) []string {
+	var tags []string
+	var tag strings.Builder
+	flush := func() {
+		if t := strings.TrimSpace(tag.String()); t != "" {
+			tags = append(tags, t)
+		}
+		tag.Reset()
+	}
+
+	for i := 0; i < len(raw); i++ {
+		switch {
+		case raw[i] == '\\' && i+1 < len(raw) && raw[i+1] == ',':
+			tag.WriteByte(',')
+			i++
+		case raw[i] == ',':
+			flush()
+		default:
+			tag.WriteByte(raw[i])
+		}
+	}
+	flush()
+
+	return tags
+}
+
 // initContainerCommandTpl is the template for the command executed by
 // the init container.
-const initContainerCommandTpl = `
-export CONSUL_HTTP_ADDR="${HOST_IP}:8500"
-export CONSUL_GRPC_ADDR="${HOST_IP}:8502"
+const initContainerCommandTpl = hostAddrCommand + podAddrCommand + `
+export CONSUL_HTTP_ADDR="{{ .ConsulHTTPAddr }}"
+{{- if .ConsulCACert }}
+export CONSUL_GRPC_ADDR="https://${HOST_ADDR}:8502"
+
+# Write the CA certificate of the Consul agents. The certificate is stored
+# in the volume so that the preStop hook can access it too.
+cat <<EOF >/consul/connect-inject/consul-ca.pem
+{{ .ConsulCACert }}
+EOF
+{{- else }}
+export CONSUL_GRPC_ADDR="${HOST_ADDR}:8502"
+{{- end }}
 
 # Register the service. The HCL is stored in the volume so that
 # the preStop hook can access it to deregister the service.
 cat <<EOF >/consul/connect-inject/service.hcl
+{{- range $i, $service := .Services }}
+{{- if $i }}
+{{ end }}
+{{- if not $.ServiceOnly }}
 services {
-  id   = "${PROXY_SERVICE_ID}"
-  name = "{{ .ProxyServiceName }}"
+  id   = "{{ printf "${%s}" .ProxyIDEnvVar }}"
+  name = "{{ .ProxyName }}"
+  {{- if $.Partition }}
+  partition = "{{ $.Partition }}"
+  {{- end }}
+  {{- if $.Namespace }}
+  namespace = "{{ $.Namespace }}"
+  {{- end }}
   kind = "connect-proxy"
   address = "${POD_IP}"
-  port = 20000
+  port = {{ .ProxyPort }}
   {{- if .Tags}}
   tags = {{.Tags}}
   {{- end}}
   {{- if .Meta}}
   meta = {
     {{- range $key, $value := .Meta }}
-    {{$key}} = "{{$value}}"
+    {{$key}} = {{$value}}
     {{- end }}
   }
   {{- end}}
 
   proxy {
-    destination_service_name = "{{ .ServiceName }}"
-    destination_service_id = "${SERVICE_ID}"
-    {{- if (gt .ServicePort 0) }}
+    destination_service_name = "{{ .Name }}"
+    destination_service_id = "{{ printf "${%s}" .IDEnvVar }}"
+    {{- if $.TProxyOutboundListenerPort }}
+    mode = "transparent"
+    transparent_proxy {
+      outbound_listener_port = {{ $.TProxyOutboundListenerPort }}
+    }
+    {{- end }}
+    {{- if $.LocalServiceAddress }}
+    local_service_address = "{{ $.LocalServiceAddress }}"
+    {{- else if (gt .Port 0) }}
     local_service_address = "127.0.0.1"
-    local_service_port = {{ .ServicePort }}
+    {{- end }}
+    {{- if (gt .Port 0) }}
+    local_service_port = {{ .Port }}
+    {{- end }}
+    {{- if .ProxyConfig }}
+    config {
+      {{- range $key, $value := .ProxyConfig }}
+      {{ $key }} = {{ $value }}
+      {{- end }}
+    }
+    {{- end }}
+    {{- if .ExposePaths }}
+    expose {
+      {{- range .ExposePaths }}
+      paths {
+        path = "{{ .Path }}"
+        local_path_port = {{ .LocalPathPort }}
+        listener_port = {{ .ListenerPort }}
+        protocol = "http"
+      }
+      {{- end }}
+    }
     {{- end }}
     {{- range .Upstreams }}
     upstreams {
       {{- if .Name }}
       destination_type = "service" 
-      destination_name = "{{ .Name }}"
+      destination_name = {{ hclString .Name }}
       {{- end}}
       {{- if .Query }}
       destination_type = "prepared_query" 
-      destination_name = "{{ .Query}}"
+      destination_name = {{ hclString .Query }}
       {{- end}}
       local_bind_port = {{ .LocalPort }}
       {{- if .Datacenter }}
-      datacenter = "{{ .Datacenter }}"
+      datacenter = {{ hclString .Datacenter }}
       {{- end}}
     }
     {{- end }}
@@ -249,57 +1006,85 @@ services {
 
   checks {
     name = "Proxy Public Listener"
-    tcp = "${POD_IP}:20000"
-    interval = "10s"
-    deregister_critical_service_after = "10m"
+    tcp = "${POD_ADDR}:{{ .ProxyPort }}"
+    interval = "{{ $.CheckInterval }}"
+    {{- if $.CheckTimeout }}
+    timeout = "{{ $.CheckTimeout }}"
+    {{- end }}
+    deregister_critical_service_after = "{{ $.CheckDeregisterCriticalAfter }}"
   }
 
   checks {
     name = "Destination Alias"
-    alias_service = "{{ .ServiceName }}"
+    alias_service = "{{ .Name }}"
   }
 }
-
+{{ end }}
 services {
-  id   = "${SERVICE_ID}"
-  name = "{{ .ServiceName }}"
+  id   = "{{ printf "${%s}" .IDEnvVar }}"
+  name = "{{ .Name }}"
+  {{- if $.Partition }}
+  partition = "{{ $.Partition }}"
+  {{- end }}
+  {{- if $.Namespace }}
+  namespace = "{{ $.Namespace }}"
+  {{- end }}
   address = "${POD_IP}"
-  port = {{ .ServicePort }}
+  port = {{ .Port }}
   {{- if .Tags}}
   tags = {{.Tags}}
   {{- end}}
   {{- if .Meta}}
   meta = {
     {{- range $key, $value := .Meta }}
-    {{$key}} = "{{$value}}"
+    {{$key}} = {{$value}}
     {{- end }}
   }
   {{- end}}
 }
+{{- end }}
 EOF
 
 {{- if .WriteServiceDefaults }}
+{{- range .Services }}
 # Create the service-defaults config for the service
-cat <<EOF >/consul/connect-inject/service-defaults.hcl
+cat <<EOF >/consul/connect-inject/service-defaults{{ .Suffix }}.hcl
 kind = "service-defaults"
-name = "{{ .ServiceName }}"
-protocol = "{{ .ServiceProtocol }}"
+name = "{{ .Name }}"
+{{- if $.Partition }}
+partition = "{{ $.Partition }}"
+{{- end }}
+{{- if $.Namespace }}
+namespace = "{{ $.Namespace }}"
+{{- end }}
+protocol = "{{ $.ServiceProtocol }}"
 EOF
 {{- end }}
-{{- if .AuthMethod }}
-/bin/consul login -method="{{ .AuthMethod }}" \
-  -bearer-token-file="/var/run/secrets/kubernetes.io/serviceaccount/token" \
-  -token-sink-file="/consul/connect-inject/acl-token" \
-  -meta="pod=${POD_NAMESPACE}/${POD_NAME}"
 {{- end }}
 {{- if .WriteServiceDefaults }}
 {{- /* We use -cas and -modify-index 0 so that if a service-defaults config
-       already exists for this service, we don't override it */}}
+       already exists for this service, we don't override it. Pods of the
+       same service could disagree on the protocol, so we warn if the
+       existing config doesn't match ours rather than flip-flopping it */}}
+{{- range .Services }}
 /bin/consul config write -cas -modify-index 0 \
-  {{- if .AuthMethod }}
+  {{- if $.AuthMethod }}
+  -token-file="/consul/connect-inject/acl-token" \
+  {{- end }}
+  /consul/connect-inject/service-defaults{{ .Suffix }}.hcl || \
+  /bin/consul config read -kind service-defaults -name "{{ .Name }}" \
+  {{- if $.Partition }}
+  -partition="{{ $.Partition }}" \
+  {{- end }}
+  {{- if $.Namespace }}
+  -namespace="{{ $.Namespace }}" \
+  {{- end }}
+  {{- if $.AuthMethod }}
   -token-file="/consul/connect-inject/acl-token" \
   {{- end }}
-  /consul/connect-inject/service-defaults.hcl || true
+  | grep -q '"Protocol": "{{ $.ServiceProtocol }}"' || \
+  echo "WARNING: the service-defaults config for {{ .Name }} does not have protocol {{ $.ServiceProtocol }}, leaving it unchanged"
+{{- end }}
 {{- end }}
 
 /bin/consul services register \
@@ -308,13 +1093,27 @@ EOF
   {{- end }}
   /consul/connect-inject/service.hcl
 
+{{- if not .ServiceOnly }}
+
 # Generate the envoy bootstrap code
+{{- range .Services }}
 /bin/consul connect envoy \
-  -proxy-id="${PROXY_SERVICE_ID}" \
-  {{- if .AuthMethod }}
+  -proxy-id="{{ printf "${%s}" .ProxyIDEnvVar }}" \
+  {{- if $.Partition }}
+  -partition="{{ $.Partition }}" \
+  {{- end }}
+  {{- if $.Namespace }}
+  -namespace="{{ $.Namespace }}" \
+  {{- end }}
+  {{- if .AdminBind }}
+  -admin-bind="{{ .AdminBind }}" \
+  {{- end }}
+  {{- if $.AuthMethod }}
   -token-file="/consul/connect-inject/acl-token" \
   {{- end }}
-  -bootstrap > /consul/connect-inject/envoy-bootstrap.yaml
+  -bootstrap > /consul/connect-inject/envoy-bootstrap{{ .Suffix }}.yaml
+{{- end }}
+{{- end }}
 
 # Copy the Consul binary
 cp /bin/consul /consul/connect-inject/consul
@@ -2,9 +2,12 @@ package connectinject
 
 import (
 	"fmt"
+	"os/exec"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -46,8 +49,13 @@ func TestHandlerContainerInit(t *testing.T) {
 				pod.Annotations[annotationService] = "web"
 				return pod
 			},
-			`/bin/sh -ec export CONSUL_HTTP_ADDR="${HOST_IP}:8500"
-export CONSUL_GRPC_ADDR="${HOST_IP}:8502"
+			`/bin/sh -ec HOST_ADDR="${HOST_IP}"
+case "${HOST_ADDR}" in *:*) HOST_ADDR="[${HOST_ADDR}]" ;; esac
+POD_ADDR="${POD_IP}"
+case "${POD_ADDR}" in *:*) POD_ADDR="[${POD_ADDR}]" ;; esac
+
+export CONSUL_HTTP_ADDR="${HOST_ADDR}:8500"
+export CONSUL_GRPC_ADDR="${HOST_ADDR}:8502"
 
 # Register the service. The HCL is stored in the volume so that
 # the preStop hook can access it to deregister the service.
@@ -66,7 +74,7 @@ services {
 
   checks {
     name = "Proxy Public Listener"
-    tcp = "${POD_IP}:20000"
+    tcp = "${POD_ADDR}:20000"
     interval = "10s"
     deregister_critical_service_after = "10m"
   }
@@ -121,7 +129,7 @@ cp /bin/consul /consul/connect-inject/consul`,
 
   checks {
     name = "Proxy Public Listener"
-    tcp = "${POD_IP}:20000"
+    tcp = "${POD_ADDR}:20000"
     interval = "10s"
     deregister_critical_service_after = "10m"
   }
@@ -234,7 +242,7 @@ services {
 
   checks {
     name = "Proxy Public Listener"
-    tcp = "${POD_IP}:20000"
+    tcp = "${POD_ADDR}:20000"
     interval = "10s"
     deregister_critical_service_after = "10m"
   }
@@ -280,7 +288,7 @@ services {
 
   checks {
     name = "Proxy Public Listener"
-    tcp = "${POD_IP}:20000"
+    tcp = "${POD_ADDR}:20000"
     interval = "10s"
     deregister_critical_service_after = "10m"
   }
@@ -326,7 +334,7 @@ services {
 
   checks {
     name = "Proxy Public Listener"
-    tcp = "${POD_IP}:20000"
+    tcp = "${POD_ADDR}:20000"
     interval = "10s"
     deregister_critical_service_after = "10m"
   }
@@ -362,7 +370,7 @@ services {
   kind = "connect-proxy"
   address = "${POD_IP}"
   port = 20000
-  tags = ["abc","123","abc","123","def","456"]
+  tags = ["abc","123","def","456"]
 
   proxy {
     destination_service_name = "web"
@@ -373,7 +381,7 @@ services {
 
   checks {
     name = "Proxy Public Listener"
-    tcp = "${POD_IP}:20000"
+    tcp = "${POD_ADDR}:20000"
     interval = "10s"
     deregister_critical_service_after = "10m"
   }
@@ -389,11 +397,55 @@ services {
   name = "web"
   address = "${POD_IP}"
   port = 1234
-  tags = ["abc","123","abc","123","def","456"]
+  tags = ["abc","123","def","456"]
 }`,
 			"",
 		},
 
+		{
+			"Tags with whitespace and empty entries",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Annotations[annotationTags] = " abc , ,123,"
+				return pod
+			},
+			`tags = ["abc","123"]`,
+			"",
+		},
+
+		{
+			"Tags with escaped comma",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Annotations[annotationTags] = `abc\,def,123`
+				return pod
+			},
+			`tags = ["abc,def","123"]`,
+			"",
+		},
+
+		{
+			"Tags with shell characters",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Annotations[annotationTags] = "$(id),`id`"
+				return pod
+			},
+			"tags = [\"\\$(id)\",\"\\`id\\`\"]",
+			"",
+		},
+
+		{
+			"Tags annotation with no tags",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Annotations[annotationTags] = " , "
+				return pod
+			},
+			"",
+			`tags`,
+		},
+
 		{
 			"No Tags specified",
 			func(pod *corev1.Pod) *corev1.Pod {
@@ -432,7 +484,7 @@ services {
 
   checks {
     name = "Proxy Public Listener"
-    tcp = "${POD_IP}:20000"
+    tcp = "${POD_ADDR}:20000"
     interval = "10s"
     deregister_critical_service_after = "10m"
   }
@@ -456,6 +508,20 @@ services {
 			"",
 		},
 
+		{
+			"Metadata with shell characters",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Annotations[fmt.Sprintf("%sname", annotationMeta)] = `a"$(id)`
+				return pod
+			},
+			`
+  meta = {
+    name = "a\\"\$(id)"
+  }`,
+			"",
+		},
+
 		{
 			"No Metadata specified",
 			func(pod *corev1.Pod) *corev1.Pod {
@@ -526,7 +592,10 @@ name = "foo"
 protocol = "grpc"
 EOF
 /bin/consul config write -cas -modify-index 0 \
-  /consul/connect-inject/service-defaults.hcl || true
+  /consul/connect-inject/service-defaults.hcl || \
+  /bin/consul config read -kind service-defaults -name "foo" \
+  | grep -q '"Protocol": "grpc"' || \
+  echo "WARNING: the service-defaults config for foo does not have protocol grpc, leaving it unchanged"
 
 /bin/consul services register \
   /consul/connect-inject/service.hcl
@@ -574,7 +643,10 @@ name = "foo"
 protocol = "grpc"
 EOF
 /bin/consul config write -cas -modify-index 0 \
-  /consul/connect-inject/service-defaults.hcl || true
+  /consul/connect-inject/service-defaults.hcl || \
+  /bin/consul config read -kind service-defaults -name "foo" \
+  | grep -q '"Protocol": "grpc"' || \
+  echo "WARNING: the service-defaults config for foo does not have protocol grpc, leaving it unchanged"
 
 /bin/consul services register \
   /consul/connect-inject/service.hcl
@@ -618,12 +690,9 @@ func TestHandlerContainerInit_authMethod(t *testing.T) {
 	container, err := h.containerInit(pod)
 	require.NoError(err)
 	actual := strings.Join(container.Command, " ")
+	// The login is done by the ACL init container.
+	require.NotContains(actual, "/bin/consul login")
 	require.Contains(actual, `
-/bin/consul login -method="release-name-consul-k8s-auth-method" \
-  -bearer-token-file="/var/run/secrets/kubernetes.io/serviceaccount/token" \
-  -token-sink-file="/consul/connect-inject/acl-token" \
-  -meta="pod=${POD_NAMESPACE}/${POD_NAME}"
-
 /bin/consul services register \
   -token-file="/consul/connect-inject/acl-token" \
   /consul/connect-inject/service.hcl
@@ -674,13 +743,13 @@ kind = "service-defaults"
 name = "foo"
 protocol = "grpc"
 EOF
-/bin/consul login -method="release-name-consul-k8s-auth-method" \
-  -bearer-token-file="/var/run/secrets/kubernetes.io/serviceaccount/token" \
-  -token-sink-file="/consul/connect-inject/acl-token" \
-  -meta="pod=${POD_NAMESPACE}/${POD_NAME}"
 /bin/consul config write -cas -modify-index 0 \
   -token-file="/consul/connect-inject/acl-token" \
-  /consul/connect-inject/service-defaults.hcl || true
+  /consul/connect-inject/service-defaults.hcl || \
+  /bin/consul config read -kind service-defaults -name "foo" \
+  -token-file="/consul/connect-inject/acl-token" \
+  | grep -q '"Protocol": "grpc"' || \
+  echo "WARNING: the service-defaults config for foo does not have protocol grpc, leaving it unchanged"
 
 /bin/consul services register \
   -token-file="/consul/connect-inject/acl-token" \
@@ -727,8 +796,1991 @@ kind = "service-defaults"
 name = "foo"
 protocol = ""
 EOF`)
-	require.NotContains(actual, `
-/bin/consul config write -cas -modify-index 0 \
-  -token-file="/consul/connect-inject/acl-token" \
-  /consul/connect-inject/service-defaults.hcl || true`)
+	require.NotContains(actual, `/bin/consul config write`)
+}
+
+// Test that the Consul HTTP port can be set on the handler and overridden
+// by the pod annotation.
+func TestHandlerContainerInit_consulHTTPPort(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Handler     Handler
+		Annotations map[string]string
+		Cmd         string
+		Err         string
+	}{
+		{
+			"default",
+			Handler{},
+			nil,
+			`export CONSUL_HTTP_ADDR="${HOST_ADDR}:8500"`,
+			"",
+		},
+
+		{
+			"handler port",
+			Handler{ConsulHTTPPort: 8501},
+			nil,
+			`export CONSUL_HTTP_ADDR="${HOST_ADDR}:8501"`,
+			"",
+		},
+
+		{
+			"annotation overrides handler port",
+			Handler{ConsulHTTPPort: 8501},
+			map[string]string{annotationConsulHTTPPort: "18500"},
+			`export CONSUL_HTTP_ADDR="${HOST_ADDR}:18500"`,
+			"",
+		},
+
+		{
+			"non-numeric annotation",
+			Handler{},
+			map[string]string{annotationConsulHTTPPort: "http"},
+			"",
+			`consul.hashicorp.com/consul-http-port annotation value of "http" is not a valid port`,
+		},
+
+		{
+			"out of range annotation",
+			Handler{},
+			map[string]string{annotationConsulHTTPPort: "65536"},
+			"",
+			`consul.hashicorp.com/consul-http-port annotation value of "65536" is not a valid port`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "foo",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			container, err := tt.Handler.containerInit(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			actual := strings.Join(container.Command, " ")
+			require.Contains(actual, tt.Cmd)
+		})
+	}
+}
+
+func TestHandlerContainerInit_consulTLS(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Handler     Handler
+		Annotations map[string]string
+		TLS         bool
+		Cmd         string
+	}{
+		{
+			"no CA cert",
+			Handler{},
+			nil,
+			false,
+			`export CONSUL_HTTP_ADDR="${HOST_ADDR}:8500"
+export CONSUL_GRPC_ADDR="${HOST_ADDR}:8502"`,
+		},
+
+		{
+			"CA cert",
+			Handler{ConsulCACert: "consul-ca-cert"},
+			nil,
+			true,
+			`export CONSUL_HTTP_ADDR="https://${HOST_ADDR}:8501"
+export CONSUL_GRPC_ADDR="https://${HOST_ADDR}:8502"
+
+# Write the CA certificate of the Consul agents. The certificate is stored
+# in the volume so that the preStop hook can access it too.
+cat <<EOF >/consul/connect-inject/consul-ca.pem
+consul-ca-cert
+EOF`,
+		},
+
+		{
+			"CA cert with HTTPS port",
+			Handler{ConsulCACert: "consul-ca-cert", ConsulHTTPSPort: 443},
+			nil,
+			true,
+			`export CONSUL_HTTP_ADDR="https://${HOST_ADDR}:443"`,
+		},
+
+		{
+			"CA cert with pod opted out",
+			Handler{ConsulCACert: "consul-ca-cert"},
+			map[string]string{annotationConsulTLS: "false"},
+			false,
+			`export CONSUL_HTTP_ADDR="${HOST_ADDR}:8500"
+export CONSUL_GRPC_ADDR="${HOST_ADDR}:8502"`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "foo",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			container, err := tt.Handler.containerInit(pod)
+			require.NoError(err)
+			actual := strings.Join(container.Command, " ")
+			require.Contains(actual, tt.Cmd)
+
+			var caCertEnv *corev1.EnvVar
+			for i, env := range container.Env {
+				if env.Name == "CONSUL_CACERT" {
+					caCertEnv = &container.Env[i]
+				}
+			}
+			if tt.TLS {
+				require.NotNil(caCertEnv)
+				require.Equal("/consul/connect-inject/consul-ca.pem", caCertEnv.Value)
+			} else {
+				require.Nil(caCertEnv)
+				require.NotContains(actual, "consul-ca.pem")
+			}
+		})
+	}
+}
+
+// Test that invalid metadata annotations are rejected.
+func TestHandlerContainerInit_invalidMeta(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Annotations map[string]string
+		Err         string
+	}{
+		{
+			"invalid characters in key",
+			map[string]string{annotationMeta + "build.sha": "abc"},
+			"consul.hashicorp.com/service-meta-build.sha: key must only contain alphanumeric, '-' or '_' characters",
+		},
+
+		{
+			"key too long",
+			map[string]string{annotationMeta + strings.Repeat("a", 129): "abc"},
+			"key is longer than 128 characters",
+		},
+
+		{
+			"reserved key prefix",
+			map[string]string{annotationMeta + "consul-version": "1.6.0"},
+			`consul.hashicorp.com/service-meta-consul-version: key prefix "consul-" is reserved for Consul`,
+		},
+
+		{
+			"reserved key prefix in different case",
+			map[string]string{annotationMeta + "Consul-version": "1.6.0"},
+			`key prefix "consul-" is reserved for Consul`,
+		},
+
+		{
+			"value too long",
+			map[string]string{annotationMeta + "version": strings.Repeat("a", 513)},
+			"consul.hashicorp.com/service-meta-version: value is longer than 512 characters",
+		},
+
+		{
+			"first invalid key in order",
+			map[string]string{
+				annotationMeta + "z-key!":     "value",
+				annotationMeta + "consul-key": "value",
+				annotationMeta + "a-key!":     "value",
+			},
+			"consul.hashicorp.com/service-meta-a-key!: key must only contain",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "foo",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			var h Handler
+			_, err := h.containerInit(pod)
+			require.Error(err)
+			require.Contains(err.Error(), tt.Err)
+		})
+	}
+}
+
+func TestHandlerParseUpstreams(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Value    string
+		Expected []initContainerCommandUpstreamData
+		Err      string
+	}{
+		{
+			"empty",
+			"",
+			nil,
+			"",
+		},
+
+		{
+			"service",
+			"db:1234",
+			[]initContainerCommandUpstreamData{
+				{Name: "db", LocalPort: 1234},
+			},
+			"",
+		},
+
+		{
+			"service with datacenter",
+			"billing:9090:dc2",
+			[]initContainerCommandUpstreamData{
+				{Name: "billing", LocalPort: 9090, Datacenter: "dc2"},
+			},
+			"",
+		},
+
+		{
+			"prepared query",
+			"prepared_query:geo-db:8001",
+			[]initContainerCommandUpstreamData{
+				{Query: "geo-db", LocalPort: 8001},
+			},
+			"",
+		},
+
+		{
+			"named port",
+			"db:http",
+			[]initContainerCommandUpstreamData{
+				{Name: "db", LocalPort: 8080},
+			},
+			"",
+		},
+
+		{
+			"multiple with whitespace and empty entries",
+			" db : 1234 , prepared_query:geo-db:8001,,billing:9090:dc2,",
+			[]initContainerCommandUpstreamData{
+				{Name: "db", LocalPort: 1234},
+				{Query: "geo-db", LocalPort: 8001},
+				{Name: "billing", LocalPort: 9090, Datacenter: "dc2"},
+			},
+			"",
+		},
+
+		{
+			"missing port",
+			"db",
+			nil,
+			`upstream "db" must be in the format`,
+		},
+
+		{
+			"too many parts",
+			"db:1234:dc1:extra",
+			nil,
+			`upstream "db:1234:dc1:extra" must be in the format`,
+		},
+
+		{
+			"prepared query missing port",
+			"prepared_query:geo-db",
+			nil,
+			`upstream "prepared_query:geo-db" must be in the format`,
+		},
+
+		{
+			"missing service name",
+			":1234",
+			nil,
+			`upstream ":1234" is missing a destination name`,
+		},
+
+		{
+			"missing prepared query name",
+			"prepared_query::8001",
+			nil,
+			`upstream "prepared_query::8001" is missing a destination name`,
+		},
+
+		{
+			"invalid prepared query name",
+			`prepared_query:geo"$(id):8001`,
+			nil,
+			`upstream "prepared_query:geo\"$(id):8001" has an invalid destination name "geo\"$(id)"`,
+		},
+
+		{
+			"invalid datacenter",
+			"billing:9090:dc`id`",
+			nil,
+			"upstream \"billing:9090:dc`id`\" has an invalid datacenter \"dc`id`\"",
+		},
+
+		{
+			"empty datacenter",
+			"billing:9090:",
+			nil,
+			`upstream "billing:9090:" has an invalid datacenter ""`,
+		},
+
+		{
+			"invalid port",
+			"db:abc",
+			nil,
+			`upstream "db:abc" has an invalid local port "abc"`,
+		},
+
+		{
+			"out of range port",
+			"db:70000",
+			nil,
+			`upstream "db:70000" has an invalid local port "70000"`,
+		},
+
+		{
+			"duplicate local port",
+			"db:1234,prepared_query:geo-db:1234",
+			nil,
+			`upstreams "db:1234" and "prepared_query:geo-db:1234" use the same local port 1234`,
+		},
+
+		{
+			"same service in multiple datacenters",
+			"billing:9090:dc2,billing:9091",
+			nil,
+			`upstreams "billing:9090:dc2" and "billing:9091" have the same service "billing"`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationUpstreams: tt.Value,
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "http",
+									ContainerPort: 8080,
+								},
+							},
+						},
+					},
+				},
+			}
+
+			actual, err := parseUpstreams(pod)
+			if tt.Err != "" {
+				require.Error(err)
+				require.Contains(err.Error(), tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.Expected, actual)
+		})
+	}
+}
+
+// Test the service-defaults config rendered for each protocol and that
+// unknown protocols are rejected.
+func TestHandlerContainerInit_protocol(t *testing.T) {
+	cases := []struct {
+		Protocol string
+		Err      string
+	}{
+		{"grpc", ""},
+		{"http", ""},
+		{"http2", ""},
+		{"tcp", ""},
+		{"udp", `consul.hashicorp.com/connect-service-protocol annotation value of "udp" is not a valid protocol, must be one of tcp, http, http2, grpc`},
+		{"HTTP", `annotation value of "HTTP" is not a valid protocol`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Protocol, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{
+				WriteServiceDefaults: true,
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService:  "foo",
+						annotationProtocol: tt.Protocol,
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			container, err := h.containerInit(pod)
+			if tt.Err != "" {
+				require.Error(err)
+				require.Contains(err.Error(), tt.Err)
+				return
+			}
+			require.NoError(err)
+			actual := strings.Join(container.Command, " ")
+			require.Contains(actual, fmt.Sprintf(`
+cat <<EOF >/consul/connect-inject/service-defaults.hcl
+kind = "service-defaults"
+name = "foo"
+protocol = "%s"
+EOF`, tt.Protocol))
+			require.Contains(actual, fmt.Sprintf(`| grep -q '"Protocol": "%s"' || \
+  echo "WARNING: the service-defaults config for foo does not have protocol %s, leaving it unchanged"`,
+				tt.Protocol, tt.Protocol))
+		})
+	}
+}
+
+func TestHandlerContainerInit_multipleServices(t *testing.T) {
+	require := require.New(t)
+	h := Handler{
+		WriteServiceDefaults: true,
+		DefaultProtocol:      "http",
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService:   "web,web-admin",
+				annotationPort:      "8080,9090",
+				annotationUpstreams: "db:1234",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+	container, err := h.containerInit(pod)
+	require.NoError(err)
+	actual := strings.Join(container.Command, " ")
+
+	// The upstreams only apply to the first service.
+	require.Contains(actual, `
+  proxy {
+    destination_service_name = "web"
+    destination_service_id = "${SERVICE_ID}"
+    local_service_address = "127.0.0.1"
+    local_service_port = 8080
+    upstreams {
+      destination_type = "service" 
+      destination_name = "db"
+      local_bind_port = 1234
+    }
+  }`)
+	require.Contains(actual, `
+services {
+  id   = "${PROXY_SERVICE_ID_1}"
+  name = "web-admin-sidecar-proxy"
+  kind = "connect-proxy"
+  address = "${POD_IP}"
+  port = 20001
+
+  proxy {
+    destination_service_name = "web-admin"
+    destination_service_id = "${SERVICE_ID_1}"
+    local_service_address = "127.0.0.1"
+    local_service_port = 9090
+  }
+
+  checks {
+    name = "Proxy Public Listener"
+    tcp = "${POD_ADDR}:20001"
+    interval = "10s"
+    deregister_critical_service_after = "10m"
+  }
+
+  checks {
+    name = "Destination Alias"
+    alias_service = "web-admin"
+  }
+}
+
+services {
+  id   = "${SERVICE_ID_1}"
+  name = "web-admin"
+  address = "${POD_IP}"
+  port = 9090
+}
+EOF`)
+	require.Contains(actual, `
+cat <<EOF >/consul/connect-inject/service-defaults-1.hcl
+kind = "service-defaults"
+name = "web-admin"
+protocol = "http"
+EOF`)
+	require.Contains(actual, `
+# Generate the envoy bootstrap code
+/bin/consul connect envoy \
+  -proxy-id="${PROXY_SERVICE_ID}" \
+  -bootstrap > /consul/connect-inject/envoy-bootstrap.yaml
+/bin/consul connect envoy \
+  -proxy-id="${PROXY_SERVICE_ID_1}" \
+  -admin-bind="127.0.0.1:19001" \
+  -bootstrap > /consul/connect-inject/envoy-bootstrap-1.yaml`)
+	require.Contains(container.Env, corev1.EnvVar{
+		Name:  "SERVICE_ID_1",
+		Value: "$(POD_NAME)-web-admin",
+	})
+	require.Contains(container.Env, corev1.EnvVar{
+		Name:  "PROXY_SERVICE_ID_1",
+		Value: "$(POD_NAME)-web-admin-sidecar-proxy",
+	})
+}
+
+func TestHandlerContainerInit_multipleServicesInvalid(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Service string
+		Port    string
+		Err     string
+	}{
+		{
+			"mismatched lengths",
+			"web,web-admin",
+			"8080",
+			"consul.hashicorp.com/connect-service annotation has 2 entries and consul.hashicorp.com/connect-service-port annotation has 1, they must be of equal length",
+		},
+		{
+			"empty service name",
+			"web,",
+			"",
+			`consul.hashicorp.com/connect-service annotation value of "web," contains an empty service name`,
+		},
+		{
+			"duplicate service name",
+			"web, web",
+			"8080,9090",
+			`consul.hashicorp.com/connect-service annotation contains service "web" more than once`,
+		},
+		{
+			"service name with quote",
+			`web,we"b`,
+			"",
+			`consul.hashicorp.com/connect-service annotation contains invalid service name "we\"b", it must only contain alphanumeric, '.', '-' or '_' characters`,
+		},
+		{
+			"service name with command substitution",
+			"web$(id)",
+			"",
+			`consul.hashicorp.com/connect-service annotation contains invalid service name "web$(id)", it must only contain alphanumeric, '.', '-' or '_' characters`,
+		},
+		{
+			"service name with newline",
+			"we\nb",
+			"",
+			`consul.hashicorp.com/connect-service annotation contains invalid service name "we\nb", it must only contain alphanumeric, '.', '-' or '_' characters`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			var h Handler
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: tt.Service,
+						annotationPort:    tt.Port,
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			_, err := h.containerInit(pod)
+			require.EqualError(err, tt.Err)
+		})
+	}
+}
+
+func TestHandlerContainerInit_proxyPort(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Handler     Handler
+		HostNetwork bool
+		Annotations map[string]string
+		Ports       []int32 // expected proxy ports
+		Err         string
+	}{
+		{
+			"default",
+			Handler{},
+			false,
+			nil,
+			[]int32{20000},
+			"",
+		},
+
+		{
+			"annotation",
+			Handler{},
+			false,
+			map[string]string{annotationProxyPort: "21000"},
+			[]int32{21000},
+			"",
+		},
+
+		{
+			"annotation with multiple services",
+			Handler{},
+			false,
+			map[string]string{
+				annotationService:   "web,web-admin",
+				annotationProxyPort: "21000",
+			},
+			[]int32{21000, 21001},
+			"",
+		},
+
+		{
+			"invalid annotation",
+			Handler{},
+			false,
+			map[string]string{annotationProxyPort: "envoy"},
+			nil,
+			`consul.hashicorp.com/connect-sidecar-proxy-port annotation value of "envoy" is not a valid port`,
+		},
+
+		{
+			"out of range with multiple services",
+			Handler{},
+			false,
+			map[string]string{
+				annotationService:   "web,web-admin",
+				annotationProxyPort: "65535",
+			},
+			nil,
+			`consul.hashicorp.com/connect-sidecar-proxy-port annotation value of "65535" is not a valid port`,
+		},
+
+		{
+			"host network",
+			Handler{},
+			true,
+			map[string]string{annotationProxyPort: "21000"},
+			[]int32{21000},
+			"",
+		},
+
+		{
+			"host network without annotation",
+			Handler{},
+			true,
+			nil,
+			nil,
+			"consul.hashicorp.com/connect-sidecar-proxy-port annotation must be set for pods that use the host network",
+		},
+
+		{
+			"host network collides with container port",
+			Handler{},
+			true,
+			map[string]string{annotationProxyPort: "8080"},
+			nil,
+			`consul.hashicorp.com/connect-sidecar-proxy-port annotation value of "8080" is invalid: proxy port 8080 is already used by container web`,
+		},
+
+		{
+			"handler default",
+			Handler{DefaultProxyPort: 22000},
+			false,
+			map[string]string{annotationService: "web,web-admin"},
+			[]int32{22000, 22001},
+			"",
+		},
+
+		{
+			"annotation overrides handler default",
+			Handler{DefaultProxyPort: 22000},
+			false,
+			map[string]string{annotationProxyPort: "21000"},
+			[]int32{21000},
+			"",
+		},
+
+		{
+			"collides with container port",
+			Handler{},
+			false,
+			map[string]string{annotationProxyPort: "8080"},
+			nil,
+			`consul.hashicorp.com/connect-sidecar-proxy-port annotation value of "8080" is invalid: proxy port 8080 is already used by container web`,
+		},
+
+		{
+			"handler default collides with container port",
+			Handler{DefaultProxyPort: 8080},
+			false,
+			nil,
+			nil,
+			"proxy port 8080 is already used by container web, set the consul.hashicorp.com/connect-sidecar-proxy-port annotation to choose another port",
+		},
+
+		{
+			"collides with service port",
+			Handler{},
+			false,
+			map[string]string{
+				annotationPort:      "9090",
+				annotationProxyPort: "9090",
+			},
+			nil,
+			`consul.hashicorp.com/connect-service-port annotation value of "9090" is invalid: port 9090 of service web is also the proxy port of service web`,
+		},
+
+		{
+			"collides with service port of another service",
+			Handler{},
+			false,
+			map[string]string{
+				annotationService:   "web,web-admin",
+				annotationPort:      "9091,9090",
+				annotationProxyPort: "9090",
+			},
+			nil,
+			`consul.hashicorp.com/connect-service-port annotation value of "9091,9090" is invalid: port 9091 of service web is also the proxy port of service web-admin`,
+		},
+
+		{
+			"host network collides with Consul",
+			Handler{},
+			true,
+			map[string]string{
+				annotationService:   "web,web-admin",
+				annotationProxyPort: "8501",
+			},
+			nil,
+			`consul.hashicorp.com/connect-sidecar-proxy-port annotation value of "8501" is invalid: proxy port 8501 is already used by the Consul HTTPS API on the host network`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := tt.Handler
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "web",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					HostNetwork: tt.HostNetwork,
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+							Ports: []corev1.ContainerPort{
+								{
+									ContainerPort: 8080,
+								},
+							},
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			container, err := h.containerInit(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			actual := strings.Join(container.Command, " ")
+			for _, port := range tt.Ports {
+				require.Contains(actual, fmt.Sprintf(`
+  kind = "connect-proxy"
+  address = "${POD_IP}"
+  port = %d`, port))
+				require.Contains(actual, fmt.Sprintf(`tcp = "${POD_ADDR}:%d"`, port))
+			}
+		})
+	}
+}
+
+func TestHandlerContainerInit_namespace(t *testing.T) {
+	require := require.New(t)
+	h := Handler{
+		ConsulDestinationNamespace: "dest",
+		WriteServiceDefaults:       true,
+		DefaultProtocol:            "http",
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService: "web",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+	container, err := h.containerInit(pod)
+	require.NoError(err)
+	actual := strings.Join(container.Command, " ")
+	require.Contains(actual, `
+  id   = "${PROXY_SERVICE_ID}"
+  name = "web-sidecar-proxy"
+  namespace = "dest"
+  kind = "connect-proxy"`)
+	require.Contains(actual, `
+  id   = "${SERVICE_ID}"
+  name = "web"
+  namespace = "dest"
+  address = "${POD_IP}"`)
+	require.Contains(actual, `
+kind = "service-defaults"
+name = "web"
+namespace = "dest"
+protocol = "http"`)
+	require.Contains(actual, `
+  /bin/consul config read -kind service-defaults -name "web" \
+  -namespace="dest" \`)
+	require.Contains(actual, `
+/bin/consul connect envoy \
+  -proxy-id="${PROXY_SERVICE_ID}" \
+  -namespace="dest" \
+  -bootstrap > /consul/connect-inject/envoy-bootstrap.yaml`)
+}
+
+func TestHandlerContainerInit_partition(t *testing.T) {
+	require := require.New(t)
+	h := Handler{
+		ConsulPartition:            "part",
+		ConsulDestinationNamespace: "dest",
+		WriteServiceDefaults:       true,
+		DefaultProtocol:            "http",
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService: "web",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+	container, err := h.containerInit(pod)
+	require.NoError(err)
+	require.Contains(container.Env, corev1.EnvVar{Name: "CONSUL_PARTITION", Value: "part"})
+	actual := strings.Join(container.Command, " ")
+	require.Contains(actual, `
+  id   = "${PROXY_SERVICE_ID}"
+  name = "web-sidecar-proxy"
+  partition = "part"
+  namespace = "dest"
+  kind = "connect-proxy"`)
+	require.Contains(actual, `
+  id   = "${SERVICE_ID}"
+  name = "web"
+  partition = "part"
+  namespace = "dest"
+  address = "${POD_IP}"`)
+	require.Contains(actual, `
+kind = "service-defaults"
+name = "web"
+partition = "part"
+namespace = "dest"
+protocol = "http"`)
+	require.Contains(actual, `
+  /bin/consul config read -kind service-defaults -name "web" \
+  -partition="part" \
+  -namespace="dest" \`)
+	require.Contains(actual, `
+/bin/consul connect envoy \
+  -proxy-id="${PROXY_SERVICE_ID}" \
+  -partition="part" \
+  -namespace="dest" \
+  -bootstrap > /consul/connect-inject/envoy-bootstrap.yaml`)
+
+	// Without a partition, there's no partition anywhere
+	h.ConsulPartition = ""
+	container, err = h.containerInit(pod)
+	require.NoError(err)
+	require.NotContains(strings.Join(container.Command, " "), "partition")
+	for _, env := range container.Env {
+		require.NotEqual("CONSUL_PARTITION", env.Name)
+	}
+}
+
+// Test that only the services are registered for pods without proxies.
+// Pods on the host network don't need to choose a proxy port then.
+func TestHandlerContainerInit_serviceOnly(t *testing.T) {
+	require := require.New(t)
+	h := Handler{
+		WriteServiceDefaults: true,
+		DefaultProtocol:      "http",
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService:     "web,admin",
+				annotationPort:        "http,9090",
+				annotationInjectProxy: "false",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			HostNetwork: true,
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+					Ports: []corev1.ContainerPort{
+						{Name: "http", ContainerPort: 8080},
+					},
+				},
+			},
+		},
+	}
+	container, err := h.containerInit(pod)
+	require.NoError(err)
+	actual := strings.Join(container.Command, " ")
+	require.Contains(actual, `
+cat <<EOF >/consul/connect-inject/service.hcl
+services {
+  id   = "${SERVICE_ID}"
+  name = "web"
+  address = "${POD_IP}"
+  port = 8080
+}
+
+services {
+  id   = "${SERVICE_ID_1}"
+  name = "admin"
+  address = "${POD_IP}"
+  port = 9090
+}
+EOF
+
+/bin/consul services register \
+  /consul/connect-inject/service.hcl
+
+# Copy the Consul binary`)
+	require.NotContains(actual, "connect-proxy")
+	require.NotContains(actual, "service-defaults")
+	require.NotContains(actual, "consul connect envoy")
+	for _, env := range container.Env {
+		require.NotContains(env.Name, "PROXY_SERVICE_ID")
+	}
+
+	// Without a proxy, there's nothing to reach the upstreams through
+	pod.Annotations[annotationUpstreams] = "db:1234"
+	_, err = h.containerInit(pod)
+	require.EqualError(err, "consul.hashicorp.com/connect-service-upstreams annotation "+
+		"can't be used without a sidecar proxy")
+
+	pod.Annotations[annotationInjectProxy] = "nope"
+	_, err = h.containerInit(pod)
+	require.EqualError(err, `consul.hashicorp.com/connect-inject-proxy annotation value of "nope" `+
+		"is not a valid boolean")
+}
+
+func TestHandlerContainerInit_localServiceAddress(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Annotations map[string]string
+		Expected    string
+		Err         string
+	}{
+		{
+			"no annotation",
+			map[string]string{annotationPort: "8080"},
+			`
+    local_service_address = "127.0.0.1"
+    local_service_port = 8080`,
+			"",
+		},
+
+		{
+			"no annotation or port",
+			nil,
+			`
+    destination_service_id = "${SERVICE_ID}"
+  }`,
+			"",
+		},
+
+		{
+			"IPv4 annotation",
+			map[string]string{
+				annotationPort:                "8080",
+				annotationLocalServiceAddress: "127.0.0.2",
+			},
+			`
+    local_service_address = "127.0.0.2"
+    local_service_port = 8080`,
+			"",
+		},
+
+		{
+			"IPv6 annotation without port",
+			map[string]string{annotationLocalServiceAddress: "::1"},
+			`
+    destination_service_id = "${SERVICE_ID}"
+    local_service_address = "::1"
+  }`,
+			"",
+		},
+
+		{
+			"invalid annotation",
+			map[string]string{annotationLocalServiceAddress: "localhost"},
+			"",
+			`consul.hashicorp.com/connect-service-local-address annotation value of "localhost" is not a valid IP address`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			var h Handler
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "web",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			container, err := h.containerInit(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			actual := strings.Join(container.Command, " ")
+			require.Contains(actual, tt.Expected)
+		})
+	}
+}
+
+// Test that the address commands bracket IPv6 addresses so that a port can
+// be appended to them.
+func TestHandlerContainerInit_addrCommands(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+
+	cases := []struct {
+		Name     string
+		IP       string
+		Expected string
+	}{
+		{
+			"IPv4",
+			"10.0.0.1",
+			"10.0.0.1:8500 10.0.0.1:20000",
+		},
+
+		{
+			"IPv6",
+			"fd00::1",
+			"[fd00::1]:8500 [fd00::1]:20000",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			cmd := exec.Command("sh", "-ec", hostAddrCommand+podAddrCommand+
+				`echo "${HOST_ADDR}:8500 ${POD_ADDR}:20000"`)
+			cmd.Env = []string{"HOST_IP=" + tt.IP, "POD_IP=" + tt.IP}
+			out, err := cmd.Output()
+			require.NoError(err)
+			require.Equal(tt.Expected, strings.TrimSpace(string(out)))
+		})
+	}
+}
+
+// Test that the services and proxies are registered with the pod IP from
+// the downward API, including for pods that use the host network.
+func TestHandlerContainerInit_podIPAddress(t *testing.T) {
+	for _, hostNetwork := range []bool{false, true} {
+		t.Run(fmt.Sprintf("host network %t", hostNetwork), func(t *testing.T) {
+			require := require.New(t)
+			var h Handler
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService:   "web,web-admin",
+						annotationPort:      "8080,9090",
+						annotationProxyPort: "21000",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					HostNetwork: hostNetwork,
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+
+			container, err := h.containerInit(pod)
+			require.NoError(err)
+			require.Contains(container.Env, corev1.EnvVar{
+				Name: "POD_IP",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"},
+				},
+			})
+
+			// Both services and both proxies
+			actual := strings.Join(container.Command, " ")
+			require.Equal(4, strings.Count(actual, `
+  address = "${POD_IP}"`))
+		})
+	}
+}
+
+func TestHandlerContainerInit_checkDurations(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Handler     Handler
+		Annotations map[string]string
+		Expected    string
+		Err         string
+	}{
+		{
+			"defaults",
+			Handler{},
+			nil,
+			`
+    interval = "10s"
+    deregister_critical_service_after = "10m"`,
+			"",
+		},
+
+		{
+			"handler defaults",
+			Handler{
+				CheckInterval:                30 * time.Second,
+				CheckTimeout:                 5 * time.Second,
+				CheckDeregisterCriticalAfter: time.Hour,
+			},
+			nil,
+			`
+    interval = "30s"
+    timeout = "5s"
+    deregister_critical_service_after = "1h"`,
+			"",
+		},
+
+		{
+			"interval annotation",
+			Handler{CheckInterval: 30 * time.Second},
+			map[string]string{annotationCheckInterval: "1m30s"},
+			`
+    interval = "1m30s"
+    deregister_critical_service_after = "10m"`,
+			"",
+		},
+
+		{
+			"timeout annotation",
+			Handler{},
+			map[string]string{annotationCheckTimeout: "2s"},
+			`
+    interval = "10s"
+    timeout = "2s"
+    deregister_critical_service_after = "10m"`,
+			"",
+		},
+
+		{
+			"deregister annotation",
+			Handler{},
+			map[string]string{annotationCheckDeregisterCriticalAfter: "90m"},
+			`
+    interval = "10s"
+    deregister_critical_service_after = "1h30m"`,
+			"",
+		},
+
+		{
+			"invalid duration",
+			Handler{},
+			map[string]string{annotationCheckInterval: "10"},
+			"",
+			`consul.hashicorp.com/check-interval annotation value of "10" is not a valid positive duration`,
+		},
+
+		{
+			"negative duration",
+			Handler{},
+			map[string]string{annotationCheckTimeout: "-1s"},
+			"",
+			`consul.hashicorp.com/check-timeout annotation value of "-1s" is not a valid positive duration`,
+		},
+
+		{
+			"deregister too short",
+			Handler{},
+			map[string]string{annotationCheckDeregisterCriticalAfter: "30s"},
+			"",
+			"consul.hashicorp.com/check-deregister-critical-after of 30s must be at least 1m",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "web",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			container, err := tt.Handler.containerInit(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			actual := strings.Join(container.Command, " ")
+			require.Contains(actual, tt.Expected)
+		})
+	}
+}
+
+func TestHandlerContainerInit_metrics(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Handler     Handler
+		Annotations map[string]string
+		Expected    string
+		Err         string
+	}{
+		{
+			"disabled",
+			Handler{},
+			nil,
+			"",
+			"",
+		},
+
+		{
+			"handler default",
+			Handler{DefaultEnableMetrics: true},
+			nil,
+			`
+    local_service_port = 8080
+    config {
+      envoy_prometheus_bind_addr = "0.0.0.0:20200"
+    }`,
+			"",
+		},
+
+		{
+			"annotation with port",
+			Handler{},
+			map[string]string{
+				annotationEnableMetrics: "true",
+				annotationMetricsPort:   "9102",
+			},
+			`
+    config {
+      envoy_prometheus_bind_addr = "0.0.0.0:9102"
+    }`,
+			"",
+		},
+
+		{
+			"annotation opts out",
+			Handler{DefaultEnableMetrics: true},
+			map[string]string{annotationEnableMetrics: "false"},
+			"",
+			"",
+		},
+
+		{
+			"invalid boolean",
+			Handler{},
+			map[string]string{annotationEnableMetrics: "yes please"},
+			"",
+			`consul.hashicorp.com/enable-metrics annotation value of "yes please" is not a valid boolean`,
+		},
+
+		{
+			"invalid port",
+			Handler{DefaultEnableMetrics: true},
+			map[string]string{annotationMetricsPort: "70000"},
+			"",
+			`consul.hashicorp.com/metrics-port annotation value of "70000" is not a valid port`,
+		},
+
+		{
+			"port used by proxy",
+			Handler{DefaultEnableMetrics: true},
+			map[string]string{annotationMetricsPort: "20000"},
+			"",
+			"metrics port 20000 is already used by the proxy of web",
+		},
+
+		{
+			"relative scrape path",
+			Handler{DefaultEnableMetrics: true},
+			map[string]string{annotationPrometheusScrapePath: "metrics"},
+			"",
+			`consul.hashicorp.com/prometheus-scrape-path annotation value of "metrics" must be an absolute path`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "web",
+						annotationPort:    "8080",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			container, err := tt.Handler.containerInit(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			actual := strings.Join(container.Command, " ")
+			if tt.Expected == "" {
+				require.NotContains(actual, "envoy_prometheus_bind_addr")
+				return
+			}
+			require.Contains(actual, tt.Expected)
+		})
+	}
+}
+
+func TestHandlerContainerInit_transparentProxy(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Handler     Handler
+		Annotations map[string]string
+		Expected    string
+		Err         string
+	}{
+		{
+			"disabled",
+			Handler{},
+			nil,
+			"",
+			"",
+		},
+
+		{
+			"handler default",
+			Handler{EnableTransparentProxy: true},
+			nil,
+			`
+    destination_service_id = "${SERVICE_ID}"
+    mode = "transparent"
+    transparent_proxy {
+      outbound_listener_port = 15001
+    }`,
+			"",
+		},
+
+		{
+			"annotation with outbound listener port",
+			Handler{},
+			map[string]string{
+				annotationTransparentProxy:           "true",
+				annotationTProxyOutboundListenerPort: "16001",
+			},
+			`
+    mode = "transparent"
+    transparent_proxy {
+      outbound_listener_port = 16001
+    }`,
+			"",
+		},
+
+		{
+			"annotation opts out",
+			Handler{EnableTransparentProxy: true},
+			map[string]string{annotationTransparentProxy: "false"},
+			"",
+			"",
+		},
+
+		{
+			"invalid annotation",
+			Handler{},
+			map[string]string{annotationTransparentProxy: "maybe"},
+			"",
+			`consul.hashicorp.com/transparent-proxy annotation value of "maybe" is not a valid boolean`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "web",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			container, err := tt.Handler.containerInit(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			actual := strings.Join(container.Command, " ")
+			if tt.Expected == "" {
+				require.NotContains(actual, `mode = "transparent"`)
+				return
+			}
+			require.Contains(actual, tt.Expected)
+		})
+	}
+}
+
+// Test that the configured pod labels are copied into the service metadata.
+func TestHandlerContainerInit_copyLabelsToMeta(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Labels      map[string]string
+		Annotations map[string]string
+		Expected    string
+	}{
+		{
+			"mapping",
+			map[string]string{
+				"team":                      "payments",
+				"app.kubernetes.io/version": "1.2.3",
+				"unrelated":                 "foo",
+			},
+			nil,
+			`
+  meta = {
+    team = "payments"
+    version = "1.2.3"
+  }`,
+		},
+
+		{
+			"missing labels",
+			map[string]string{"team": "payments"},
+			nil,
+			`
+  meta = {
+    team = "payments"
+  }`,
+		},
+
+		{
+			"annotation wins",
+			map[string]string{
+				"team":                      "payments",
+				"app.kubernetes.io/version": "1.2.3",
+			},
+			map[string]string{annotationMeta + "version": "2.0.0"},
+			`
+  meta = {
+    team = "payments"
+    version = "2.0.0"
+  }`,
+		},
+
+		{
+			"truncated",
+			map[string]string{"team": strings.Repeat("a", 600)},
+			nil,
+			`
+  meta = {
+    team = "` + strings.Repeat("a", 512) + `"
+  }`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{
+				CopyLabelsToMeta: map[string]string{
+					"team":                      "team",
+					"app.kubernetes.io/version": "version",
+				},
+				Log: hclog.Default().Named("handler"),
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "web",
+					},
+					Labels: tt.Labels,
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			container, err := h.containerInit(pod)
+			require.NoError(err)
+			actual := strings.Join(container.Command, " ")
+			require.Contains(actual, tt.Expected+`
+
+  proxy {`)
+		})
+	}
+}
+
+func TestParseCopyLabelsToMeta(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Values   []string
+		Expected map[string]string
+		Err      string
+	}{
+		{
+			"bare key",
+			[]string{"team"},
+			map[string]string{"team": "team"},
+			"",
+		},
+
+		{
+			"mapped key",
+			[]string{"team", "app.kubernetes.io/version=version"},
+			map[string]string{"team": "team", "app.kubernetes.io/version": "version"},
+			"",
+		},
+
+		{
+			"bare key that isn't a valid meta key",
+			[]string{"app.kubernetes.io/version"},
+			nil,
+			`"app.kubernetes.io/version": metadata key must only contain alphanumeric, '-' or '_' characters, use labelKey=metaKey to choose another key`,
+		},
+
+		{
+			"reserved prefix",
+			[]string{"team=consul-team"},
+			nil,
+			`"team=consul-team": metadata key prefix "consul-" is reserved for Consul`,
+		},
+
+		{
+			"empty meta key",
+			[]string{"team="},
+			nil,
+			`"team=" must be a label key or labelKey=metaKey`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			actual, err := ParseCopyLabelsToMeta(tt.Values)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.Expected, actual)
+		})
+	}
+}
+
+func TestHandlerContainerInit_proxyConfig(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Annotations map[string]string
+		Expected    string
+		Err         string
+	}{
+		{
+			"passthrough",
+			map[string]string{
+				annotationProxyConfig: `{"local_connect_timeout_ms": 2000, "protocol": "http", "max_inbound_connections": 1024}`,
+			},
+			`
+    config {
+      local_connect_timeout_ms = 2000
+      max_inbound_connections = 1024
+      protocol = "http"
+    }`,
+			"",
+		},
+
+		{
+			"nested",
+			map[string]string{
+				annotationProxyConfig: `{"envoy_extra_static_clusters_json": "{\"name\": \"zipkin\"}", "limits": {"max_connections": 100, "hosts": ["a", "b"], "enabled": true}, "odd-key": 1.5}`,
+			},
+			`
+    config {
+      "odd-key" = 1.5
+      envoy_extra_static_clusters_json = "{\\"name\\": \\"zipkin\\"}"
+      limits = { enabled = true, hosts = ["a", "b"], max_connections = 100 }
+    }`,
+			"",
+		},
+
+		{
+			"metrics win",
+			map[string]string{
+				annotationEnableMetrics: "true",
+				annotationProxyConfig:   `{"envoy_prometheus_bind_addr": "0.0.0.0:9999", "protocol": "grpc"}`,
+			},
+			`
+    config {
+      envoy_prometheus_bind_addr = "0.0.0.0:20200"
+      protocol = "grpc"
+    }`,
+			"",
+		},
+
+		{
+			"invalid JSON",
+			map[string]string{annotationProxyConfig: `{"protocol": http}`},
+			"",
+			`consul.hashicorp.com/proxy-config annotation value of "{\"protocol\": http}" is not a JSON object`,
+		},
+
+		{
+			"trailing garbage",
+			map[string]string{annotationProxyConfig: `{"protocol": "http"} garbage`},
+			"",
+			`consul.hashicorp.com/proxy-config annotation value of "{\"protocol\": \"http\"} garbage" is not a JSON object`,
+		},
+
+		{
+			"multiple objects",
+			map[string]string{annotationProxyConfig: `{"a": 1}{"b": 2}`},
+			"",
+			`consul.hashicorp.com/proxy-config annotation value of "{\"a\": 1}{\"b\": 2}" is not a JSON object`,
+		},
+
+		{
+			"trailing brace",
+			map[string]string{annotationProxyConfig: `{"a": 1}}`},
+			"",
+			`consul.hashicorp.com/proxy-config annotation value of "{\"a\": 1}}" is not a JSON object`,
+		},
+
+		{
+			"not an object",
+			map[string]string{annotationProxyConfig: `["protocol"]`},
+			"",
+			`consul.hashicorp.com/proxy-config annotation value of "[\"protocol\"]" is not a JSON object`,
+		},
+
+		{
+			"null value",
+			map[string]string{annotationProxyConfig: `{"protocol": null}`},
+			"",
+			`consul.hashicorp.com/proxy-config annotation: key "protocol": null values are not supported`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{Log: hclog.Default().Named("handler")}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "web",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			container, err := h.containerInit(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Contains(strings.Join(container.Command, " "), tt.Expected)
+		})
+	}
+}
+
+// Test that strings in the proxy config survive the heredoc that writes
+// the service file.
+func TestHCLString_heredoc(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+
+	require := require.New(t)
+	value := "a \"quoted\" $HOME `id` \\ value"
+	cmd := exec.Command("sh", "-ec", "cat <<EOF\n"+hclString(value)+"\nEOF")
+	cmd.Env = []string{"HOME=/root"}
+	out, err := cmd.Output()
+	require.NoError(err)
+	require.Equal(`"a \"quoted\" $HOME `+"`id`"+` \\ value"`, strings.TrimSpace(string(out)))
+}
+
+// Test that the handler's default tags are merged with the tags from the
+// annotations.
+func TestHandlerContainerInit_defaultServiceTags(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Default     []string
+		Annotations map[string]string
+		Expected    string // tags of the first service and its proxy
+		Other       string // tags of the second service and its proxy
+	}{
+		{
+			"no default or annotation",
+			nil,
+			nil,
+			"",
+			"",
+		},
+
+		{
+			"default only",
+			[]string{"cluster-a", "prod"},
+			nil,
+			`["cluster-a","prod"]`,
+			`["cluster-a","prod"]`,
+		},
+
+		{
+			"annotation only",
+			nil,
+			map[string]string{annotationTags: "v1,canary"},
+			`["v1","canary"]`,
+			"",
+		},
+
+		{
+			"merged and deduplicated",
+			[]string{"cluster-a", "prod", "cluster-a"},
+			map[string]string{
+				annotationTags:        "v1,prod",
+				annotationConnectTags: "cluster-a,canary",
+			},
+			`["cluster-a","prod","v1","canary"]`,
+			`["cluster-a","prod"]`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{DefaultServiceTags: tt.Default}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "web,web-admin",
+						annotationPort:    "8080,9090",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			container, err := h.containerInit(pod)
+			require.NoError(err)
+			actual := strings.Join(container.Command, " ")
+
+			first := `
+  name = "web"
+  address = "${POD_IP}"
+  port = 8080`
+			other := `
+  name = "web-admin"
+  address = "${POD_IP}"
+  port = 9090`
+			firstProxy := `
+  name = "web-sidecar-proxy"
+  kind = "connect-proxy"
+  address = "${POD_IP}"
+  port = 20000`
+			otherProxy := `
+  name = "web-admin-sidecar-proxy"
+  kind = "connect-proxy"
+  address = "${POD_IP}"
+  port = 20001`
+			if tt.Expected == "" {
+				require.NotContains(actual, "tags")
+				return
+			}
+			require.Contains(actual, first+"\n  tags = "+tt.Expected+"\n")
+			require.Contains(actual, firstProxy+"\n  tags = "+tt.Expected+"\n")
+			if tt.Other == "" {
+				require.Contains(actual, other+"\n}")
+				require.Contains(actual, otherProxy+"\n\n")
+			} else {
+				require.Contains(actual, other+"\n  tags = "+tt.Other+"\n")
+				require.Contains(actual, otherProxy+"\n  tags = "+tt.Other+"\n")
+			}
+		})
+	}
 }
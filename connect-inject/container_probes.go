@@ -0,0 +1,143 @@
+package connectinject
+
+import (
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// exposePathsListenerPortStart is the first port that the listeners of the
+// expose paths for the pod's probes are allocated from.
+const exposePathsListenerPortStart = 21500
+
+// exposedProbe is an HTTP probe of an application container that kubelet
+// reaches through an expose path listener of the sidecar proxy.
+type exposedProbe struct {
+	// Container is the index of the container in the pod spec, and Probe
+	// is the JSON name of the probe's field in the container.
+	Container int
+	Probe     string
+	// Path is the HTTP path of the probe, and LocalPathPort the port the
+	// application serves it on.
+	Path          string
+	LocalPathPort int32
+	// ListenerPort is the port of the expose path listener of the proxy
+	// that the probe is rewritten to target.
+	ListenerPort int32
+}
+
+// overwriteProbes returns whether the HTTP probes of the pod's containers
+// are rewritten to go through the sidecar proxy. The handler's default can
+// be overridden with the overwrite-probes annotation. The probes of pods
+// without sidecars are left alone.
+func (h *Handler) overwriteProbes(pod *corev1.Pod) (bool, error) {
+	if serviceOnly, err := h.serviceOnly(pod); err != nil || serviceOnly {
+		return false, err
+	}
+	raw, ok := pod.Annotations[annotationOverwriteProbes]
+	if !ok {
+		return h.OverwriteProbes, nil
+	}
+
+	enabled, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("%s annotation value of %q is not a valid boolean",
+			annotationOverwriteProbes, raw)
+	}
+	return enabled, nil
+}
+
+// exposedProbes returns the HTTP liveness and readiness probes of the pod's
+// containers that are served through expose paths of the first sidecar
+// proxy, with a listener port allocated for each. The listener ports don't
+// collide with the ports of the services, proxies, containers or metrics.
+// TCP and exec probes, and HTTP probes of another host or over HTTPS, are
+// left alone. It returns nil if probes aren't overwritten for the pod.
+func (h *Handler) exposedProbes(pod *corev1.Pod) ([]exposedProbe, error) {
+	enabled, err := h.overwriteProbes(pod)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	services, err := h.podServices(pod)
+	if err != nil {
+		return nil, err
+	}
+	metricsPort, _, err := h.prometheusMetrics(pod)
+	if err != nil {
+		return nil, err
+	}
+	used := map[int32]bool{metricsPort: true}
+	for _, service := range services {
+		used[service.Port] = true
+		used[service.ProxyPort] = true
+	}
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			used[p.ContainerPort] = true
+		}
+	}
+
+	next := int32(exposePathsListenerPortStart)
+	var probes []exposedProbe
+	for i, c := range pod.Spec.Containers {
+		for _, p := range []struct {
+			name  string
+			probe *corev1.Probe
+		}{
+			{"livenessProbe", c.LivenessProbe},
+			{"readinessProbe", c.ReadinessProbe},
+		} {
+			if p.probe == nil || p.probe.HTTPGet == nil {
+				continue
+			}
+			get := p.probe.HTTPGet
+			if get.Host != "" || get.Scheme == corev1.URISchemeHTTPS {
+				continue
+			}
+
+			port, err := probePort(c, get.Port)
+			if err != nil {
+				return nil, fmt.Errorf("%s of container %s: %s", p.name, c.Name, err)
+			}
+			for used[next] {
+				next++
+			}
+			if next > 65535 {
+				return nil, fmt.Errorf("no ports left for the expose path listeners of the probes")
+			}
+			used[next] = true
+
+			path := get.Path
+			if path == "" {
+				path = "/"
+			}
+			probes = append(probes, exposedProbe{
+				Container:     i,
+				Probe:         p.name,
+				Path:          path,
+				LocalPathPort: port,
+				ListenerPort:  next,
+			})
+		}
+	}
+
+	return probes, nil
+}
+
+// probePort returns the number of the port that a probe of the container
+// targets. Named ports refer to the ports of the container itself.
+func probePort(c corev1.Container, port intstr.IntOrString) (int32, error) {
+	if port.Type == intstr.Int {
+		return port.IntVal, nil
+	}
+
+	for _, p := range c.Ports {
+		if p.Name == port.StrVal {
+			return p.ContainerPort, nil
+		}
+	}
+	return 0, fmt.Errorf("no container port named %q", port.StrVal)
+}
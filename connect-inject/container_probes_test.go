@@ -0,0 +1,295 @@
+package connectinject
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/mattbaird/jsonpatch"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func httpProbe(path string, port intstr.IntOrString) *corev1.Probe {
+	return &corev1.Probe{
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: path,
+				Port: port,
+			},
+		},
+	}
+}
+
+func TestHandlerExposedProbes(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Handler     Handler
+		Annotations map[string]string
+		Containers  []corev1.Container
+		Expected    []exposedProbe
+		Err         string
+	}{
+		{
+			"disabled",
+			Handler{},
+			nil,
+			[]corev1.Container{
+				{
+					Name:          "web",
+					LivenessProbe: httpProbe("/health", intstr.FromInt(8080)),
+				},
+			},
+			nil,
+			"",
+		},
+
+		{
+			"single probe",
+			Handler{OverwriteProbes: true},
+			nil,
+			[]corev1.Container{
+				{
+					Name:          "web",
+					LivenessProbe: httpProbe("/health", intstr.FromInt(8080)),
+				},
+			},
+			[]exposedProbe{
+				{0, "livenessProbe", "/health", 8080, 21500},
+			},
+			"",
+		},
+
+		{
+			"annotation",
+			Handler{},
+			map[string]string{annotationOverwriteProbes: "true"},
+			[]corev1.Container{
+				{
+					Name:           "web",
+					ReadinessProbe: httpProbe("", intstr.FromInt(8080)),
+				},
+			},
+			[]exposedProbe{
+				{0, "readinessProbe", "/", 8080, 21500},
+			},
+			"",
+		},
+
+		{
+			"multiple probes and containers",
+			Handler{OverwriteProbes: true},
+			nil,
+			[]corev1.Container{
+				{
+					Name: "web",
+					Ports: []corev1.ContainerPort{
+						{Name: "http", ContainerPort: 8080},
+						{Name: "taken", ContainerPort: 21501},
+					},
+					LivenessProbe:  httpProbe("/live", intstr.FromString("http")),
+					ReadinessProbe: httpProbe("/ready", intstr.FromString("http")),
+				},
+				{
+					Name: "tcp",
+					LivenessProbe: &corev1.Probe{
+						Handler: corev1.Handler{
+							TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(9000)},
+						},
+					},
+					ReadinessProbe: &corev1.Probe{
+						Handler: corev1.Handler{
+							Exec: &corev1.ExecAction{Command: []string{"true"}},
+						},
+					},
+				},
+				{
+					Name:           "admin",
+					ReadinessProbe: httpProbe("/status", intstr.FromInt(9090)),
+				},
+			},
+			[]exposedProbe{
+				{0, "livenessProbe", "/live", 8080, 21500},
+				{0, "readinessProbe", "/ready", 8080, 21502},
+				{2, "readinessProbe", "/status", 9090, 21503},
+			},
+			"",
+		},
+
+		{
+			"avoids proxy and service ports",
+			Handler{OverwriteProbes: true},
+			map[string]string{
+				annotationPort:      "21500",
+				annotationProxyPort: "21501",
+			},
+			[]corev1.Container{
+				{
+					Name:          "web",
+					LivenessProbe: httpProbe("/health", intstr.FromInt(21500)),
+				},
+			},
+			[]exposedProbe{
+				{0, "livenessProbe", "/health", 21500, 21502},
+			},
+			"",
+		},
+
+		{
+			"other host and HTTPS left alone",
+			Handler{OverwriteProbes: true},
+			nil,
+			[]corev1.Container{
+				{
+					Name: "web",
+					LivenessProbe: &corev1.Probe{
+						Handler: corev1.Handler{
+							HTTPGet: &corev1.HTTPGetAction{
+								Path: "/health",
+								Port: intstr.FromInt(8080),
+								Host: "example.com",
+							},
+						},
+					},
+					ReadinessProbe: &corev1.Probe{
+						Handler: corev1.Handler{
+							HTTPGet: &corev1.HTTPGetAction{
+								Path:   "/health",
+								Port:   intstr.FromInt(8443),
+								Scheme: corev1.URISchemeHTTPS,
+							},
+						},
+					},
+				},
+			},
+			nil,
+			"",
+		},
+
+		{
+			"unknown named port",
+			Handler{OverwriteProbes: true},
+			nil,
+			[]corev1.Container{
+				{
+					Name:          "web",
+					LivenessProbe: httpProbe("/health", intstr.FromString("http")),
+				},
+			},
+			nil,
+			`livenessProbe of container web: no container port named "http"`,
+		},
+
+		{
+			"invalid annotation",
+			Handler{},
+			map[string]string{annotationOverwriteProbes: "sometimes"},
+			nil,
+			nil,
+			`consul.hashicorp.com/overwrite-probes annotation value of "sometimes" is not a valid boolean`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "web",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: tt.Containers,
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			actual, err := tt.Handler.exposedProbes(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.Expected, actual)
+		})
+	}
+}
+
+// Test that the expose paths are added to the proxy registration and
+// that the probes are rewritten to target their listeners.
+func TestHandlerExposedProbes_injection(t *testing.T) {
+	require := require.New(t)
+	h := Handler{
+		OverwriteProbes:        true,
+		EnableTransparentProxy: true,
+		Log:                    hclog.Default().Named("handler"),
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService: "web",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:           "web",
+					LivenessProbe:  httpProbe("/live", intstr.FromInt(8080)),
+					ReadinessProbe: httpProbe("/ready", intstr.FromInt(8080)),
+				},
+			},
+		},
+	}
+
+	container, err := h.containerInit(pod)
+	require.NoError(err)
+	require.Contains(strings.Join(container.Command, " "), `
+    expose {
+      paths {
+        path = "/live"
+        local_path_port = 8080
+        listener_port = 21500
+        protocol = "http"
+      }
+      paths {
+        path = "/ready"
+        local_path_port = 8080
+        listener_port = 21501
+        protocol = "http"
+      }
+    }`)
+
+	// kubelet's traffic to the listeners isn't redirected
+	tproxy, err := h.containerTProxyInit(pod)
+	require.NoError(err)
+	require.Contains(tproxy.Command, "-exclude-inbound-port=21500")
+	require.Contains(tproxy.Command, "-exclude-inbound-port=21501")
+
+	req := v1beta1.AdmissionRequest{
+		Namespace: "default",
+		Object:    encodeRaw(t, pod),
+	}
+	resp := h.Mutate(&req)
+	require.True(resp.Allowed)
+	var patches []jsonpatch.JsonPatchOperation
+	require.NoError(json.Unmarshal(resp.Patch, &patches))
+	require.Contains(patches, jsonpatch.JsonPatchOperation{
+		Operation: "replace",
+		Path:      "/spec/containers/0/livenessProbe/httpGet/port",
+		Value:     float64(21500),
+	})
+	require.Contains(patches, jsonpatch.JsonPatchOperation{
+		Operation: "replace",
+		Path:      "/spec/containers/0/readinessProbe/httpGet/port",
+		Value:     float64(21501),
+	})
+}
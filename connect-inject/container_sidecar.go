@@ -2,25 +2,187 @@ package connectinject
 
 import (
 	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-func (h *Handler) containerSidecar(pod *corev1.Pod) (corev1.Container, error) {
+// sidecarReservedEnvVars are the environment variables of the Envoy
+// sidecar that are managed by the injector and can't be set with the
+// sidecar-env annotations.
+var sidecarReservedEnvVars = []string{"HOST_IP", "CONSUL_HTTP_ADDR", "CONSUL_CACERT", "CONSUL_PARTITION"}
+
+var sidecarEnvVarFormat = regexp.MustCompile(`^[-._a-zA-Z][-._a-zA-Z0-9]*$`)
+
+type sidecarPreStopCommandData struct {
+	AuthMethod string
+	// ConsulHTTPAddr is the address of the Consul client agent's HTTP API.
+	ConsulHTTPAddr string
+	// ConsulTLS is true if the agent is reached over TLS using the CA
+	// certificate written by the init container.
+	ConsulTLS bool
+	// TimeoutSeconds is how long to retry deregistering the services.
+	TimeoutSeconds int
+	// Partition is the Consul Enterprise admin partition of the
+	// services. It is empty if partitions aren't used.
+	Partition string
+	// Namespace is the Consul Enterprise namespace of the services. It
+	// is empty if namespaces aren't used.
+	Namespace string
+}
+
+// containerSidecars returns the Envoy sidecar containers for the pod, one
+// for each service the pod registers. Only the first container has the
+// preStop hook since it deregisters all of the pod's services. The hook is
+// left out if the pod has the skip-deregister annotation.
+//
+// Pods whose services are registered without proxies get a single
+// registration sidecar instead, which only runs the preStop hook.
+func (h *Handler) containerSidecars(pod *corev1.Pod) ([]corev1.Container, error) {
+	services, err := h.podServices(pod)
+	if err != nil {
+		return nil, err
+	}
+	consulHTTPAddr, err := h.consulHTTPAddr(pod)
+	if err != nil {
+		return nil, err
+	}
+	tls, err := h.consulTLS(pod)
+	if err != nil {
+		return nil, err
+	}
+	securityContext, err := h.sidecarSecurityContext(pod)
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := h.consulNamespace(pod)
+	if err != nil {
+		return nil, err
+	}
+	tracing, err := h.tracingEnabled(pod)
+	if err != nil {
+		return nil, err
+	}
+	envVars, err := sidecarEnvVars(pod)
+	if err != nil {
+		return nil, err
+	}
+	volumeMounts, err := sidecarVolumeMounts(pod)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := h.sidecarResources(pod)
+	if err != nil {
+		return nil, err
+	}
+	concurrency, err := h.sidecarConcurrency(pod)
+	if err != nil {
+		return nil, err
+	}
+	skipDeregister := false
+	if raw, ok := pod.Annotations[annotationSkipDeregister]; ok {
+		skipDeregister, err = strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s annotation value of %q is not a valid boolean",
+				annotationSkipDeregister, raw)
+		}
+	}
+	timeout := h.SidecarPreStopTimeout
+	if timeout == 0 {
+		timeout = DefaultSidecarPreStopTimeout
+	}
+	data := sidecarPreStopCommandData{
+		AuthMethod:     h.AuthMethod,
+		ConsulHTTPAddr: consulHTTPAddr,
+		ConsulTLS:      tls,
+		TimeoutSeconds: int(timeout.Seconds()),
+		Namespace:      namespace,
+		Partition:      h.ConsulPartition,
+	}
 
 	// Render the command
 	var buf bytes.Buffer
 	tpl := template.Must(template.New("root").Parse(strings.TrimSpace(
 		sidecarPreStopCommandTpl)))
-	err := tpl.Execute(&buf, h.AuthMethod)
+	err = tpl.Execute(&buf, &data)
+	if err != nil {
+		return nil, err
+	}
+	var lifecycle *corev1.Lifecycle
+	if !skipDeregister {
+		lifecycle = &corev1.Lifecycle{
+			PreStop: &corev1.Handler{
+				Exec: &corev1.ExecAction{
+					Command: []string{
+						"/bin/sh",
+						"-ec",
+						buf.String(),
+					},
+				},
+			},
+		}
+	}
+
+	serviceOnly, err := h.serviceOnly(pod)
 	if err != nil {
-		return corev1.Container{}, err
+		return nil, err
+	}
+	if serviceOnly {
+		container := h.containerRegistrationSidecar()
+		container.SecurityContext = securityContext
+		container.Env = append(container.Env, h.partitionEnvVars()...)
+		container.Lifecycle = lifecycle
+		return []corev1.Container{container}, nil
+	}
+
+	var containers []corev1.Container
+	for i, service := range services {
+		container := h.containerSidecar(service)
+		container.SecurityContext = securityContext
+		container.Env = append(container.Env, h.partitionEnvVars()...)
+		container.Env = append(container.Env, envVars...)
+		container.VolumeMounts = append(container.VolumeMounts, volumeMounts...)
+		container.Resources = resources
+		if concurrency > 0 {
+			container.Command = append(container.Command,
+				"--concurrency", strconv.Itoa(concurrency))
+		}
+		if i == 0 {
+			container.Lifecycle = lifecycle
+		}
+		if i == 0 && tracing {
+			// The tracer reports spans under the cluster name of the
+			// node, which the bootstrap config sets to the service name.
+			name, err := h.tracingServiceName(service.Name, pod.Namespace)
+			if err != nil {
+				return nil, err
+			}
+			container.Command = append(container.Command, "--service-cluster", name)
+		}
+		if i > 0 {
+			// Envoy processes sharing the pod's IPC namespace must use
+			// different base IDs for their shared memory regions.
+			container.Command = append(container.Command,
+				"--base-id", strconv.Itoa(i))
+		}
+		containers = append(containers, container)
 	}
 
+	return containers, nil
+}
+
+// containerSidecar returns the Envoy sidecar container for the proxy of
+// the given service.
+func (h *Handler) containerSidecar(service initContainerCommandServiceData) corev1.Container {
 	return corev1.Container{
-		Name:  "consul-connect-envoy-sidecar",
+		Name:  "consul-connect-envoy-sidecar" + service.Suffix,
 		Image: h.ImageEnvoy,
 		Env: []corev1.EnvVar{
 			{
@@ -36,34 +198,290 @@ func (h *Handler) containerSidecar(pod *corev1.Pod) (corev1.Container, error) {
 				MountPath: "/consul/connect-inject",
 			},
 		},
-		Lifecycle: &corev1.Lifecycle{
-			PreStop: &corev1.Handler{
-				Exec: &corev1.ExecAction{
-					Command: []string{
-						"/bin/sh",
-						"-ec",
-						buf.String(),
-					},
-				},
+		Ports: []corev1.ContainerPort{
+			{
+				ContainerPort: service.ProxyPort,
 			},
 		},
 		Command: []string{
 			"envoy",
 			"--max-obj-name-len", "256",
-			"--config-path", "/consul/connect-inject/envoy-bootstrap.yaml",
+			"--config-path", fmt.Sprintf(
+				"/consul/connect-inject/envoy-bootstrap%s.yaml", service.Suffix),
+		},
+	}
+}
+
+// containerRegistrationSidecar returns the sidecar container for pods
+// whose services are registered without proxies. It idles until the pod
+// stops so that its preStop hook can deregister the services.
+func (h *Handler) containerRegistrationSidecar() corev1.Container {
+	return corev1.Container{
+		Name:  "consul-connect-inject-registration",
+		Image: h.ImageConsul,
+		Env: []corev1.EnvVar{
+			{
+				Name: "HOST_IP",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
+				},
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			corev1.VolumeMount{
+				Name:      volumeName,
+				MountPath: "/consul/connect-inject",
+			},
+		},
+		Command: []string{"/bin/sh", "-ec", registrationSidecarCommand},
+	}
+}
+
+// sidecarEnvVars returns the environment variables to add to the Envoy
+// sidecars from the sidecar-env annotations of the pod, sorted by name.
+func sidecarEnvVars(pod *corev1.Pod) ([]corev1.EnvVar, error) {
+	var envVars []corev1.EnvVar
+	for k, v := range pod.Annotations {
+		if !strings.HasPrefix(k, annotationSidecarEnv) {
+			continue
+		}
+
+		name := strings.TrimPrefix(k, annotationSidecarEnv)
+		if !sidecarEnvVarFormat.MatchString(name) {
+			return nil, fmt.Errorf("%s: %q is not a valid environment variable name", k, name)
+		}
+		for _, reserved := range sidecarReservedEnvVars {
+			if name == reserved {
+				return nil, fmt.Errorf("%s: environment variable %s is managed by the injector "+
+					"and can't be set", k, name)
+			}
+		}
+
+		envVars = append(envVars, corev1.EnvVar{Name: name, Value: v})
+	}
+	sort.Slice(envVars, func(i, j int) bool {
+		return envVars[i].Name < envVars[j].Name
+	})
+
+	return envVars, nil
+}
+
+// sidecarVolumeMounts returns the volume mounts to add to the Envoy
+// sidecars from the sidecar-volume-mounts annotation of the pod. The
+// volumes must exist in the pod and must not be mounted over the shared
+// volume of the injector.
+func sidecarVolumeMounts(pod *corev1.Pod) ([]corev1.VolumeMount, error) {
+	raw, ok := pod.Annotations[annotationSidecarVolumeMounts]
+	if !ok || raw == "" {
+		return nil, nil
+	}
+
+	volumes := make(map[string]bool)
+	for _, v := range pod.Spec.Volumes {
+		volumes[v.Name] = true
+	}
+
+	var volumeMounts []corev1.VolumeMount
+	for _, raw := range strings.Split(raw, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		parts := strings.Split(raw, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || !path.IsAbs(parts[1]) ||
+			(len(parts) == 3 && parts[2] != "ro") {
+			return nil, fmt.Errorf("%s: volume mount %q must be in the format "+
+				"<volume-name>:<absolute-mount-path>[:ro]", annotationSidecarVolumeMounts, raw)
+		}
+		if !volumes[parts[0]] {
+			return nil, fmt.Errorf("%s: volume mount %q refers to volume %q that doesn't exist in the pod",
+				annotationSidecarVolumeMounts, raw, parts[0])
+		}
+		mountPath := path.Clean(parts[1])
+		if pathsOverlap(mountPath, "/consul/connect-inject") {
+			return nil, fmt.Errorf("%s: volume mount %q collides with the mount path "+
+				"/consul/connect-inject of the injector", annotationSidecarVolumeMounts, raw)
+		}
+
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      parts[0],
+			MountPath: mountPath,
+			ReadOnly:  len(parts) == 3,
+		})
+	}
+
+	return volumeMounts, nil
+}
+
+// pathsOverlap returns true if a and b are the same path or one of them
+// is within the other. Both paths must be clean.
+func pathsOverlap(a, b string) bool {
+	return a == b || a == "/" || b == "/" ||
+		strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// sidecarResources returns the resource requirements of the Envoy sidecars.
+// The defaults of the handler are overridden by the sidecar-proxy resource
+// annotations of the pod, and requests must not exceed their limits.
+func (h *Handler) sidecarResources(pod *corev1.Pod) (corev1.ResourceRequirements, error) {
+	resources := corev1.ResourceRequirements{
+		Limits:   corev1.ResourceList{},
+		Requests: corev1.ResourceList{},
+	}
+	for _, r := range []struct {
+		list       corev1.ResourceList
+		name       corev1.ResourceName
+		annotation string
+		value      resource.Quantity
+	}{
+		{resources.Requests, corev1.ResourceCPU, annotationSidecarProxyCPURequest, h.DefaultProxyCPURequest},
+		{resources.Limits, corev1.ResourceCPU, annotationSidecarProxyCPULimit, h.DefaultProxyCPULimit},
+		{resources.Requests, corev1.ResourceMemory, annotationSidecarProxyMemoryRequest, h.DefaultProxyMemoryRequest},
+		{resources.Limits, corev1.ResourceMemory, annotationSidecarProxyMemoryLimit, h.DefaultProxyMemoryLimit},
+	} {
+		value := r.value
+		if raw, ok := pod.Annotations[r.annotation]; ok {
+			var err error
+			value, err = resource.ParseQuantity(raw)
+			if err != nil {
+				return corev1.ResourceRequirements{}, fmt.Errorf(
+					"%s annotation value of %q is invalid: %s", r.annotation, raw, err)
+			}
+		}
+		if !value.IsZero() {
+			r.list[r.name] = value
+		}
+	}
+
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		request, hasRequest := resources.Requests[name]
+		limit, hasLimit := resources.Limits[name]
+		if hasRequest && hasLimit && request.Cmp(limit) > 0 {
+			return corev1.ResourceRequirements{}, fmt.Errorf(
+				"sidecar proxy %s request %s must not be greater than its limit %s",
+				name, request.String(), limit.String())
+		}
+	}
+
+	if len(resources.Limits) == 0 {
+		resources.Limits = nil
+	}
+	if len(resources.Requests) == 0 {
+		resources.Requests = nil
+	}
+	return resources, nil
+}
+
+// sidecarConcurrency returns the number of worker threads of the Envoy
+// sidecars. Zero leaves it to Envoy.
+func (h *Handler) sidecarConcurrency(pod *corev1.Pod) (int, error) {
+	raw, ok := pod.Annotations[annotationSidecarProxyConcurrency]
+	if !ok {
+		return h.DefaultProxyConcurrency, nil
+	}
+
+	concurrency, err := strconv.Atoi(raw)
+	if err != nil || concurrency < 1 {
+		return 0, fmt.Errorf("%s annotation value of %q is not a positive integer",
+			annotationSidecarProxyConcurrency, raw)
+	}
+	return concurrency, nil
+}
+
+// sidecarSecurityContext returns the security context for the Envoy
+// sidecars. The sidecars run as a non-root user without any capabilities
+// and with a read-only root filesystem unless this is disabled on the
+// handler. On OpenShift the user and group IDs are left to the platform.
+func (h *Handler) sidecarSecurityContext(pod *corev1.Pod) (*corev1.SecurityContext, error) {
+	if h.DisableSidecarSecurityContext {
+		return nil, nil
+	}
+
+	runAsNonRoot := true
+	readOnlyRootFilesystem := true
+	allowPrivilegeEscalation := false
+	securityContext := &corev1.SecurityContext{
+		RunAsNonRoot:             &runAsNonRoot,
+		ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
 		},
-	}, nil
+	}
+	if h.EnableOpenShift {
+		return securityContext, nil
+	}
+
+	uid := h.SidecarUID
+	if uid == 0 {
+		uid = DefaultSidecarUID
+	}
+	gid := h.SidecarGID
+	if gid == 0 {
+		gid = DefaultSidecarGID
+	}
+	if raw, ok := pod.Annotations[annotationSidecarUID]; ok {
+		var err error
+		uid, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || uid < 1 {
+			return nil, fmt.Errorf("%s annotation value of %q is not a valid non-root user ID",
+				annotationSidecarUID, raw)
+		}
+	}
+
+	securityContext.RunAsUser = &uid
+	securityContext.RunAsGroup = &gid
+	return securityContext, nil
 }
 
-const sidecarPreStopCommandTpl = `
-export CONSUL_HTTP_ADDR="${HOST_IP}:8500"
-/consul/connect-inject/consul services deregister \
-  {{- if . }}
+// registrationSidecarCommand is the command of the registration sidecar.
+// The shell runs as PID 1 of the container, which ignores SIGTERM unless
+// it is trapped.
+const registrationSidecarCommand = `trap "exit 0" TERM
+while true; do
+  sleep 1
+done`
+
+// sidecarPreStopCommandTpl is the template for the command executed by
+// the preStop hook of the Envoy sidecar. The Consul client agent may be
+// briefly unreachable, e.g. while it restarts, so deregistering is retried
+// until it succeeds or the timeout is reached.
+const sidecarPreStopCommandTpl = hostAddrCommand + `
+export CONSUL_HTTP_ADDR="{{ .ConsulHTTPAddr }}"
+deadline=$(($(date +%s) + {{ .TimeoutSeconds }}))
+until /consul/connect-inject/consul services deregister \
+  {{- if .Partition }}
+  -partition="{{ .Partition }}" \
+  {{- end }}
+  {{- if .Namespace }}
+  -namespace="{{ .Namespace }}" \
+  {{- end }}
+  {{- if .ConsulTLS }}
+  -ca-file="/consul/connect-inject/consul-ca.pem" \
+  {{- end }}
+  {{- if .AuthMethod }}
   -token-file="/consul/connect-inject/acl-token" \
   {{- end }}
   /consul/connect-inject/service.hcl
-{{- if . }}
-&& /consul/connect-inject/consul logout \
+do
+  if [ "$(date +%s)" -ge "${deadline}" ]; then
+    echo "ERROR: unable to deregister the services within {{ .TimeoutSeconds }}s"
+    exit 1
+  fi
+  sleep 1
+done
+{{- if .AuthMethod }}
+/consul/connect-inject/consul logout \
+  {{- if .Partition }}
+  -partition="{{ .Partition }}" \
+  {{- end }}
+  {{- if .Namespace }}
+  -namespace="{{ .Namespace }}" \
+  {{- end }}
+  {{- if .ConsulTLS }}
+  -ca-file="/consul/connect-inject/consul-ca.pem" \
+  {{- end }}
   -token-file="/consul/connect-inject/acl-token"
-{{- end}}
+{{- end }}
 `
@@ -0,0 +1,933 @@
+package connectinject
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHandlerContainerSidecar(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Handler     Handler
+		Annotations map[string]string
+		PreStop     string // Strings.Contains test
+	}{
+		{
+			"default",
+			Handler{},
+			nil,
+			`export CONSUL_HTTP_ADDR="${HOST_ADDR}:8500"
+deadline=$(($(date +%s) + 30))
+until /consul/connect-inject/consul services deregister \
+  /consul/connect-inject/service.hcl
+do
+  if [ "$(date +%s)" -ge "${deadline}" ]; then
+    echo "ERROR: unable to deregister the services within 30s"
+    exit 1
+  fi
+  sleep 1
+done`,
+		},
+
+		{
+			"auth method",
+			Handler{AuthMethod: "auth-method"},
+			nil,
+			`export CONSUL_HTTP_ADDR="${HOST_ADDR}:8500"
+deadline=$(($(date +%s) + 30))
+until /consul/connect-inject/consul services deregister \
+  -token-file="/consul/connect-inject/acl-token" \
+  /consul/connect-inject/service.hcl
+do
+  if [ "$(date +%s)" -ge "${deadline}" ]; then
+    echo "ERROR: unable to deregister the services within 30s"
+    exit 1
+  fi
+  sleep 1
+done
+/consul/connect-inject/consul logout \
+  -token-file="/consul/connect-inject/acl-token"`,
+		},
+
+		{
+			"handler HTTP port",
+			Handler{ConsulHTTPPort: 8501},
+			nil,
+			`export CONSUL_HTTP_ADDR="${HOST_ADDR}:8501"`,
+		},
+
+		{
+			"annotation HTTP port",
+			Handler{ConsulHTTPPort: 8501},
+			map[string]string{annotationConsulHTTPPort: "18500"},
+			`export CONSUL_HTTP_ADDR="${HOST_ADDR}:18500"`,
+		},
+
+		{
+			"CA cert",
+			Handler{ConsulCACert: "consul-ca-cert", AuthMethod: "auth-method"},
+			nil,
+			`export CONSUL_HTTP_ADDR="https://${HOST_ADDR}:8501"
+deadline=$(($(date +%s) + 30))
+until /consul/connect-inject/consul services deregister \
+  -ca-file="/consul/connect-inject/consul-ca.pem" \
+  -token-file="/consul/connect-inject/acl-token" \
+  /consul/connect-inject/service.hcl
+do
+  if [ "$(date +%s)" -ge "${deadline}" ]; then
+    echo "ERROR: unable to deregister the services within 30s"
+    exit 1
+  fi
+  sleep 1
+done
+/consul/connect-inject/consul logout \
+  -ca-file="/consul/connect-inject/consul-ca.pem" \
+  -token-file="/consul/connect-inject/acl-token"`,
+		},
+
+		{
+			"CA cert with pod opted out",
+			Handler{ConsulCACert: "consul-ca-cert"},
+			map[string]string{annotationConsulTLS: "false"},
+			`export CONSUL_HTTP_ADDR="${HOST_ADDR}:8500"
+deadline=$(($(date +%s) + 30))
+until /consul/connect-inject/consul services deregister \
+  /consul/connect-inject/service.hcl`,
+		},
+
+		{
+			"namespace",
+			Handler{ConsulDestinationNamespace: "dest", AuthMethod: "auth-method"},
+			nil,
+			`until /consul/connect-inject/consul services deregister \
+  -namespace="dest" \
+  -token-file="/consul/connect-inject/acl-token" \
+  /consul/connect-inject/service.hcl`,
+		},
+
+		{
+			"partition",
+			Handler{ConsulPartition: "part", AuthMethod: "auth-method"},
+			nil,
+			`until /consul/connect-inject/consul services deregister \
+  -partition="part" \
+  -token-file="/consul/connect-inject/acl-token" \
+  /consul/connect-inject/service.hcl
+do
+  if [ "$(date +%s)" -ge "${deadline}" ]; then
+    echo "ERROR: unable to deregister the services within 30s"
+    exit 1
+  fi
+  sleep 1
+done
+/consul/connect-inject/consul logout \
+  -partition="part" \
+  -token-file="/consul/connect-inject/acl-token"`,
+		},
+
+		{
+			"prestop timeout",
+			Handler{SidecarPreStopTimeout: 2 * time.Minute},
+			nil,
+			`deadline=$(($(date +%s) + 120))`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "foo",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			containers, err := tt.Handler.containerSidecars(pod)
+			require.NoError(err)
+			require.Len(containers, 1)
+			container := containers[0]
+			require.NotNil(container.Lifecycle)
+			require.NotNil(container.Lifecycle.PreStop)
+			actual := strings.Join(container.Lifecycle.PreStop.Exec.Command, " ")
+			require.Contains(actual, tt.PreStop)
+			if tt.Handler.ConsulPartition != "" {
+				require.Contains(container.Env, corev1.EnvVar{
+					Name:  "CONSUL_PARTITION",
+					Value: tt.Handler.ConsulPartition,
+				})
+			}
+		})
+	}
+}
+
+func TestHandlerContainerSidecar_multipleServices(t *testing.T) {
+	require := require.New(t)
+	h := Handler{ImageEnvoy: "envoy"}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService: "web,web-admin",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+
+	containers, err := h.containerSidecars(pod)
+	require.NoError(err)
+	require.Len(containers, 2)
+
+	require.Equal("consul-connect-envoy-sidecar", containers[0].Name)
+	require.Equal([]string{
+		"envoy",
+		"--max-obj-name-len", "256",
+		"--config-path", "/consul/connect-inject/envoy-bootstrap.yaml",
+	}, containers[0].Command)
+	require.NotNil(containers[0].Lifecycle)
+
+	// Only the first sidecar deregisters the services.
+	require.Equal("consul-connect-envoy-sidecar-1", containers[1].Name)
+	require.Equal([]string{
+		"envoy",
+		"--max-obj-name-len", "256",
+		"--config-path", "/consul/connect-inject/envoy-bootstrap-1.yaml",
+		"--base-id", "1",
+	}, containers[1].Command)
+	require.Nil(containers[1].Lifecycle)
+}
+
+func TestHandlerContainerSidecar_securityContext(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Handler     Handler
+		Annotations map[string]string
+		UID         int64
+		GID         int64
+		Err         string
+	}{
+		{
+			"defaults",
+			Handler{},
+			nil,
+			DefaultSidecarUID,
+			DefaultSidecarGID,
+			"",
+		},
+
+		{
+			"handler IDs",
+			Handler{SidecarUID: 1234, SidecarGID: 4321},
+			nil,
+			1234,
+			4321,
+			"",
+		},
+
+		{
+			"annotation user ID",
+			Handler{SidecarUID: 1234, SidecarGID: 4321},
+			map[string]string{annotationSidecarUID: "2345"},
+			2345,
+			4321,
+			"",
+		},
+
+		{
+			"root annotation user ID",
+			Handler{},
+			map[string]string{annotationSidecarUID: "0"},
+			0,
+			0,
+			`consul.hashicorp.com/sidecar-run-as-user annotation value of "0" is not a valid non-root user ID`,
+		},
+
+		{
+			"invalid annotation user ID",
+			Handler{},
+			map[string]string{annotationSidecarUID: "envoy"},
+			0,
+			0,
+			`consul.hashicorp.com/sidecar-run-as-user annotation value of "envoy" is not a valid non-root user ID`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "foo",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			containers, err := tt.Handler.containerSidecars(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Len(containers, 1)
+
+			runAsNonRoot := true
+			readOnlyRootFilesystem := true
+			allowPrivilegeEscalation := false
+			require.Equal(&corev1.SecurityContext{
+				RunAsUser:                &tt.UID,
+				RunAsGroup:               &tt.GID,
+				RunAsNonRoot:             &runAsNonRoot,
+				ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+				AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+				Capabilities: &corev1.Capabilities{
+					Drop: []corev1.Capability{"ALL"},
+				},
+			}, containers[0].SecurityContext)
+		})
+	}
+}
+
+func TestHandlerContainerSidecar_disableSecurityContext(t *testing.T) {
+	require := require.New(t)
+	h := Handler{DisableSidecarSecurityContext: true}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService:    "foo",
+				annotationSidecarUID: "1234",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+
+	containers, err := h.containerSidecars(pod)
+	require.NoError(err)
+	require.Len(containers, 1)
+	require.Nil(containers[0].SecurityContext)
+}
+
+func TestHandlerContainerSidecar_skipDeregister(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Value   string
+		PreStop bool
+		Err     string
+	}{
+		{"true", "true", false, ""},
+		{"false", "false", true, ""},
+		{"invalid", "yes please", false, `consul.hashicorp.com/skip-deregister annotation value of "yes please" is not a valid boolean`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			var h Handler
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService:        "foo",
+						annotationSkipDeregister: tt.Value,
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+
+			containers, err := h.containerSidecars(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Len(containers, 1)
+			if tt.PreStop {
+				require.NotNil(containers[0].Lifecycle)
+				actual := strings.Join(containers[0].Lifecycle.PreStop.Exec.Command, " ")
+				require.Contains(actual, "/consul/connect-inject/service.hcl")
+			} else {
+				require.Nil(containers[0].Lifecycle)
+			}
+		})
+	}
+}
+
+// Test that pods without proxies get a single registration sidecar that
+// deregisters all of their services.
+func TestHandlerContainerSidecar_serviceOnly(t *testing.T) {
+	require := require.New(t)
+	h := Handler{
+		ImageConsul:     "consul:1.5.0",
+		ImageEnvoy:      "envoy:1.10.0",
+		ConsulPartition: "part",
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService:     "web,admin",
+				annotationInjectProxy: "false",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+
+	containers, err := h.containerSidecars(pod)
+	require.NoError(err)
+	require.Len(containers, 1)
+	container := containers[0]
+	require.Equal("consul-connect-inject-registration", container.Name)
+	require.Equal("consul:1.5.0", container.Image)
+	require.Empty(container.Ports)
+	require.Contains(container.Env, corev1.EnvVar{Name: "CONSUL_PARTITION", Value: "part"})
+	require.NotNil(container.SecurityContext)
+	require.NotNil(container.Lifecycle)
+	actual := strings.Join(container.Lifecycle.PreStop.Exec.Command, " ")
+	require.Contains(actual, "/consul/connect-inject/service.hcl")
+
+	// The hook is still left out if the pod skips deregistering
+	pod.Annotations[annotationSkipDeregister] = "true"
+	containers, err = h.containerSidecars(pod)
+	require.NoError(err)
+	require.Len(containers, 1)
+	require.Nil(containers[0].Lifecycle)
+}
+
+func TestHandlerContainerSidecar_env(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Annotations map[string]string
+		Expected    []corev1.EnvVar
+		Err         string
+	}{
+		{
+			"no annotations",
+			nil,
+			nil,
+			"",
+		},
+
+		{
+			"single variable",
+			map[string]string{
+				annotationSidecarEnv + "HTTPS_PROXY": "proxy:3128",
+			},
+			[]corev1.EnvVar{
+				{Name: "HTTPS_PROXY", Value: "proxy:3128"},
+			},
+			"",
+		},
+
+		{
+			"multiple variables",
+			map[string]string{
+				annotationSidecarEnv + "NO_PROXY":               "127.0.0.1",
+				annotationSidecarEnv + "CONSUL_HTTP_TOKEN_FILE": "/etc/consul/token",
+			},
+			[]corev1.EnvVar{
+				{Name: "CONSUL_HTTP_TOKEN_FILE", Value: "/etc/consul/token"},
+				{Name: "NO_PROXY", Value: "127.0.0.1"},
+			},
+			"",
+		},
+
+		{
+			"managed variable",
+			map[string]string{
+				annotationSidecarEnv + "CONSUL_HTTP_ADDR": "consul:8500",
+			},
+			nil,
+			"consul.hashicorp.com/sidecar-env-CONSUL_HTTP_ADDR: environment variable CONSUL_HTTP_ADDR is managed by the injector and can't be set",
+		},
+
+		{
+			"invalid name",
+			map[string]string{
+				annotationSidecarEnv + "1PROXY": "proxy:3128",
+			},
+			nil,
+			`consul.hashicorp.com/sidecar-env-1PROXY: "1PROXY" is not a valid environment variable name`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			var h Handler
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "foo",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			containers, err := h.containerSidecars(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Len(containers, 1)
+			require.Equal("HOST_IP", containers[0].Env[0].Name)
+			require.Equal(len(tt.Expected), len(containers[0].Env)-1)
+			for i, env := range tt.Expected {
+				require.Equal(env, containers[0].Env[i+1])
+			}
+		})
+	}
+}
+
+func TestHandlerContainerSidecar_volumeMounts(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Value    string
+		Expected []corev1.VolumeMount
+		Err      string
+	}{
+		{
+			"single mount",
+			"certs:/etc/certs",
+			[]corev1.VolumeMount{
+				{Name: "certs", MountPath: "/etc/certs"},
+			},
+			"",
+		},
+
+		{
+			"multiple mounts",
+			"certs:/etc/certs:ro, ca-bundle:/etc/ca/",
+			[]corev1.VolumeMount{
+				{Name: "certs", MountPath: "/etc/certs", ReadOnly: true},
+				{Name: "ca-bundle", MountPath: "/etc/ca"},
+			},
+			"",
+		},
+
+		{
+			"unknown volume",
+			"secrets:/etc/secrets",
+			nil,
+			`consul.hashicorp.com/sidecar-volume-mounts: volume mount "secrets:/etc/secrets" refers to volume "secrets" that doesn't exist in the pod`,
+		},
+
+		{
+			"invalid format",
+			"certs:/etc/certs:rw",
+			nil,
+			`consul.hashicorp.com/sidecar-volume-mounts: volume mount "certs:/etc/certs:rw" must be in the format <volume-name>:<absolute-mount-path>[:ro]`,
+		},
+
+		{
+			"relative mount path",
+			"certs:certs",
+			nil,
+			`consul.hashicorp.com/sidecar-volume-mounts: volume mount "certs:certs" must be in the format <volume-name>:<absolute-mount-path>[:ro]`,
+		},
+
+		{
+			"collides with injector mount",
+			"certs:/consul/connect-inject/",
+			nil,
+			`consul.hashicorp.com/sidecar-volume-mounts: volume mount "certs:/consul/connect-inject/" collides with the mount path /consul/connect-inject of the injector`,
+		},
+
+		{
+			"within injector mount",
+			"certs:/consul/connect-inject/certs",
+			nil,
+			`consul.hashicorp.com/sidecar-volume-mounts: volume mount "certs:/consul/connect-inject/certs" collides with the mount path /consul/connect-inject of the injector`,
+		},
+
+		{
+			"parent of injector mount",
+			"certs:/consul",
+			nil,
+			`consul.hashicorp.com/sidecar-volume-mounts: volume mount "certs:/consul" collides with the mount path /consul/connect-inject of the injector`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			var h Handler
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService:             "foo",
+						annotationSidecarVolumeMounts: tt.Value,
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Volumes: []corev1.Volume{
+						{Name: "certs"},
+						{Name: "ca-bundle"},
+					},
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+
+			containers, err := h.containerSidecars(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Len(containers, 1)
+			require.Equal(append([]corev1.VolumeMount{
+				{Name: volumeName, MountPath: "/consul/connect-inject"},
+			}, tt.Expected...), containers[0].VolumeMounts)
+		})
+	}
+}
+
+func TestHandlerContainerSidecar_openShift(t *testing.T) {
+	require := require.New(t)
+	h := Handler{EnableOpenShift: true, SidecarUID: 1234, SidecarGID: 4321}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService:    "foo",
+				annotationSidecarUID: "2345",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+
+	containers, err := h.containerSidecars(pod)
+	require.NoError(err)
+	require.Len(containers, 1)
+
+	// The user and group IDs are assigned by OpenShift.
+	runAsNonRoot := true
+	readOnlyRootFilesystem := true
+	allowPrivilegeEscalation := false
+	require.Equal(&corev1.SecurityContext{
+		RunAsNonRoot:             &runAsNonRoot,
+		ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}, containers[0].SecurityContext)
+}
+
+func TestHandlerContainerSidecar_resources(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Handler     Handler
+		Annotations map[string]string
+		Expected    corev1.ResourceRequirements
+		Err         string
+	}{
+		{
+			"no defaults or annotations",
+			Handler{},
+			nil,
+			corev1.ResourceRequirements{},
+			"",
+		},
+
+		{
+			"defaults",
+			Handler{
+				DefaultProxyCPURequest:    resource.MustParse("100m"),
+				DefaultProxyCPULimit:      resource.MustParse("200m"),
+				DefaultProxyMemoryRequest: resource.MustParse("64Mi"),
+				DefaultProxyMemoryLimit:   resource.MustParse("128Mi"),
+			},
+			nil,
+			corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("200m"),
+					corev1.ResourceMemory: resource.MustParse("128Mi"),
+				},
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("100m"),
+					corev1.ResourceMemory: resource.MustParse("64Mi"),
+				},
+			},
+			"",
+		},
+
+		{
+			"annotations override defaults",
+			Handler{
+				DefaultProxyCPURequest: resource.MustParse("100m"),
+				DefaultProxyCPULimit:   resource.MustParse("200m"),
+			},
+			map[string]string{
+				annotationSidecarProxyCPULimit:      "1",
+				annotationSidecarProxyMemoryRequest: "256Mi",
+			},
+			corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceCPU: resource.MustParse("1"),
+				},
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("100m"),
+					corev1.ResourceMemory: resource.MustParse("256Mi"),
+				},
+			},
+			"",
+		},
+
+		{
+			"zero annotation unsets default",
+			Handler{
+				DefaultProxyMemoryLimit: resource.MustParse("128Mi"),
+			},
+			map[string]string{
+				annotationSidecarProxyMemoryLimit: "0",
+			},
+			corev1.ResourceRequirements{},
+			"",
+		},
+
+		{
+			"invalid quantity",
+			Handler{},
+			map[string]string{
+				annotationSidecarProxyCPURequest: "lots",
+			},
+			corev1.ResourceRequirements{},
+			`consul.hashicorp.com/sidecar-proxy-cpu-request annotation value of "lots" is invalid: quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$'`,
+		},
+
+		{
+			"request greater than limit",
+			Handler{
+				DefaultProxyMemoryLimit: resource.MustParse("128Mi"),
+			},
+			map[string]string{
+				annotationSidecarProxyMemoryRequest: "256Mi",
+			},
+			corev1.ResourceRequirements{},
+			"sidecar proxy memory request 256Mi must not be greater than its limit 128Mi",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "foo",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			containers, err := tt.Handler.containerSidecars(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Len(containers, 1)
+			require.Equal(tt.Expected, containers[0].Resources)
+		})
+	}
+}
+
+func TestHandlerContainerSidecar_concurrency(t *testing.T) {
+	cases := []struct {
+		Name       string
+		Default    int
+		Annotation string
+		Expected   []string
+		Err        string
+	}{
+		{
+			"no default or annotation",
+			0,
+			"",
+			nil,
+			"",
+		},
+
+		{
+			"default",
+			2,
+			"",
+			[]string{"--concurrency", "2"},
+			"",
+		},
+
+		{
+			"annotation overrides default",
+			2,
+			"8",
+			[]string{"--concurrency", "8"},
+			"",
+		},
+
+		{
+			"zero annotation",
+			2,
+			"0",
+			nil,
+			`consul.hashicorp.com/sidecar-proxy-concurrency annotation value of "0" is not a positive integer`,
+		},
+
+		{
+			"invalid annotation",
+			0,
+			"many",
+			nil,
+			`consul.hashicorp.com/sidecar-proxy-concurrency annotation value of "many" is not a positive integer`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{DefaultProxyConcurrency: tt.Default}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "foo",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			if tt.Annotation != "" {
+				pod.Annotations[annotationSidecarProxyConcurrency] = tt.Annotation
+			}
+
+			containers, err := h.containerSidecars(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Len(containers, 1)
+			require.Equal(append([]string{
+				"envoy",
+				"--max-obj-name-len", "256",
+				"--config-path", "/consul/connect-inject/envoy-bootstrap.yaml",
+			}, tt.Expected...), containers[0].Command)
+		})
+	}
+}
+
+func TestHandlerContainerSidecar_ports(t *testing.T) {
+	require := require.New(t)
+	h := Handler{DefaultProxyPort: 22000}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService: "web,web-admin",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+
+	containers, err := h.containerSidecars(pod)
+	require.NoError(err)
+	require.Len(containers, 2)
+	require.Equal([]corev1.ContainerPort{{ContainerPort: 22000}}, containers[0].Ports)
+	require.Equal([]corev1.ContainerPort{{ContainerPort: 22001}}, containers[1].Ports)
+}
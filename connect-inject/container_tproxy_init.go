@@ -0,0 +1,181 @@
+package connectinject
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// transparentProxy returns whether the pod's traffic is transparently
+// redirected through the Envoy sidecar. The handler's default can be
+// overridden with the transparent-proxy annotation. Pods without sidecars
+// are never redirected.
+func (h *Handler) transparentProxy(pod *corev1.Pod) (bool, error) {
+	if serviceOnly, err := h.serviceOnly(pod); err != nil || serviceOnly {
+		return false, err
+	}
+	raw, ok := pod.Annotations[annotationTransparentProxy]
+	if !ok {
+		return h.EnableTransparentProxy, nil
+	}
+
+	enabled, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("%s annotation value of %q is not a valid boolean",
+			annotationTransparentProxy, raw)
+	}
+	return enabled, nil
+}
+
+// tproxyOutboundListenerPort returns the port of the Envoy listener that
+// outbound traffic is redirected to.
+func (h *Handler) tproxyOutboundListenerPort(pod *corev1.Pod) (int, error) {
+	port := h.TProxyOutboundListenerPort
+	if port == 0 {
+		port = DefaultTProxyOutboundListenerPort
+	}
+	if raw, ok := pod.Annotations[annotationTProxyOutboundListenerPort]; ok {
+		var err error
+		port, err = strconv.Atoi(raw)
+		if err != nil || port < 1 || port > 65535 {
+			return 0, fmt.Errorf("%s annotation value of %q is not a valid port",
+				annotationTProxyOutboundListenerPort, raw)
+		}
+	}
+
+	return port, nil
+}
+
+// containerTProxyInit returns the init container spec for redirecting the
+// pod's traffic through the Envoy sidecar with iptables. Traffic of the
+// sidecar's user is excluded so that the proxy can reach its upstreams.
+// It must run after the other init containers since they talk to the
+// Consul client agent before the sidecar is up to proxy their traffic.
+func (h *Handler) containerTProxyInit(pod *corev1.Pod) (corev1.Container, error) {
+	if pod.Spec.HostNetwork {
+		return corev1.Container{}, fmt.Errorf(
+			"transparent proxy can't be used with pods that use the host network")
+	}
+	if h.EnableOpenShift {
+		return corev1.Container{}, fmt.Errorf(
+			"transparent proxy can't be used in OpenShift mode since the user ID " +
+				"of the Envoy sidecar is assigned by OpenShift")
+	}
+	if h.DisableSidecarSecurityContext {
+		return corev1.Container{}, fmt.Errorf(
+			"transparent proxy can't be used with the sidecar security context " +
+				"disabled since the user ID of the Envoy sidecar isn't known")
+	}
+
+	services, err := h.podServices(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	if len(services) > 1 {
+		return corev1.Container{}, fmt.Errorf(
+			"transparent proxy can't be used with pods that register multiple services")
+	}
+	outboundPort, err := h.tproxyOutboundListenerPort(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	if int32(outboundPort) == services[0].ProxyPort {
+		return corev1.Container{}, fmt.Errorf(
+			"transparent proxy outbound listener port %d is already used by the proxy", outboundPort)
+	}
+	securityContext, err := h.sidecarSecurityContext(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	exclusions, err := tproxyExclusionArgs(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	// kubelet reaches the expose path listeners from outside the mesh
+	probes, err := h.exposedProbes(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	for _, probe := range probes {
+		exclusions = append(exclusions, fmt.Sprintf("-exclude-inbound-port=%d", probe.ListenerPort))
+	}
+
+	// iptables needs to run as root with NET_ADMIN, but nothing else.
+	runAsUser := int64(0)
+	runAsNonRoot := false
+	allowPrivilegeEscalation := false
+	return corev1.Container{
+		Name:  "consul-connect-inject-tproxy-init",
+		Image: h.ImageConsul,
+		Command: append([]string{
+			"/bin/consul", "connect", "redirect-traffic",
+			fmt.Sprintf("-proxy-uid=%d", *securityContext.RunAsUser),
+			fmt.Sprintf("-proxy-inbound-port=%d", services[0].ProxyPort),
+			fmt.Sprintf("-proxy-outbound-port=%d", outboundPort),
+		}, exclusions...),
+		SecurityContext: &corev1.SecurityContext{
+			RunAsUser:                &runAsUser,
+			RunAsNonRoot:             &runAsNonRoot,
+			AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+			Capabilities: &corev1.Capabilities{
+				Add:  []corev1.Capability{"NET_ADMIN"},
+				Drop: []corev1.Capability{"ALL"},
+			},
+		},
+	}, nil
+}
+
+// tproxyExclusionArgs returns the arguments of the redirect-traffic command
+// for the traffic the pod excludes from redirection with the
+// transparent-proxy-exclude annotations. Empty annotations are ignored.
+func tproxyExclusionArgs(pod *corev1.Pod) ([]string, error) {
+	var args []string
+	for _, e := range []struct {
+		annotation string
+		flag       string
+		valid      func(string) bool
+		kind       string
+	}{
+		{annotationTProxyExcludeInboundPorts, "-exclude-inbound-port", validPort, "port"},
+		{annotationTProxyExcludeOutboundPorts, "-exclude-outbound-port", validPort, "port"},
+		{annotationTProxyExcludeOutboundCIDRs, "-exclude-outbound-cidr", validCIDR, "CIDR"},
+		{annotationTProxyExcludeUIDs, "-exclude-uid", validUID, "user ID"},
+	} {
+		raw, ok := pod.Annotations[e.annotation]
+		if !ok {
+			continue
+		}
+
+		for _, value := range strings.Split(raw, ",") {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			if !e.valid(value) {
+				return nil, fmt.Errorf("%s annotation: %q is not a valid %s", e.annotation, value, e.kind)
+			}
+			args = append(args, fmt.Sprintf("%s=%s", e.flag, value))
+		}
+	}
+
+	return args, nil
+}
+
+func validPort(value string) bool {
+	port, err := strconv.Atoi(value)
+	return err == nil && port >= 1 && port <= 65535
+}
+
+func validCIDR(value string) bool {
+	_, _, err := net.ParseCIDR(value)
+	return err == nil
+}
+
+func validUID(value string) bool {
+	uid, err := strconv.ParseInt(value, 10, 64)
+	return err == nil && uid >= 0
+}
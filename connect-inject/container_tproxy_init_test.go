@@ -0,0 +1,295 @@
+package connectinject
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHandlerContainerTProxyInit(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Handler     Handler
+		Annotations map[string]string
+		Cmd         []string
+		Err         string
+	}{
+		{
+			"defaults",
+			Handler{},
+			nil,
+			[]string{
+				"/bin/consul", "connect", "redirect-traffic",
+				"-proxy-uid=5995",
+				"-proxy-inbound-port=20000",
+				"-proxy-outbound-port=15001",
+			},
+			"",
+		},
+
+		{
+			"handler settings",
+			Handler{SidecarUID: 1234, TProxyOutboundListenerPort: 16001},
+			nil,
+			[]string{
+				"/bin/consul", "connect", "redirect-traffic",
+				"-proxy-uid=1234",
+				"-proxy-inbound-port=20000",
+				"-proxy-outbound-port=16001",
+			},
+			"",
+		},
+
+		{
+			"annotations",
+			Handler{TProxyOutboundListenerPort: 16001},
+			map[string]string{
+				annotationSidecarUID:                 "2345",
+				annotationProxyPort:                  "21000",
+				annotationTProxyOutboundListenerPort: "17001",
+			},
+			[]string{
+				"/bin/consul", "connect", "redirect-traffic",
+				"-proxy-uid=2345",
+				"-proxy-inbound-port=21000",
+				"-proxy-outbound-port=17001",
+			},
+			"",
+		},
+
+		{
+			"exclusions",
+			Handler{},
+			map[string]string{
+				annotationTProxyExcludeInboundPorts:  "8080",
+				annotationTProxyExcludeOutboundCIDRs: "10.0.0.0/8",
+			},
+			[]string{
+				"/bin/consul", "connect", "redirect-traffic",
+				"-proxy-uid=5995",
+				"-proxy-inbound-port=20000",
+				"-proxy-outbound-port=15001",
+				"-exclude-inbound-port=8080",
+				"-exclude-outbound-cidr=10.0.0.0/8",
+			},
+			"",
+		},
+
+		{
+			"invalid exclusion",
+			Handler{},
+			map[string]string{annotationTProxyExcludeUIDs: "root"},
+			nil,
+			`consul.hashicorp.com/transparent-proxy-exclude-uids annotation: "root" is not a valid user ID`,
+		},
+
+		{
+			"invalid outbound listener port",
+			Handler{},
+			map[string]string{annotationTProxyOutboundListenerPort: "http"},
+			nil,
+			`consul.hashicorp.com/transparent-proxy-outbound-listener-port annotation value of "http" is not a valid port`,
+		},
+
+		{
+			"outbound listener port used by proxy",
+			Handler{TProxyOutboundListenerPort: 20000},
+			nil,
+			nil,
+			"transparent proxy outbound listener port 20000 is already used by the proxy",
+		},
+
+		{
+			"multiple services",
+			Handler{},
+			map[string]string{annotationService: "web,admin"},
+			nil,
+			"transparent proxy can't be used with pods that register multiple services",
+		},
+
+		{
+			"OpenShift",
+			Handler{EnableOpenShift: true},
+			nil,
+			nil,
+			"transparent proxy can't be used in OpenShift mode since the user ID of the Envoy sidecar is assigned by OpenShift",
+		},
+
+		{
+			"security context disabled",
+			Handler{DisableSidecarSecurityContext: true},
+			nil,
+			nil,
+			"transparent proxy can't be used with the sidecar security context disabled since the user ID of the Envoy sidecar isn't known",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "web",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for k, v := range tt.Annotations {
+				pod.Annotations[k] = v
+			}
+
+			container, err := tt.Handler.containerTProxyInit(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Equal("consul-connect-inject-tproxy-init", container.Name)
+			require.Equal(tt.Cmd, container.Command)
+
+			// The container only gets the capability iptables needs.
+			runAsUser := int64(0)
+			runAsNonRoot := false
+			allowPrivilegeEscalation := false
+			require.Equal(&corev1.SecurityContext{
+				RunAsUser:                &runAsUser,
+				RunAsNonRoot:             &runAsNonRoot,
+				AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+				Capabilities: &corev1.Capabilities{
+					Add:  []corev1.Capability{"NET_ADMIN"},
+					Drop: []corev1.Capability{"ALL"},
+				},
+			}, container.SecurityContext)
+		})
+	}
+}
+
+func TestTProxyExclusionArgs(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Annotations map[string]string
+		Expected    []string
+		Err         string
+	}{
+		{
+			"no annotations",
+			nil,
+			nil,
+			"",
+		},
+
+		{
+			"empty annotations",
+			map[string]string{
+				annotationTProxyExcludeInboundPorts:  "",
+				annotationTProxyExcludeOutboundPorts: " , ",
+				annotationTProxyExcludeOutboundCIDRs: "",
+				annotationTProxyExcludeUIDs:          "",
+			},
+			nil,
+			"",
+		},
+
+		{
+			"all annotations",
+			map[string]string{
+				annotationTProxyExcludeInboundPorts:  "8080, 9090",
+				annotationTProxyExcludeOutboundPorts: "5432",
+				annotationTProxyExcludeOutboundCIDRs: "10.0.0.0/8,fd00::/8",
+				annotationTProxyExcludeUIDs:          "0,1234",
+			},
+			[]string{
+				"-exclude-inbound-port=8080",
+				"-exclude-inbound-port=9090",
+				"-exclude-outbound-port=5432",
+				"-exclude-outbound-cidr=10.0.0.0/8",
+				"-exclude-outbound-cidr=fd00::/8",
+				"-exclude-uid=0",
+				"-exclude-uid=1234",
+			},
+			"",
+		},
+
+		{
+			"invalid inbound port",
+			map[string]string{annotationTProxyExcludeInboundPorts: "8080,http"},
+			nil,
+			`consul.hashicorp.com/transparent-proxy-exclude-inbound-ports annotation: "http" is not a valid port`,
+		},
+
+		{
+			"outbound port out of range",
+			map[string]string{annotationTProxyExcludeOutboundPorts: "65536"},
+			nil,
+			`consul.hashicorp.com/transparent-proxy-exclude-outbound-ports annotation: "65536" is not a valid port`,
+		},
+
+		{
+			"invalid CIDR",
+			map[string]string{annotationTProxyExcludeOutboundCIDRs: "10.0.0.0/8,10.0.0.1"},
+			nil,
+			`consul.hashicorp.com/transparent-proxy-exclude-outbound-cidrs annotation: "10.0.0.1" is not a valid CIDR`,
+		},
+
+		{
+			"invalid UID",
+			map[string]string{annotationTProxyExcludeUIDs: "-1"},
+			nil,
+			`consul.hashicorp.com/transparent-proxy-exclude-uids annotation: "-1" is not a valid user ID`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tt.Annotations,
+				},
+			}
+
+			actual, err := tproxyExclusionArgs(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.Expected, actual)
+		})
+	}
+}
+
+func TestHandlerContainerTProxyInit_hostNetwork(t *testing.T) {
+	require := require.New(t)
+	var h Handler
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService:   "web",
+				annotationProxyPort: "21000",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			HostNetwork: true,
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+
+	_, err := h.containerTProxyInit(pod)
+	require.EqualError(err, "transparent proxy can't be used with pods that use the host network")
+}
@@ -1,6 +1,9 @@
 package connectinject
 
 import (
+	"fmt"
+	"time"
+
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -8,6 +11,14 @@ import (
 // Consul Connect injection data.
 const volumeName = "consul-connect-inject-data"
 
+// tokenVolumeName is the name of the volume that projects the bound service
+// account token for the ACL login, and tokenMountPath is where the ACL init
+// container mounts it.
+const (
+	tokenVolumeName = "consul-connect-inject-token"
+	tokenMountPath  = "/consul/connect-inject-token"
+)
+
 // containerVolume returns the volume data to add to the pod. This volume
 // is used for shared data between containers.
 func (h *Handler) containerVolume() corev1.Volume {
@@ -18,3 +29,76 @@ func (h *Handler) containerVolume() corev1.Volume {
 		},
 	}
 }
+
+// containerTokenVolume returns the volume that projects a service account
+// token bound to the pod and the handler's audience. The ACL init container
+// logs in with it instead of the auto-mounted token.
+func (h *Handler) containerTokenVolume() corev1.Volume {
+	expiration := h.ServiceAccountTokenExpiration
+	if expiration == 0 {
+		expiration = DefaultServiceAccountTokenExpiration
+	}
+	expirationSeconds := int64(expiration / time.Second)
+
+	return corev1.Volume{
+		Name: tokenVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          h.ServiceAccountTokenAudience,
+							ExpirationSeconds: &expirationSeconds,
+							Path:              "token",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// injectedName returns the name to give an injected container or volume so
+// that it doesn't collide with the names in used, which are the names the
+// pod already has. The name is returned unchanged if it is free. Otherwise
+// the pod is rejected, unless the handler renames conflicting names, in
+// which case a deterministic suffix is appended.
+func (h *Handler) injectedName(name, kind string, used map[string]bool) (string, error) {
+	if !used[name] {
+		return name, nil
+	}
+	if !h.RenameConflictingNames {
+		return "", fmt.Errorf("the pod already has a %s named %s that wasn't added by the "+
+			"injector, rename it or remove it", kind, name)
+	}
+
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s-injected-%d", name, i)
+		if !used[candidate] {
+			return candidate, nil
+		}
+	}
+}
+
+// nameInjectedContainers gives the injected containers names that don't
+// collide with the containers in used, and mounts the injected volumes
+// under their injected names. volumes maps the mount paths of the injected
+// volumes to their names. The names of the containers are added to used.
+func (h *Handler) nameInjectedContainers(containers []corev1.Container, used map[string]bool, volumes map[string]string) error {
+	for i := range containers {
+		name, err := h.injectedName(containers[i].Name, "container", used)
+		if err != nil {
+			return err
+		}
+		containers[i].Name = name
+		used[name] = true
+
+		for j, mount := range containers[i].VolumeMounts {
+			if name, ok := volumes[mount.MountPath]; ok {
+				containers[i].VolumeMounts[j].Name = name
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package connectinject
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultClusterDomain is the DNS domain of the cluster if no other is
+	// configured.
+	DefaultClusterDomain = "cluster.local"
+
+	// maxDNSNameservers and maxDNSSearches are the limits Kubernetes
+	// enforces on the dnsConfig of pods.
+	maxDNSNameservers = 3
+	maxDNSSearches    = 6
+)
+
+// podDNSConfig returns the DNS config that makes the pod resolve names
+// with Consul DNS first and with the cluster's DNS if Consul fails to
+// resolve them. It returns nil if the pod doesn't use Consul DNS.
+//
+// Pods that set their own dnsConfig are rejected, unless the handler
+// merges the config, in which case the pod's nameservers follow Consul's
+// and its search domains and options are kept.
+func (h *Handler) podDNSConfig(pod *corev1.Pod) (*corev1.PodDNSConfig, error) {
+	raw, ok := pod.Annotations[annotationUseConsulDNS]
+	if !ok {
+		return nil, nil
+	}
+	enabled, err := strconv.ParseBool(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s annotation value of %q is not a valid boolean",
+			annotationUseConsulDNS, raw)
+	}
+	if !enabled {
+		return nil, nil
+	}
+	if h.ConsulDNSAddress == "" {
+		return nil, fmt.Errorf("%s annotation is set but no Consul DNS address is configured",
+			annotationUseConsulDNS)
+	}
+	existing := pod.Spec.DNSConfig
+	if existing != nil && !h.MergePodDNSConfig {
+		return nil, fmt.Errorf("%s annotation is set but the pod already has a dnsConfig",
+			annotationUseConsulDNS)
+	}
+
+	// Search the same domains as with the ClusterFirst DNS policy.
+	domain := h.ClusterDomain
+	if domain == "" {
+		domain = DefaultClusterDomain
+	}
+	ndots := "5"
+	config := &corev1.PodDNSConfig{
+		Nameservers: []string{h.ConsulDNSAddress},
+		Searches: []string{
+			fmt.Sprintf("%s.svc.%s", pod.Namespace, domain),
+			"svc." + domain,
+			domain,
+		},
+		Options: []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndots}},
+	}
+	if existing != nil {
+		config.Nameservers = appendUnique(config.Nameservers, existing.Nameservers...)
+		config.Searches = appendUnique(config.Searches, existing.Searches...)
+		for _, option := range existing.Options {
+			if option.Name == "ndots" {
+				config.Options[0] = option
+			} else {
+				config.Options = append(config.Options, option)
+			}
+		}
+	}
+	config.Nameservers = appendUnique(config.Nameservers, h.ClusterDNSNameservers...)
+
+	if len(config.Nameservers) > maxDNSNameservers {
+		return nil, fmt.Errorf("the pod's dnsConfig would have more than %d nameservers: %s",
+			maxDNSNameservers, strings.Join(config.Nameservers, ", "))
+	}
+	if len(config.Searches) > maxDNSSearches {
+		return nil, fmt.Errorf("the pod's dnsConfig would have more than %d search domains: %s",
+			maxDNSSearches, strings.Join(config.Searches, ", "))
+	}
+
+	return config, nil
+}
+
+// ResolvConfNameservers returns the nameservers of a resolv.conf file,
+// such as the injector's own, which points at the cluster's DNS.
+func ResolvConfNameservers(r io.Reader) ([]string, error) {
+	var nameservers []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			nameservers = append(nameservers, fields[1])
+		}
+	}
+
+	return nameservers, scanner.Err()
+}
+
+// appendUnique appends the values that the list doesn't contain yet.
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, existing := range list {
+			if v == existing {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
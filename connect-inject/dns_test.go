@@ -0,0 +1,224 @@
+package connectinject
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHandlerPodDNSConfig(t *testing.T) {
+	ndots := func(value string) []corev1.PodDNSConfigOption {
+		return []corev1.PodDNSConfigOption{{Name: "ndots", Value: &value}}
+	}
+	cases := []struct {
+		Name       string
+		Handler    Handler
+		Annotation string
+		DNSConfig  *corev1.PodDNSConfig
+		Expected   *corev1.PodDNSConfig
+		Err        string
+	}{
+		{
+			"no annotation",
+			Handler{ConsulDNSAddress: "10.0.0.53"},
+			"",
+			nil,
+			nil,
+			"",
+		},
+
+		{
+			"disabled",
+			Handler{ConsulDNSAddress: "10.0.0.53"},
+			"false",
+			nil,
+			nil,
+			"",
+		},
+
+		{
+			"enabled",
+			Handler{
+				ConsulDNSAddress:      "10.0.0.53",
+				ClusterDNSNameservers: []string{"10.0.0.10"},
+			},
+			"true",
+			nil,
+			&corev1.PodDNSConfig{
+				Nameservers: []string{"10.0.0.53", "10.0.0.10"},
+				Searches: []string{
+					"apps.svc.cluster.local",
+					"svc.cluster.local",
+					"cluster.local",
+				},
+				Options: ndots("5"),
+			},
+			"",
+		},
+
+		{
+			"cluster domain",
+			Handler{
+				ConsulDNSAddress:      "10.0.0.53",
+				ClusterDNSNameservers: []string{"10.0.0.10"},
+				ClusterDomain:         "k8s.example.com",
+			},
+			"true",
+			nil,
+			&corev1.PodDNSConfig{
+				Nameservers: []string{"10.0.0.53", "10.0.0.10"},
+				Searches: []string{
+					"apps.svc.k8s.example.com",
+					"svc.k8s.example.com",
+					"k8s.example.com",
+				},
+				Options: ndots("5"),
+			},
+			"",
+		},
+
+		{
+			"existing config rejected",
+			Handler{ConsulDNSAddress: "10.0.0.53"},
+			"true",
+			&corev1.PodDNSConfig{Searches: []string{"example.com"}},
+			nil,
+			"consul.hashicorp.com/use-consul-dns annotation is set but the pod already has a dnsConfig",
+		},
+
+		{
+			"existing config merged",
+			Handler{
+				ConsulDNSAddress:      "10.0.0.53",
+				ClusterDNSNameservers: []string{"10.0.0.10"},
+				MergePodDNSConfig:     true,
+			},
+			"true",
+			&corev1.PodDNSConfig{
+				Nameservers: []string{"10.0.0.10"},
+				Searches:    []string{"example.com", "svc.cluster.local"},
+				Options: []corev1.PodDNSConfigOption{
+					{Name: "single-request-reopen"},
+					ndots("2")[0],
+				},
+			},
+			&corev1.PodDNSConfig{
+				Nameservers: []string{"10.0.0.53", "10.0.0.10"},
+				Searches: []string{
+					"apps.svc.cluster.local",
+					"svc.cluster.local",
+					"cluster.local",
+					"example.com",
+				},
+				Options: []corev1.PodDNSConfigOption{
+					ndots("2")[0],
+					{Name: "single-request-reopen"},
+				},
+			},
+			"",
+		},
+
+		{
+			"too many nameservers",
+			Handler{
+				ConsulDNSAddress:      "10.0.0.53",
+				ClusterDNSNameservers: []string{"10.0.0.10"},
+				MergePodDNSConfig:     true,
+			},
+			"true",
+			&corev1.PodDNSConfig{Nameservers: []string{"8.8.8.8", "8.8.4.4"}},
+			nil,
+			"the pod's dnsConfig would have more than 3 nameservers: 10.0.0.53, 8.8.8.8, 8.8.4.4, 10.0.0.10",
+		},
+
+		{
+			"too many search domains",
+			Handler{ConsulDNSAddress: "10.0.0.53", MergePodDNSConfig: true},
+			"true",
+			&corev1.PodDNSConfig{Searches: []string{"a.com", "b.com", "c.com", "d.com"}},
+			nil,
+			"the pod's dnsConfig would have more than 6 search domains",
+		},
+
+		{
+			"no address",
+			Handler{},
+			"true",
+			nil,
+			nil,
+			"consul.hashicorp.com/use-consul-dns annotation is set but no Consul DNS address is configured",
+		},
+
+		{
+			"invalid annotation",
+			Handler{ConsulDNSAddress: "10.0.0.53"},
+			"sure",
+			nil,
+			nil,
+			`consul.hashicorp.com/use-consul-dns annotation value of "sure" is not a valid boolean`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "apps",
+					Annotations: map[string]string{},
+				},
+
+				Spec: corev1.PodSpec{
+					DNSConfig: tt.DNSConfig,
+				},
+			}
+			if tt.Annotation != "" {
+				pod.Annotations[annotationUseConsulDNS] = tt.Annotation
+			}
+
+			config, err := tt.Handler.podDNSConfig(pod)
+			if tt.Err != "" {
+				require.Error(err)
+				require.Contains(err.Error(), tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.Expected, config)
+		})
+	}
+}
+
+// Test that injected pods with the annotation get the DNS policy and
+// config.
+func TestHandlerHandle_consulDNS(t *testing.T) {
+	require := require.New(t)
+	h := Handler{
+		ConsulDNSAddress:      "10.0.0.53",
+		ClusterDNSNameservers: []string{"10.0.0.10"},
+		Log:                   hclog.Default().Named("handler"),
+	}
+	pod := reinvocationPod(map[string]string{annotationUseConsulDNS: "true"})
+	pod.Spec.DNSPolicy = corev1.DNSClusterFirst
+
+	injected := mutateAndApply(t, &h, pod)
+	require.Equal(corev1.DNSNone, injected.Spec.DNSPolicy)
+	require.NotNil(injected.Spec.DNSConfig)
+	require.Equal([]string{"10.0.0.53", "10.0.0.10"}, injected.Spec.DNSConfig.Nameservers)
+	require.Equal("default.svc.cluster.local", injected.Spec.DNSConfig.Searches[0])
+}
+
+func TestResolvConfNameservers(t *testing.T) {
+	nameservers, err := ResolvConfNameservers(strings.NewReader(`
+search consul.svc.cluster.local svc.cluster.local cluster.local
+nameserver 10.0.0.10
+# nameserver 10.0.0.11
+nameserver   fd00::10
+options ndots:5
+`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.10", "fd00::10"}, nameservers)
+}
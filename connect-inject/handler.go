@@ -7,12 +7,16 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/mattbaird/jsonpatch"
 	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
@@ -21,6 +25,62 @@ import (
 const (
 	DefaultConsulImage = "consul:1.5.0"
 	DefaultEnvoyImage  = "envoyproxy/envoy-alpine:v1.9.1"
+
+	// DefaultConsulHTTPPort is the port the Consul client agents are
+	// expected to serve their HTTP API on if no other port is configured.
+	DefaultConsulHTTPPort = 8500
+
+	// DefaultConsulHTTPSPort is the port the Consul client agents are
+	// expected to serve their HTTPS API on if TLS is enabled.
+	DefaultConsulHTTPSPort = 8501
+
+	// DefaultProxyPort is the port of the public listener of the sidecar
+	// proxy if neither the handler nor the pod sets one.
+	DefaultProxyPort = 20000
+
+	// consulGRPCPort is the port of the Consul client agent's gRPC API
+	// that Envoy gets its configuration from.
+	consulGRPCPort = 8502
+
+	// DefaultSidecarUID and DefaultSidecarGID are the user and group IDs
+	// the Envoy sidecar runs as if no others are configured.
+	DefaultSidecarUID = 5995
+	DefaultSidecarGID = 5995
+
+	// DefaultSidecarPreStopTimeout is how long the preStop hook of the
+	// Envoy sidecar retries deregistering the services if no other
+	// timeout is configured.
+	DefaultSidecarPreStopTimeout = 30 * time.Second
+
+	// DefaultMetricsPort and DefaultPrometheusScrapePath are where the
+	// Envoy sidecar serves Prometheus metrics if no others are configured.
+	DefaultMetricsPort          = 20200
+	DefaultPrometheusScrapePath = "/metrics"
+
+	// DefaultTProxyOutboundListenerPort is the port of the Envoy listener
+	// that outbound traffic is redirected to in transparent proxy mode if
+	// no other is configured.
+	DefaultTProxyOutboundListenerPort = 15001
+
+	// DefaultCheckInterval and DefaultCheckDeregisterCriticalAfter are the
+	// interval of the generated health checks and how long their services
+	// may be critical before Consul deregisters them, if no others are
+	// configured.
+	DefaultCheckInterval                = 10 * time.Second
+	DefaultCheckDeregisterCriticalAfter = 10 * time.Minute
+
+	// DefaultServiceAccountTokenExpiration is how long the bound service
+	// account token of the ACL login is valid for if no other expiration is
+	// configured. The kubelet rotates it before it expires.
+	DefaultServiceAccountTokenExpiration = time.Hour
+
+	// minCheckDeregisterCriticalAfter is the shortest deregister-after
+	// duration that Consul accepts.
+	minCheckDeregisterCriticalAfter = time.Minute
+
+	// consulCACertPath is the path in the shared volume that the Consul
+	// CA certificate is written to when TLS is enabled.
+	consulCACertPath = "/consul/connect-inject/consul-ca.pem"
 )
 
 const (
@@ -28,19 +88,49 @@ const (
 	// a pod after an injection is done.
 	annotationStatus = "consul.hashicorp.com/connect-inject-status"
 
+	// annotationInjectorVersion is the key of the annotation that is added
+	// to a pod after an injection is done. It is the version of the
+	// injector that injected the pod.
+	annotationInjectorVersion = "consul.hashicorp.com/connect-inject-version"
+
 	// annotationInject is the key of the annotation that controls whether
 	// injection is explicitly enabled or disabled for a pod. This should
 	// be set to a truthy or falsy value, as parseable by strconv.ParseBool
 	annotationInject = "consul.hashicorp.com/connect-inject"
 
+	// annotationInjectProxy controls whether the pod's services get sidecar
+	// proxies. If it is set to a falsy value, as parseable by
+	// strconv.ParseBool, only the services are registered in the catalog,
+	// without joining the service mesh.
+	annotationInjectProxy = "consul.hashicorp.com/connect-inject-proxy"
+
 	// annotationService is the name of the service to proxy. This defaults
-	// to the name of the first container.
+	// to the value of the handler's service name label, or else to the name
+	// of the first container. A pod can register multiple
+	// services by setting this and annotationPort to comma-separated lists
+	// of equal length, e.g. web,web-admin. Upstreams, tags and metadata
+	// only apply to the first service.
 	annotationService = "consul.hashicorp.com/connect-service"
 
 	// annotationPort is the name or value of the port to proxy incoming
-	// connections to.
+	// connections to. This defaults to the first port of the first
+	// container. If neither is set, the service is registered with port 0
+	// and the proxy only makes outbound connections. See annotationService
+	// for pods with multiple services.
 	annotationPort = "consul.hashicorp.com/connect-service-port"
 
+	// annotationLocalServiceAddress is the IP address the sidecar proxy
+	// connects to the application on. This defaults to 127.0.0.1 if the
+	// service has a port.
+	annotationLocalServiceAddress = "consul.hashicorp.com/connect-service-local-address"
+
+	// annotationProxyPort is the port of the public listener of the
+	// sidecar proxy. If the pod registers multiple services, the proxies
+	// of the other services use the ports following it. This overrides
+	// the handler's default and must be set for pods that use the host
+	// network, since the default would collide with other pods on the node.
+	annotationProxyPort = "consul.hashicorp.com/connect-sidecar-proxy-port"
+
 	// annotationProtocol contains the protocol that should be used for
 	// the service that is being injected. Valid values are "http", "http2",
 	// "grpc" and "tcp".
@@ -50,11 +140,14 @@ const (
 	// proxy in the format of `<service-name>:<local-port>,...`. The
 	// service name should map to a Consul service namd and the local port
 	// is the local port in the pod that the listener will bind to. It can
-	// be a named port.
+	// be a named port. An upstream in another datacenter is specified as
+	// `<service-name>:<local-port>:<datacenter>` and a prepared query as
+	// `prepared_query:<query-name>:<local-port>`.
 	annotationUpstreams = "consul.hashicorp.com/connect-service-upstreams"
 
 	// annotationTags is a list of tags to register with the service
-	// this is specified as a comma separated list e.g. abc,123
+	// this is specified as a comma separated list e.g. abc,123. A comma
+	// within a tag can be escaped with a backslash, e.g. abc\,def.
 	annotationTags = "consul.hashicorp.com/service-tags"
 
 	// annotationConnectTags is a list of tags to register with the service
@@ -70,17 +163,148 @@ const (
 	// registration. This is specified in the format `<key>:<value>`
 	// e.g. consul.hashicorp.com/service-meta-foo:bar
 	annotationMeta = "consul.hashicorp.com/service-meta-"
+
+	// annotationSidecarEnv is the prefix of annotations that add
+	// environment variables to the Envoy sidecar. This is specified in the
+	// format `<prefix><name>: <value>`
+	// e.g. consul.hashicorp.com/sidecar-env-HTTPS_PROXY: "proxy:3128"
+	annotationSidecarEnv = "consul.hashicorp.com/sidecar-env-"
+
+	// annotationSidecarVolumeMounts is a list of volumes of the pod to
+	// mount in the Envoy sidecar in the format of
+	// `<volume-name>:<mount-path>[:ro],...`.
+	annotationSidecarVolumeMounts = "consul.hashicorp.com/sidecar-volume-mounts"
+
+	// annotationConsulHTTPPort is the port of the Consul client agent's
+	// HTTP API on the host. This overrides the port configured on the
+	// handler for a single pod.
+	annotationConsulHTTPPort = "consul.hashicorp.com/consul-http-port"
+
+	// annotationConsulTLS controls whether the injected containers talk
+	// to the Consul client agent over HTTPS. TLS is used by default when
+	// the handler has a CA certificate, so this can only be used to opt a
+	// pod out by setting it to a falsy value, as parseable by
+	// strconv.ParseBool.
+	annotationConsulTLS = "consul.hashicorp.com/consul-tls"
+
+	// annotationSidecarUID is the user ID the Envoy sidecar runs as. This
+	// overrides the user ID configured on the handler for a single pod.
+	annotationSidecarUID = "consul.hashicorp.com/sidecar-run-as-user"
+
+	// annotationConsulNamespace is the Consul Enterprise namespace to
+	// register the services in. It is only accepted if the handler allows
+	// pods to choose their namespace.
+	annotationConsulNamespace = "consul.hashicorp.com/consul-namespace"
+
+	// annotationSkipDeregister controls whether the preStop hook that
+	// deregisters the services, and logs out if ACLs are enabled, is added
+	// to the Envoy sidecar. This should be set to a truthy or falsy value,
+	// as parseable by strconv.ParseBool.
+	annotationSkipDeregister = "consul.hashicorp.com/skip-deregister"
+
+	// annotationProxyConfig is a JSON object that is added to the opaque
+	// config of the sidecar proxy, e.g. {"local_connect_timeout_ms": 2000}.
+	// Keys that the injector sets itself take precedence.
+	annotationProxyConfig = "consul.hashicorp.com/proxy-config"
+
+	// annotationEnableMetrics controls whether the Envoy sidecar serves
+	// Prometheus metrics and the pod is annotated to be scraped. This
+	// should be set to a truthy or falsy value, as parseable by
+	// strconv.ParseBool, and overrides the handler's default.
+	annotationEnableMetrics = "consul.hashicorp.com/enable-metrics"
+
+	// annotationMetricsPort and annotationPrometheusScrapePath are the port
+	// and path the Envoy sidecar serves Prometheus metrics on. These
+	// override the handler's defaults for a single pod.
+	annotationMetricsPort          = "consul.hashicorp.com/metrics-port"
+	annotationPrometheusScrapePath = "consul.hashicorp.com/prometheus-scrape-path"
+
+	// annotationPrometheusScrape, annotationPrometheusPort and
+	// annotationPrometheusPath are the conventional annotations that tell
+	// Prometheus to scrape a pod. They're added to pods with metrics
+	// enabled unless the pod already sets them.
+	annotationPrometheusScrape = "prometheus.io/scrape"
+	annotationPrometheusPort   = "prometheus.io/port"
+	annotationPrometheusPath   = "prometheus.io/path"
+
+	// annotationEnableTracing controls whether the Envoy sidecar sends
+	// spans to the tracing collector configured on the handler. This
+	// should be set to a truthy or falsy value, as parseable by
+	// strconv.ParseBool.
+	annotationEnableTracing = "consul.hashicorp.com/enable-tracing"
+
+	// annotationUseConsulDNS controls whether the pod resolves names with
+	// Consul DNS before the cluster's DNS. This should be set to a truthy
+	// or falsy value, as parseable by strconv.ParseBool.
+	annotationUseConsulDNS = "consul.hashicorp.com/use-consul-dns"
+
+	// annotationTransparentProxy controls whether the pod's traffic is
+	// transparently redirected through the Envoy sidecar. This should be
+	// set to a truthy or falsy value, as parseable by strconv.ParseBool,
+	// and overrides the handler's default.
+	annotationTransparentProxy = "consul.hashicorp.com/transparent-proxy"
+
+	// annotationTProxyOutboundListenerPort is the port of the Envoy
+	// listener that outbound traffic is redirected to in transparent proxy
+	// mode. This overrides the port configured on the handler.
+	annotationTProxyOutboundListenerPort = "consul.hashicorp.com/transparent-proxy-outbound-listener-port"
+
+	// annotationTProxyExcludeInboundPorts, annotationTProxyExcludeOutboundPorts,
+	// annotationTProxyExcludeOutboundCIDRs and annotationTProxyExcludeUIDs
+	// are comma-separated lists of inbound ports, outbound ports, outbound
+	// CIDRs and user IDs whose traffic isn't redirected through the Envoy
+	// sidecar in transparent proxy mode.
+	annotationTProxyExcludeInboundPorts  = "consul.hashicorp.com/transparent-proxy-exclude-inbound-ports"
+	annotationTProxyExcludeOutboundPorts = "consul.hashicorp.com/transparent-proxy-exclude-outbound-ports"
+	annotationTProxyExcludeOutboundCIDRs = "consul.hashicorp.com/transparent-proxy-exclude-outbound-cidrs"
+	annotationTProxyExcludeUIDs          = "consul.hashicorp.com/transparent-proxy-exclude-uids"
+
+	// annotationOverwriteProbes controls whether the HTTP liveness and
+	// readiness probes of the pod's containers are rewritten to go through
+	// expose path listeners of the sidecar proxy. This should be set to a
+	// truthy or falsy value, as parseable by strconv.ParseBool, and
+	// overrides the handler's default.
+	annotationOverwriteProbes = "consul.hashicorp.com/overwrite-probes"
+
+	// annotationCheckInterval, annotationCheckTimeout and
+	// annotationCheckDeregisterCriticalAfter tune the health checks the
+	// injector generates for the sidecar proxies. The values are durations
+	// as parseable by time.ParseDuration and override the handler's
+	// defaults for a single pod.
+	annotationCheckInterval                = "consul.hashicorp.com/check-interval"
+	annotationCheckTimeout                 = "consul.hashicorp.com/check-timeout"
+	annotationCheckDeregisterCriticalAfter = "consul.hashicorp.com/check-deregister-critical-after"
+
+	// annotationSidecarProxyCPURequest, annotationSidecarProxyCPULimit,
+	// annotationSidecarProxyMemoryRequest and annotationSidecarProxyMemoryLimit
+	// are the resources of the Envoy sidecar as Kubernetes quantities. These
+	// override the defaults configured on the handler for a single pod.
+	annotationSidecarProxyCPURequest    = "consul.hashicorp.com/sidecar-proxy-cpu-request"
+	annotationSidecarProxyCPULimit      = "consul.hashicorp.com/sidecar-proxy-cpu-limit"
+	annotationSidecarProxyMemoryRequest = "consul.hashicorp.com/sidecar-proxy-memory-request"
+	annotationSidecarProxyMemoryLimit   = "consul.hashicorp.com/sidecar-proxy-memory-limit"
+
+	// annotationSidecarProxyConcurrency is the number of worker threads of
+	// the Envoy sidecar. This overrides the concurrency configured on the
+	// handler for a single pod.
+	annotationSidecarProxyConcurrency = "consul.hashicorp.com/sidecar-proxy-concurrency"
 )
 
 var (
+	// validProtocols are the protocols that can be set for a service
+	// through the protocol annotation or the default protocol.
+	validProtocols = []string{"tcp", "http", "http2", "grpc"}
+
 	codecs       = serializer.NewCodecFactory(runtime.NewScheme())
 	deserializer = codecs.UniversalDeserializer()
 
 	// kubeSystemNamespaces is a list of namespaces that are considered
-	// "system" level namespaces and are always skipped (never injected).
+	// "system" level namespaces and are skipped (never injected) unless
+	// the handler allows system namespaces.
 	kubeSystemNamespaces = []string{
 		metav1.NamespaceSystem,
 		metav1.NamespacePublic,
+		"kube-node-lease",
 	}
 )
 
@@ -101,6 +325,14 @@ type Handler struct {
 	// use for identity with connectInjection if ACLs are enabled
 	AuthMethod string
 
+	// ServiceAccountTokenAudience makes the ACL login use a bound service
+	// account token with this audience, projected into a volume of the
+	// pod, instead of the pod's auto-mounted token. The token is valid for
+	// ServiceAccountTokenExpiration, or DefaultServiceAccountTokenExpiration
+	// if zero.
+	ServiceAccountTokenAudience   string
+	ServiceAccountTokenExpiration time.Duration
+
 	// WriteServiceDefaults controls whether injection should write a
 	// service-defaults config entry for each service.
 	// Requires an additional `protocol` parameter.
@@ -110,6 +342,179 @@ type Handler struct {
 	// registrations. It will be overridden by a specific annotation.
 	DefaultProtocol string
 
+	// ConsulHTTPPort is the port of the Consul client agent's HTTP API
+	// on the host. If this is zero, DefaultConsulHTTPPort is used.
+	ConsulHTTPPort int
+
+	// ConsulCACert is the PEM-encoded CA certificate of the Consul
+	// client agents. If this is set, the injected containers talk to the
+	// agents over HTTPS on ConsulHTTPSPort.
+	// ConsulHTTPSPort defaults to DefaultConsulHTTPSPort if zero.
+	ConsulCACert    string
+	ConsulHTTPSPort int
+
+	// SidecarUID and SidecarGID are the user and group IDs the Envoy
+	// sidecar runs as. They default to DefaultSidecarUID and
+	// DefaultSidecarGID if zero.
+	SidecarUID int64
+	SidecarGID int64
+
+	// DisableSidecarSecurityContext stops the injector from setting a
+	// security context on the Envoy sidecar, for clusters where the
+	// non-root defaults can't be used.
+	DisableSidecarSecurityContext bool
+
+	// EnableOpenShift makes the injected containers compatible with
+	// OpenShift, which assigns the user and group IDs of the containers
+	// from the namespace's range. SidecarUID, SidecarGID and the user ID
+	// annotation are ignored if this is true.
+	EnableOpenShift bool
+
+	// AllowK8sNamespaces and DenyK8sNamespaces are the Kubernetes
+	// namespaces that pods are and aren't injected in. "*" in the allow
+	// list allows all namespaces. An empty allow list also allows all
+	// namespaces. The deny list takes precedence over the allow list.
+	AllowK8sNamespaces []string
+	DenyK8sNamespaces  []string
+
+	// Namespace is the Kubernetes namespace the injector runs in. Like the
+	// Kubernetes system namespaces, it is skipped unless
+	// AllowSystemNamespaces is true, since injecting the pods that run the
+	// cluster or the injector itself can break them.
+	Namespace             string
+	AllowSystemNamespaces bool
+
+	// ConsulDestinationNamespace is the Consul Enterprise namespace that
+	// services are registered in. If EnableK8SNSMirroring is true, the
+	// services are instead registered in a namespace with the name of the
+	// pod's Kubernetes namespace, prefixed with K8SNSMirroringPrefix. No
+	// namespace is used if neither is set.
+	ConsulDestinationNamespace string
+	EnableK8SNSMirroring       bool
+	K8SNSMirroringPrefix       string
+
+	// ConsulPartition is the Consul Enterprise admin partition that
+	// services are registered in. Pods can't choose another partition, so
+	// that a partition's trust boundary is set by the injector alone. No
+	// partition is used if it is empty.
+	ConsulPartition string
+
+	// AllowConsulNamespaceAnnotation allows pods to choose the Consul
+	// namespace with the consul-namespace annotation. Otherwise pods with
+	// the annotation are rejected.
+	AllowConsulNamespaceAnnotation bool
+
+	// SidecarPreStopTimeout is how long the preStop hook of the Envoy
+	// sidecar retries deregistering the services while the Consul client
+	// agent is unreachable. It defaults to DefaultSidecarPreStopTimeout
+	// if zero.
+	SidecarPreStopTimeout time.Duration
+
+	// DefaultProxyPort is the port of the public listener of the sidecar
+	// proxy unless the pod overrides it with an annotation. It defaults to
+	// the constant of the same name if zero.
+	DefaultProxyPort int
+
+	// EnableTransparentProxy redirects the traffic of injected pods
+	// through the Envoy sidecar with iptables unless the pod opts out
+	// with an annotation. This requires Consul 1.10 or later.
+	EnableTransparentProxy bool
+
+	// TProxyOutboundListenerPort is the port of the Envoy listener that
+	// outbound traffic is redirected to in transparent proxy mode. It
+	// defaults to DefaultTProxyOutboundListenerPort if zero.
+	TProxyOutboundListenerPort int
+
+	// OverwriteProbes rewrites the HTTP liveness and readiness probes of
+	// injected pods to go through expose path listeners of the sidecar
+	// proxy, unless the pod opts out with an annotation. This lets kubelet
+	// probe applications that only listen on localhost or that are only
+	// reachable through the mesh.
+	OverwriteProbes bool
+
+	// DefaultEnableMetrics makes the Envoy sidecars serve Prometheus
+	// metrics unless the pod opts out with an annotation.
+	// DefaultMetricsPort and DefaultPrometheusScrapePath are the port and
+	// path they're served on, and default to the constants of the same
+	// name if zero.
+	DefaultEnableMetrics        bool
+	DefaultMetricsPort          int
+	DefaultPrometheusScrapePath string
+
+	// TracingProvider is the kind of tracing collector, zipkin or jaeger,
+	// that the Envoy sidecars of pods with the enable-tracing annotation
+	// send spans to at TracingCollectorAddress (host:port). Tracing is
+	// unavailable if it is empty. TracingServiceNameTemplate is rendered
+	// with the service and Kubernetes namespace of the proxy to the name
+	// it reports spans under, and defaults to
+	// DefaultTracingServiceNameTemplate if empty.
+	TracingProvider            string
+	TracingCollectorAddress    string
+	TracingServiceNameTemplate string
+
+	// ConsulDNSAddress is the IP address that pods with the use-consul-dns
+	// annotation send DNS queries to first, such as the cluster IP of a
+	// Service in front of the DNS ports of the Consul client agents. Names
+	// Consul doesn't resolve are resolved by ClusterDNSNameservers, in the
+	// search domains of ClusterDomain, which defaults to
+	// DefaultClusterDomain if empty. Pods that set their own dnsConfig are
+	// rejected unless MergePodDNSConfig is true.
+	ConsulDNSAddress      string
+	ClusterDNSNameservers []string
+	ClusterDomain         string
+	MergePodDNSConfig     bool
+
+	// CheckInterval, CheckTimeout and CheckDeregisterCriticalAfter are the
+	// defaults of the generated health checks. CheckInterval and
+	// CheckDeregisterCriticalAfter default to DefaultCheckInterval and
+	// DefaultCheckDeregisterCriticalAfter if zero. If CheckTimeout is zero,
+	// Consul's default timeout is used.
+	CheckInterval                time.Duration
+	CheckTimeout                 time.Duration
+	CheckDeregisterCriticalAfter time.Duration
+
+	// DefaultProxyCPURequest, DefaultProxyCPULimit, DefaultProxyMemoryRequest
+	// and DefaultProxyMemoryLimit are the resources of the Envoy sidecars
+	// unless the pod overrides them with annotations. Zero quantities
+	// aren't set.
+	DefaultProxyCPURequest    resource.Quantity
+	DefaultProxyCPULimit      resource.Quantity
+	DefaultProxyMemoryRequest resource.Quantity
+	DefaultProxyMemoryLimit   resource.Quantity
+
+	// DefaultProxyConcurrency is the number of worker threads of the Envoy
+	// sidecars unless the pod overrides it with an annotation. If zero,
+	// Envoy starts one worker thread per CPU core of the node.
+	DefaultProxyConcurrency int
+
+	// DefaultServiceTags are added to the tags of every injected service
+	// and its proxy, before the tags from the pod's annotations.
+	DefaultServiceTags []string
+
+	// CopyLabelsToMeta maps the keys of pod labels to keys of the service
+	// metadata. The labels the pod has are added to the metadata of its
+	// first service, unless a meta annotation sets the same key.
+	CopyLabelsToMeta map[string]string
+
+	// DefaultServiceNameLabel is the key of the pod label whose value is
+	// the service name of pods without the service annotation, such as
+	// app.kubernetes.io/name. Pods without the label default to the name of
+	// their first container.
+	DefaultServiceNameLabel string
+
+	// RenameConflictingNames gives injected containers and volumes whose
+	// names are already used by the pod a suffixed name. Otherwise such
+	// pods are rejected.
+	RenameConflictingNames bool
+
+	// Version is the version of the injector. It is added to the pods
+	// it injects.
+	Version string
+
+	// Metrics records the outcome and duration of admission requests.
+	// Requests aren't recorded if it is nil.
+	Metrics *Metrics
+
 	// Log
 	Log hclog.Logger
 }
@@ -167,8 +572,41 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 }
 
 // Mutate takes an admission request and performs mutation if necessary,
-// returning the final API response.
+// returning the final API response. The outcome and duration of the
+// request are recorded in the handler's metrics.
+//
+// Mutate has no side effects outside the injector. It only computes the
+// patch, and the injected containers reach Consul once the pod runs. Dry
+// run requests are therefore answered like any other, and the webhook can
+// be registered with sideEffects set to None.
 func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+	start := time.Now()
+	resp, outcome := h.mutate(req)
+	if !resp.Allowed {
+		outcome = outcomeError
+	}
+	h.Metrics.observe(req.Namespace, outcome, time.Since(start))
+	return resp
+}
+
+// mutate returns the response to the admission request and its outcome.
+func (h *Handler) mutate(req *v1beta1.AdmissionRequest) (*v1beta1.AdmissionResponse, string) {
+	// Pods in system namespaces and namespaces that aren't allowed are
+	// never touched, so this is checked before anything else.
+	if h.systemNamespace(req.Namespace) {
+		h.Log.Info("Skipping pod in system namespace", "Namespace", req.Namespace)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+			UID:     req.UID,
+		}, outcomeSkippedNamespace
+	}
+	if !h.namespaceAllowed(req.Namespace) {
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+			UID:     req.UID,
+		}, outcomeSkippedNamespace
+	}
+
 	// Decode the pod from the request
 	var pod corev1.Pod
 	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
@@ -177,7 +615,12 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
-		}
+		}, outcomeError
+	}
+
+	// The namespace isn't always set on the pod of a create request
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
 	}
 
 	// Build the basic response
@@ -189,6 +632,30 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 	// Accumulate any patches here
 	var patches []jsonpatch.JsonPatchOperation
 
+	// Pods that were already injected, for example because the webhook is
+	// invoked again after other webhooks changed the pod, only get back
+	// what was removed from them since.
+	if pod.Annotations[annotationStatus] != "" {
+		var err error
+		patches, err = h.reinjectionPatches(&pod)
+		if err != nil {
+			return admissionError(err), outcomeError
+		}
+		if len(patches) == 0 {
+			return resp, outcomeSkippedAnnotation
+		}
+		return patchResponse(resp, patches), outcomeInjected
+	}
+
+	// Record where the service name comes from in the status annotation
+	// if the pod doesn't set it, since the defaults can be surprising.
+	status := "injected"
+	if _, ok := pod.Annotations[annotationService]; !ok {
+		if _, source := h.defaultServiceName(&pod); source != "" {
+			status = fmt.Sprintf("injected; service name from %s", source)
+		}
+	}
+
 	// Setup the default annotation values that are used for the container.
 	// This MUST be done before shouldInject is called since k.
 	if err := h.defaultAnnotations(&pod, &patches); err != nil {
@@ -196,7 +663,15 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
-		}
+		}, outcomeError
+	}
+
+	// Pods without a port annotation or a default port, such as pure
+	// clients, register their services with port 0. They get a mesh
+	// identity for their upstream connections, but nothing is proxied to
+	// them, which the status annotation records.
+	if _, ok := pod.Annotations[annotationPort]; !ok {
+		status += "; no service port"
 	}
 
 	// Check if we should inject, for example we don't inject in the
@@ -206,98 +681,150 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 			Result: &metav1.Status{
 				Message: fmt.Sprintf("Error checking if should inject: %s", err),
 			},
-		}
+		}, outcomeError
 	} else if !shouldInject {
-		return resp
+		return resp, outcomeSkippedAnnotation
 	}
 
-	// Add our volume that will be shared by the init container and
-	// the sidecar for passing data in the pod.
+	// Add our volumes, init containers and sidecars
+	objects, err := h.injectedObjects(&pod)
+	if err != nil {
+		return admissionError(err), outcomeError
+	}
 	patches = append(patches, addVolume(
 		pod.Spec.Volumes,
-		[]corev1.Volume{h.containerVolume()},
+		objects.Volumes,
 		"/spec/volumes")...)
 
 	// Add the upstream services as environment variables for easy
 	// service discovery.
+	envVars, err := h.containerEnvVars(&pod)
+	if err != nil {
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("Error configuring upstream environment variables: %s", err),
+			},
+		}, outcomeError
+	}
 	for i, container := range pod.Spec.InitContainers {
 		patches = append(patches, addEnvVar(
 			container.Env,
-			h.containerEnvVars(&pod),
+			envVars,
 			fmt.Sprintf("/spec/initContainers/%d/env", i))...)
 	}
 	for i, container := range pod.Spec.Containers {
 		patches = append(patches, addEnvVar(
 			container.Env,
-			h.containerEnvVars(&pod),
+			envVars,
 			fmt.Sprintf("/spec/containers/%d/env", i))...)
 	}
 
-	// Add the init container that registers the service and sets up
-	// the Envoy configuration.
-	container, err := h.containerInit(&pod)
-	if err != nil {
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: fmt.Sprintf("Error configuring injection init container: %s", err),
-			},
-		}
-	}
 	patches = append(patches, addContainer(
 		pod.Spec.InitContainers,
-		[]corev1.Container{container},
+		objects.InitContainers,
 		"/spec/initContainers")...)
+	patches = append(patches, addContainer(
+		pod.Spec.Containers,
+		objects.Containers,
+		"/spec/containers")...)
 
-	// Add the Envoy sidecar
-	esContainer, err := h.containerSidecar(&pod)
+	// Point the HTTP probes of the containers at the expose path listeners
+	// of the proxy.
+	probes, err := h.exposedProbes(&pod)
 	if err != nil {
 		return &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
-				Message: fmt.Sprintf("Error configuring injection sidecar container: %s", err),
+				Message: fmt.Sprintf("Error configuring probes: %s", err),
 			},
-		}
+		}, outcomeError
+	}
+	for _, probe := range probes {
+		patches = append(patches, jsonpatch.JsonPatchOperation{
+			Operation: "replace",
+			Path: fmt.Sprintf("/spec/containers/%d/%s/httpGet/port",
+				probe.Container, probe.Probe),
+			Value: probe.ListenerPort,
+		})
 	}
-	patches = append(patches, addContainer(
-		pod.Spec.Containers,
-		[]corev1.Container{esContainer},
-		"/spec/containers")...)
 
-	// Add annotations so that we know we're injected
+	// Point the pod's DNS at Consul if it asks for it.
+	dnsConfig, err := h.podDNSConfig(&pod)
+	if err != nil {
+		return admissionError(err), outcomeError
+	}
+	if dnsConfig != nil {
+		patches = append(patches,
+			jsonpatch.JsonPatchOperation{
+				Operation: "add",
+				Path:      "/spec/dnsPolicy",
+				Value:     corev1.DNSNone,
+			},
+			jsonpatch.JsonPatchOperation{
+				Operation: "add",
+				Path:      "/spec/dnsConfig",
+				Value:     dnsConfig,
+			})
+	}
+
+	// Add annotations so that we know we're injected, and by which version
+	// of the injector. The status annotation also stops the pod from being
+	// injected again.
 	patches = append(patches, updateAnnotation(
 		pod.Annotations,
-		map[string]string{annotationStatus: "injected"})...)
+		map[string]string{annotationStatus: status})...)
+	pod.Annotations[annotationStatus] = status
+	if h.Version != "" {
+		patches = append(patches, updateAnnotation(
+			pod.Annotations,
+			map[string]string{annotationInjectorVersion: h.Version})...)
+	}
 
-	// Generate the patch
-	var patch []byte
-	if len(patches) > 0 {
-		var err error
-		patch, err = json.Marshal(patches)
-		if err != nil {
-			log.Printf("Could not marshal patches: %s", err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
+	// Tell Prometheus where to scrape the sidecar's metrics, unless the
+	// pod already points it somewhere else.
+	metricsPort, metricsPath, err := h.prometheusMetrics(&pod)
+	if err != nil {
+		return admissionError(err), outcomeError
+	}
+	if metricsPort > 0 {
+		scrape := make(map[string]string)
+		for k, v := range map[string]string{
+			annotationPrometheusScrape: "true",
+			annotationPrometheusPort:   strconv.Itoa(int(metricsPort)),
+			annotationPrometheusPath:   metricsPath,
+		} {
+			if _, ok := pod.Annotations[k]; !ok {
+				scrape[k] = v
 			}
 		}
-
-		resp.Patch = patch
-		patchType := v1beta1.PatchTypeJSONPatch
-		resp.PatchType = &patchType
+		patches = append(patches, updateAnnotation(pod.Annotations, scrape)...)
 	}
 
-	return resp
+	return patchResponse(resp, patches), outcomeInjected
 }
 
-func (h *Handler) shouldInject(pod *corev1.Pod, namespace string) (bool, error) {
+// patchResponse returns the response with the patches added, if any.
+func patchResponse(resp *v1beta1.AdmissionResponse, patches []jsonpatch.JsonPatchOperation) *v1beta1.AdmissionResponse {
+	if len(patches) == 0 {
+		return resp
+	}
 
-	// Don't inject in the Kubernetes system namespaces
-	for _, ns := range kubeSystemNamespaces {
-		if namespace == ns {
-			return false, nil
+	patch, err := json.Marshal(patches)
+	if err != nil {
+		log.Printf("Could not marshal patches: %s", err)
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
 		}
 	}
 
+	resp.Patch = patch
+	patchType := v1beta1.PatchTypeJSONPatch
+	resp.PatchType = &patchType
+	return resp
+}
+
+func (h *Handler) shouldInject(pod *corev1.Pod, namespace string) (bool, error) {
 	// If we already injected then don't inject again
 	if pod.Annotations[annotationStatus] != "" {
 		return false, nil
@@ -314,33 +841,99 @@ func (h *Handler) shouldInject(pod *corev1.Pod, namespace string) (bool, error)
 	// this has to be the last check since it sets a default value after
 	// all other checks.
 	if raw, ok := pod.Annotations[annotationInject]; ok {
-		return strconv.ParseBool(raw)
+		inject, err := strconv.ParseBool(raw)
+		if err != nil {
+			return false, fmt.Errorf("%s annotation value of %q is not a valid boolean",
+				annotationInject, raw)
+		}
+		return inject, nil
 	}
 
 	return !h.RequireAnnotation, nil
 }
 
+// systemNamespace returns true if the given Kubernetes namespace is a
+// system namespace or the injector's own namespace, and the handler doesn't
+// allow injecting in those.
+func (h *Handler) systemNamespace(namespace string) bool {
+	if h.AllowSystemNamespaces {
+		return false
+	}
+	if h.Namespace != "" && namespace == h.Namespace {
+		return true
+	}
+	for _, ns := range kubeSystemNamespaces {
+		if namespace == ns {
+			return true
+		}
+	}
+
+	return false
+}
+
+// namespaceAllowed returns true if pods in the given Kubernetes namespace
+// can be injected according to the allow and deny lists of the handler.
+func (h *Handler) namespaceAllowed(namespace string) bool {
+	for _, ns := range h.DenyK8sNamespaces {
+		if ns == namespace {
+			return false
+		}
+	}
+
+	if len(h.AllowK8sNamespaces) == 0 {
+		return true
+	}
+	for _, ns := range h.AllowK8sNamespaces {
+		if ns == "*" || ns == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// defaultServiceName returns the service name of a pod without the service
+// annotation, along with a description of where it comes from. It is the
+// value of the handler's service name label if the pod has it, or else the
+// name of the first container. It returns empty strings if there's neither.
+func (h *Handler) defaultServiceName(pod *corev1.Pod) (string, string) {
+	if h.DefaultServiceNameLabel != "" {
+		if name := pod.Labels[h.DefaultServiceNameLabel]; name != "" {
+			return name, fmt.Sprintf("label %s", h.DefaultServiceNameLabel)
+		}
+	}
+
+	if cs := pod.Spec.Containers; len(cs) > 0 {
+		return cs[0].Name, fmt.Sprintf("container %s", cs[0].Name)
+	}
+
+	return "", ""
+}
+
 func (h *Handler) defaultAnnotations(pod *corev1.Pod, patches *[]jsonpatch.JsonPatchOperation) error {
 	if pod.ObjectMeta.Annotations == nil {
 		pod.ObjectMeta.Annotations = make(map[string]string)
 	}
 
-	// Default service name is the name of the first container.
+	// Default service name is the value of the service name label, or
+	// else the name of the first container.
 	if _, ok := pod.ObjectMeta.Annotations[annotationService]; !ok {
-		if cs := pod.Spec.Containers; len(cs) > 0 {
+		if name, _ := h.defaultServiceName(pod); name != "" {
 			// Create the patch for this first, so that the Annotation
 			// object will be created if necessary
 			*patches = append(*patches, updateAnnotation(
 				pod.Annotations,
-				map[string]string{annotationService: cs[0].Name})...)
+				map[string]string{annotationService: name})...)
 
 			// Set the annotation for checking in shouldInject
-			pod.ObjectMeta.Annotations[annotationService] = cs[0].Name
+			pod.ObjectMeta.Annotations[annotationService] = name
 		}
 	}
 
-	// Default service port is the first port exported in the container
-	if _, ok := pod.ObjectMeta.Annotations[annotationPort]; !ok {
+	// Default service port is the first port exported in the container.
+	// There is no sensible default if the pod registers multiple services.
+	multipleServices := strings.Contains(pod.ObjectMeta.Annotations[annotationService], ",")
+	if _, ok := pod.ObjectMeta.Annotations[annotationPort]; !ok && !multipleServices {
 		if cs := pod.Spec.Containers; len(cs) > 0 {
 			if ps := cs[0].Ports; len(ps) > 0 {
 				if ps[0].Name != "" {
@@ -383,19 +976,249 @@ func (h *Handler) defaultAnnotations(pod *corev1.Pod, patches *[]jsonpatch.JsonP
 	return nil
 }
 
+// consulHTTPPort returns the port the injected containers should use to
+// reach the Consul client agent's HTTP API. The pod annotation takes
+// precedence over the handler configuration.
+func (h *Handler) consulHTTPPort(pod *corev1.Pod) (int, error) {
+	port := h.ConsulHTTPPort
+	if port == 0 {
+		port = DefaultConsulHTTPPort
+	}
+
+	if raw, ok := pod.Annotations[annotationConsulHTTPPort]; ok {
+		var err error
+		port, err = strconv.Atoi(raw)
+		if err != nil || port < 1 || port > 65535 {
+			return 0, fmt.Errorf("%s annotation value of %q is not a valid port",
+				annotationConsulHTTPPort, raw)
+		}
+	}
+
+	return port, nil
+}
+
+// consulTLS returns whether the injected containers should talk to the
+// Consul client agent over HTTPS.
+func (h *Handler) consulTLS(pod *corev1.Pod) (bool, error) {
+	enabled := true
+	if raw, ok := pod.Annotations[annotationConsulTLS]; ok {
+		var err error
+		enabled, err = strconv.ParseBool(raw)
+		if err != nil {
+			return false, fmt.Errorf("%s annotation value of %q is not a valid boolean",
+				annotationConsulTLS, raw)
+		}
+	}
+
+	return enabled && h.ConsulCACert != "", nil
+}
+
+// serviceOnly returns true if the pod's services are registered without
+// sidecar proxies. The pod then has no proxy to reach its upstreams
+// through, so the upstreams annotation is an error.
+func (h *Handler) serviceOnly(pod *corev1.Pod) (bool, error) {
+	raw, ok := pod.Annotations[annotationInjectProxy]
+	if !ok {
+		return false, nil
+	}
+	proxy, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("%s annotation value of %q is not a valid boolean",
+			annotationInjectProxy, raw)
+	}
+	if !proxy && pod.Annotations[annotationUpstreams] != "" {
+		return false, fmt.Errorf("%s annotation can't be used without a sidecar proxy",
+			annotationUpstreams)
+	}
+
+	return !proxy, nil
+}
+
+// prometheusMetrics returns the port and path the Envoy sidecar serves
+// Prometheus metrics on. The port is zero if metrics aren't enabled for
+// the pod or the pod has no sidecar.
+func (h *Handler) prometheusMetrics(pod *corev1.Pod) (int32, string, error) {
+	if serviceOnly, err := h.serviceOnly(pod); err != nil || serviceOnly {
+		return 0, "", err
+	}
+
+	enabled := h.DefaultEnableMetrics
+	if raw, ok := pod.Annotations[annotationEnableMetrics]; ok {
+		var err error
+		enabled, err = strconv.ParseBool(raw)
+		if err != nil {
+			return 0, "", fmt.Errorf("%s annotation value of %q is not a valid boolean",
+				annotationEnableMetrics, raw)
+		}
+	}
+	if !enabled {
+		return 0, "", nil
+	}
+
+	port := int64(h.DefaultMetricsPort)
+	if port == 0 {
+		port = DefaultMetricsPort
+	}
+	if raw, ok := pod.Annotations[annotationMetricsPort]; ok {
+		var err error
+		port, err = strconv.ParseInt(raw, 10, 32)
+		if err != nil || port < 1 || port > 65535 {
+			return 0, "", fmt.Errorf("%s annotation value of %q is not a valid port",
+				annotationMetricsPort, raw)
+		}
+	}
+
+	path := h.DefaultPrometheusScrapePath
+	if path == "" {
+		path = DefaultPrometheusScrapePath
+	}
+	if raw, ok := pod.Annotations[annotationPrometheusScrapePath]; ok {
+		if !strings.HasPrefix(raw, "/") {
+			return 0, "", fmt.Errorf("%s annotation value of %q must be an absolute path",
+				annotationPrometheusScrapePath, raw)
+		}
+		path = raw
+	}
+
+	return int32(port), path, nil
+}
+
+// partitionEnvVars returns the environment variable that makes the
+// Consul CLI of the injected containers use the handler's admin partition,
+// if any.
+func (h *Handler) partitionEnvVars() []corev1.EnvVar {
+	if h.ConsulPartition == "" {
+		return nil
+	}
+	return []corev1.EnvVar{{Name: "CONSUL_PARTITION", Value: h.ConsulPartition}}
+}
+
+// consulNamespaceFormat is the format Consul requires of namespace names.
+var consulNamespaceFormat = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,62}[a-zA-Z0-9])?$`)
+
+// ValidConsulNamespace returns true if the name is a valid name of a
+// Consul Enterprise namespace.
+func ValidConsulNamespace(name string) bool {
+	return consulNamespaceFormat.MatchString(name)
+}
+
+// consulNamespace returns the Consul Enterprise namespace to register
+// the pod's services in. It is empty if namespaces aren't used.
+func (h *Handler) consulNamespace(pod *corev1.Pod) (string, error) {
+	if raw, ok := pod.Annotations[annotationConsulNamespace]; ok {
+		if !h.AllowConsulNamespaceAnnotation {
+			return "", fmt.Errorf("%s annotation is not allowed, the Consul namespace "+
+				"is chosen by the injector", annotationConsulNamespace)
+		}
+		if raw == "" {
+			return "", fmt.Errorf("%s annotation must not be empty", annotationConsulNamespace)
+		}
+		if !ValidConsulNamespace(raw) {
+			return "", fmt.Errorf("%s annotation value of %q is not a valid Consul namespace name",
+				annotationConsulNamespace, raw)
+		}
+		return raw, nil
+	}
+
+	if h.EnableK8SNSMirroring {
+		// The prefix is validated at startup, but the mirrored name can
+		// still be too long.
+		namespace := h.K8SNSMirroringPrefix + pod.Namespace
+		if !ValidConsulNamespace(namespace) {
+			return "", fmt.Errorf("Consul namespace %q mirrored from Kubernetes namespace %q "+
+				"is not a valid Consul namespace name", namespace, pod.Namespace)
+		}
+		return namespace, nil
+	}
+
+	return h.ConsulDestinationNamespace, nil
+}
+
+// hostAddrCommand is the shell command that sets HOST_ADDR to the IP
+// address of the node in a form that a port can be appended to. Whether
+// the address is IPv4 or IPv6 is only known in the container, and IPv6
+// addresses must be bracketed. podAddrCommand does the same for POD_ADDR
+// and the IP address of the pod.
+const (
+	hostAddrCommand = `HOST_ADDR="${HOST_IP}"
+case "${HOST_ADDR}" in *:*) HOST_ADDR="[${HOST_ADDR}]" ;; esac
+`
+	podAddrCommand = `POD_ADDR="${POD_IP}"
+case "${POD_ADDR}" in *:*) POD_ADDR="[${POD_ADDR}]" ;; esac
+`
+)
+
+// consulHTTPAddr returns the value of CONSUL_HTTP_ADDR for the injected
+// containers. The address refers to the HOST_ADDR shell variable, so the
+// command of the container must start with hostAddrCommand.
+func (h *Handler) consulHTTPAddr(pod *corev1.Pod) (string, error) {
+	tls, err := h.consulTLS(pod)
+	if err != nil {
+		return "", err
+	}
+	if tls {
+		port := h.ConsulHTTPSPort
+		if port == 0 {
+			port = DefaultConsulHTTPSPort
+		}
+		return fmt.Sprintf("https://${HOST_ADDR}:%d", port), nil
+	}
+
+	port, err := h.consulHTTPPort(pod)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("${HOST_ADDR}:%d", port), nil
+}
+
+// ValidProtocol returns true if the protocol can be used in a
+// service-defaults config written during injection.
+func ValidProtocol(protocol string) bool {
+	for _, p := range validProtocols {
+		if protocol == p {
+			return true
+		}
+	}
+	return false
+}
+
+// portValue returns the port number for the value of a port annotation.
+// The value is either a port number or the name of a container port in
+// the pod. A port name that is used by more than one container is an error
+// since it is ambiguous which port is meant.
 func portValue(pod *corev1.Pod, value string) (int32, error) {
-	// First search for the named port
+	if raw, err := strconv.ParseInt(value, 0, 32); err == nil {
+		return int32(raw), nil
+	}
+
+	// Not a number, so search for the named port
+	var port int32
+	var containers, names []string
 	for _, c := range pod.Spec.Containers {
 		for _, p := range c.Ports {
+			if p.Name == "" {
+				continue
+			}
+			names = append(names, p.Name)
 			if p.Name == value {
-				return p.ContainerPort, nil
+				port = p.ContainerPort
+				containers = append(containers, c.Name)
 			}
 		}
 	}
 
-	// Named port not found, return the parsed value
-	raw, err := strconv.ParseInt(value, 0, 32)
-	return int32(raw), err
+	switch {
+	case len(containers) > 1:
+		return 0, fmt.Errorf("port name %q is ambiguous, it is used by containers %s",
+			value, strings.Join(containers, ", "))
+	case len(containers) == 0 && len(names) == 0:
+		return 0, fmt.Errorf("no container port named %q, the pod has no named ports", value)
+	case len(containers) == 0:
+		return 0, fmt.Errorf("no container port named %q, available port names are %s",
+			value, strings.Join(names, ", "))
+	}
+
+	return port, nil
 }
 
 func admissionError(err error) *v1beta1.AdmissionResponse {
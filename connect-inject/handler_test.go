@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/mattbaird/jsonpatch"
@@ -13,6 +15,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 func TestHandlerHandle(t *testing.T) {
@@ -102,7 +105,7 @@ func TestHandlerHandle(t *testing.T) {
 				Object: encodeRaw(t, &corev1.Pod{
 					ObjectMeta: metav1.ObjectMeta{
 						Annotations: map[string]string{
-							annotationUpstreams: "echo:1234,db:1234",
+							annotationUpstreams: "echo:1234,db:1235",
 						},
 					},
 
@@ -312,33 +315,1102 @@ func TestHandlerHandle(t *testing.T) {
 				},
 			},
 		},
+
+		{
+			"invalid consul HTTP port annotation",
+			Handler{Log: hclog.Default().Named("handler")},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							annotationConsulHTTPPort: "not-a-port",
+						},
+					},
+
+					Spec: basicSpec,
+				}),
+			},
+			"is not a valid port",
+			nil,
+		},
+
+		{
+			"malformed upstreams annotation",
+			Handler{Log: hclog.Default().Named("handler")},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							annotationUpstreams: "echo",
+						},
+					},
+
+					Spec: basicSpec,
+				}),
+			},
+			`upstream "echo" must be in the format`,
+			nil,
+		},
+
+		{
+			"pod with multiple services",
+			Handler{Log: hclog.Default().Named("handler")},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							annotationService: "web,web-admin",
+							annotationPort:    "8080,9090",
+						},
+					},
+
+					Spec: basicSpec,
+				}),
+			},
+			"",
+			[]jsonpatch.JsonPatchOperation{
+				{
+					Operation: "add",
+					Path:      "/spec/volumes",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/-",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/-",
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationStatus),
+				},
+			},
+		},
+
+		{
+			"unknown service port name",
+			Handler{Log: hclog.Default().Named("handler")},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							annotationPort: "grpc",
+						},
+					},
+
+					Spec: basicSpec,
+				}),
+			},
+			`consul.hashicorp.com/connect-service-port annotation value of "grpc" is invalid: no container port named "grpc"`,
+			nil,
+		},
+
+		{
+			"multiple services with mismatched ports",
+			Handler{Log: hclog.Default().Named("handler")},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							annotationService: "web,web-admin",
+							annotationPort:    "8080",
+						},
+					},
+
+					Spec: basicSpec,
+				}),
+			},
+			"they must be of equal length",
+			nil,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			resp := tt.Handler.Mutate(&tt.Req)
+			if (tt.Err == "") != resp.Allowed {
+				t.Fatalf("allowed: %v, expected err: %v", resp.Allowed, tt.Err)
+			}
+			if tt.Err != "" {
+				require.Contains(resp.Result.Message, tt.Err)
+				return
+			}
+
+			var actual []jsonpatch.JsonPatchOperation
+			if len(resp.Patch) > 0 {
+				require.NoError(json.Unmarshal(resp.Patch, &actual))
+				for i, _ := range actual {
+					actual[i].Value = nil
+				}
+			}
+			require.Equal(tt.Patches, actual)
+		})
+	}
+}
+
+// Test that the ACL init container is only added with an auth method and
+// that it runs before the init container that uses the ACL token.
+func TestHandlerHandle_aclInitContainer(t *testing.T) {
+	cases := []struct {
+		Name             string
+		AuthMethod       string
+		TransparentProxy bool
+		Expected         []string
+	}{
+		{
+			"no auth method",
+			"",
+			false,
+			[]string{"consul-connect-inject-init"},
+		},
+
+		{
+			"auth method",
+			"auth-method",
+			false,
+			[]string{"consul-connect-inject-acl-init", "consul-connect-inject-init"},
+		},
+
+		{
+			"auth method and transparent proxy",
+			"auth-method",
+			true,
+			[]string{
+				"consul-connect-inject-acl-init",
+				"consul-connect-inject-init",
+				"consul-connect-inject-tproxy-init",
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{
+				AuthMethod:             tt.AuthMethod,
+				EnableTransparentProxy: tt.TransparentProxy,
+				Log:                    hclog.Default().Named("handler"),
+			}
+			req := v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{
+								Name: "web",
+								VolumeMounts: []corev1.VolumeMount{
+									{
+										Name:      "default-token-podid",
+										ReadOnly:  true,
+										MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+									},
+								},
+							},
+						},
+					},
+				}),
+			}
+			resp := h.Mutate(&req)
+			require.True(resp.Allowed)
+
+			var patches []struct {
+				Path  string
+				Value json.RawMessage
+			}
+			require.NoError(json.Unmarshal(resp.Patch, &patches))
+			var actual []string
+			for _, patch := range patches {
+				switch patch.Path {
+				case "/spec/initContainers":
+					var containers []corev1.Container
+					require.NoError(json.Unmarshal(patch.Value, &containers))
+					for _, container := range containers {
+						actual = append(actual, container.Name)
+					}
+				case "/spec/initContainers/-":
+					var container corev1.Container
+					require.NoError(json.Unmarshal(patch.Value, &container))
+					actual = append(actual, container.Name)
+				}
+			}
+			require.Equal(tt.Expected, actual)
+		})
+	}
+}
+
+// Test that pods are only injected in the allowed namespaces and that
+// pods in other namespaces are allowed without a patch.
+func TestHandlerHandle_k8sNamespaces(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Allow     []string
+		Deny      []string
+		Namespace string
+		Injected  bool
+	}{
+		{"no lists", nil, nil, "default", true},
+		{"allowed", []string{"default"}, nil, "default", true},
+		{"not allowed", []string{"web"}, nil, "default", false},
+		{"one of multiple allowed", []string{"web", "default"}, nil, "default", true},
+		{"wildcard", []string{"*"}, nil, "default", true},
+		{"denied", nil, []string{"default"}, "default", false},
+		{"other namespace denied", nil, []string{"consul"}, "default", true},
+		{"denied and allowed", []string{"default"}, []string{"default"}, "default", false},
+		{"wildcard and denied", []string{"*"}, []string{"default"}, "default", false},
+		{"wildcard and other namespace denied", []string{"*"}, []string{"consul"}, "default", true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{
+				AllowK8sNamespaces: tt.Allow,
+				DenyK8sNamespaces:  tt.Deny,
+				Log:                hclog.Default().Named("handler"),
+			}
+			req := v1beta1.AdmissionRequest{
+				Namespace: tt.Namespace,
+				Object: encodeRaw(t, &corev1.Pod{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{
+								Name: "web",
+							},
+						},
+					},
+				}),
+			}
+			resp := h.Mutate(&req)
+			require.True(resp.Allowed)
+			if tt.Injected {
+				require.NotEmpty(resp.Patch)
+			} else {
+				require.Empty(resp.Patch)
+			}
+		})
+	}
+}
+
+// Test that pods with invalid annotation values are rejected with an
+// error that names the annotation.
+func TestHandlerHandle_invalidAnnotations(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Value      string
+		Err        string
+	}{
+		{
+			annotationInject,
+			"maybe",
+			`consul.hashicorp.com/connect-inject annotation value of "maybe" is not a valid boolean`,
+		},
+		{
+			annotationPort,
+			"http",
+			`consul.hashicorp.com/connect-service-port annotation value of "http" is invalid: no container port named "http"`,
+		},
+		{
+			annotationPort,
+			"70000",
+			`consul.hashicorp.com/connect-service-port annotation value of "70000" is invalid: 70000 is not a valid port`,
+		},
+		{
+			annotationProtocol,
+			"udp",
+			`consul.hashicorp.com/connect-service-protocol annotation value of "udp" is not a valid protocol`,
+		},
+		{
+			annotationUpstreams,
+			"db:port",
+			`consul.hashicorp.com/connect-service-upstreams: upstream "db:port" has an invalid local port "port"`,
+		},
+		{
+			annotationMeta + "consul-version",
+			"1",
+			`consul.hashicorp.com/service-meta-consul-version: key prefix "consul-" is reserved for Consul`,
+		},
+		{
+			annotationConsulHTTPPort,
+			"consul",
+			`consul.hashicorp.com/consul-http-port annotation value of "consul" is not a valid port`,
+		},
+		{
+			annotationConsulTLS,
+			"on",
+			`consul.hashicorp.com/consul-tls annotation value of "on" is not a valid boolean`,
+		},
+		{
+			annotationSidecarUID,
+			"root",
+			`consul.hashicorp.com/sidecar-run-as-user annotation value of "root" is not a valid non-root user ID`,
+		},
+		{
+			annotationSkipDeregister,
+			"always",
+			`consul.hashicorp.com/skip-deregister annotation value of "always" is not a valid boolean`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Annotation, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{Log: hclog.Default().Named("handler")}
+			req := v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							tt.Annotation: tt.Value,
+						},
+					},
+
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{
+								Name: "web",
+							},
+						},
+					},
+				}),
+			}
+			resp := h.Mutate(&req)
+			require.False(resp.Allowed)
+			require.Contains(resp.Result.Message, tt.Err)
+		})
+	}
+}
+
+// Test that injected pods get the status and version annotations, and
+// that pods that aren't injected don't.
+func TestHandlerHandle_statusAnnotations(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Namespace   string
+		Annotations map[string]string
+		Injected    bool
+	}{
+		{
+			"injected",
+			"default",
+			nil,
+			true,
+		},
+
+		{
+			"already injected",
+			"default",
+			map[string]string{annotationStatus: "injected"},
+			false,
+		},
+
+		{
+			"opted out",
+			"default",
+			map[string]string{annotationInject: "false"},
+			false,
+		},
+
+		{
+			"denied namespace",
+			"kube-system",
+			nil,
+			false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{
+				Version: "1.2.3",
+				Log:     hclog.Default().Named("handler"),
+			}
+			req := v1beta1.AdmissionRequest{
+				Namespace: tt.Namespace,
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: tt.Annotations,
+					},
+
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{
+								Name: "web",
+							},
+						},
+					},
+				}),
+			}
+			resp := h.Mutate(&req)
+			require.True(resp.Allowed)
+			if !tt.Injected {
+				require.Empty(resp.Patch)
+				return
+			}
+
+			var patches []jsonpatch.JsonPatchOperation
+			require.NoError(json.Unmarshal(resp.Patch, &patches))
+			require.Contains(patches, jsonpatch.JsonPatchOperation{
+				Operation: "add",
+				Path:      "/metadata/annotations/" + escapeJSONPointer(annotationStatus),
+				Value:     "injected; service name from container web; no service port",
+			})
+			require.Contains(patches, jsonpatch.JsonPatchOperation{
+				Operation: "add",
+				Path:      "/metadata/annotations/" + escapeJSONPointer(annotationInjectorVersion),
+				Value:     "1.2.3",
+			})
+		})
+	}
+}
+
+// Test that the service name defaults to the value of the service name
+// label, and that the status annotation records where it comes from and
+// whether the service has no port.
+func TestHandlerHandle_defaultServiceName(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Label       string
+		Annotations map[string]string
+		Labels      map[string]string
+		Service     string // expected service annotation, empty if not patched
+		Status      string
+	}{
+		{
+			"annotation wins",
+			"app.kubernetes.io/name",
+			map[string]string{annotationService: "api"},
+			map[string]string{"app.kubernetes.io/name": "frontend"},
+			"",
+			"injected; no service port",
+		},
+
+		{
+			"port annotation",
+			"app.kubernetes.io/name",
+			map[string]string{annotationService: "api", annotationPort: "8080"},
+			nil,
+			"",
+			"injected",
+		},
+
+		{
+			"label fallback",
+			"app.kubernetes.io/name",
+			nil,
+			map[string]string{"app.kubernetes.io/name": "frontend"},
+			"frontend",
+			"injected; service name from label app.kubernetes.io/name; no service port",
+		},
+
+		{
+			"neither present",
+			"app.kubernetes.io/name",
+			nil,
+			map[string]string{"app": "frontend"},
+			"web",
+			"injected; service name from container web; no service port",
+		},
+
+		{
+			"no label configured",
+			"",
+			nil,
+			map[string]string{"app.kubernetes.io/name": "frontend"},
+			"web",
+			"injected; service name from container web; no service port",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{
+				DefaultServiceNameLabel: tt.Label,
+				Log:                     hclog.Default().Named("handler"),
+			}
+			// An unrelated annotation so that annotations are patched one
+			// key at a time.
+			annotations := map[string]string{"foo": "bar"}
+			for k, v := range tt.Annotations {
+				annotations[k] = v
+			}
+			req := v1beta1.AdmissionRequest{
+				Namespace: "default",
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: annotations,
+						Labels:      tt.Labels,
+					},
+
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{
+								Name: "web",
+							},
+						},
+					},
+				}),
+			}
+			resp := h.Mutate(&req)
+			require.True(resp.Allowed)
+
+			var patches []jsonpatch.JsonPatchOperation
+			require.NoError(json.Unmarshal(resp.Patch, &patches))
+			servicePatch := jsonpatch.JsonPatchOperation{
+				Operation: "add",
+				Path:      "/metadata/annotations/" + escapeJSONPointer(annotationService),
+				Value:     tt.Service,
+			}
+			if tt.Service != "" {
+				require.Contains(patches, servicePatch)
+			} else {
+				for _, patch := range patches {
+					require.NotEqual(servicePatch.Path, patch.Path)
+				}
+			}
+			require.Contains(patches, jsonpatch.JsonPatchOperation{
+				Operation: "add",
+				Path:      "/metadata/annotations/" + escapeJSONPointer(annotationStatus),
+				Value:     tt.Status,
+			})
+		})
+	}
+}
+
+// Test that the bound service account token is projected into a volume
+// that the ACL init container mounts, and only if ACLs are enabled.
+func TestHandlerHandle_serviceAccountTokenVolume(t *testing.T) {
+	hour, twentyMinutes := int64(3600), int64(1200)
+	cases := []struct {
+		Name     string
+		Handler  Handler
+		Expected []corev1.Volume
+	}{
+		{
+			"no audience",
+			Handler{AuthMethod: "auth-method"},
+			nil,
+		},
+
+		{
+			"no auth method",
+			Handler{ServiceAccountTokenAudience: "consul"},
+			nil,
+		},
+
+		{
+			"default expiration",
+			Handler{AuthMethod: "auth-method", ServiceAccountTokenAudience: "consul"},
+			[]corev1.Volume{
+				{
+					Name: tokenVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						Projected: &corev1.ProjectedVolumeSource{
+							Sources: []corev1.VolumeProjection{
+								{
+									ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+										Audience:          "consul",
+										ExpirationSeconds: &hour,
+										Path:              "token",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			"expiration",
+			Handler{
+				AuthMethod:                    "auth-method",
+				ServiceAccountTokenAudience:   "consul",
+				ServiceAccountTokenExpiration: 20 * time.Minute,
+			},
+			[]corev1.Volume{
+				{
+					Name: tokenVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						Projected: &corev1.ProjectedVolumeSource{
+							Sources: []corev1.VolumeProjection{
+								{
+									ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+										Audience:          "consul",
+										ExpirationSeconds: &twentyMinutes,
+										Path:              "token",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := tt.Handler
+			h.Log = hclog.Default().Named("handler")
+			req := v1beta1.AdmissionRequest{
+				Namespace: "default",
+				Object: encodeRaw(t, &corev1.Pod{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{
+								Name: "web",
+								VolumeMounts: []corev1.VolumeMount{
+									{
+										Name:      "default-token-podid",
+										ReadOnly:  true,
+										MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+									},
+								},
+							},
+						},
+					},
+				}),
+			}
+			resp := h.Mutate(&req)
+			require.True(resp.Allowed)
+
+			var patches []struct {
+				Path  string
+				Value json.RawMessage
+			}
+			require.NoError(json.Unmarshal(resp.Patch, &patches))
+			var volumes, tokenVolumes []corev1.Volume
+			for _, patch := range patches {
+				switch patch.Path {
+				case "/spec/volumes":
+					require.NoError(json.Unmarshal(patch.Value, &volumes))
+				case "/spec/volumes/-":
+					var volume corev1.Volume
+					require.NoError(json.Unmarshal(patch.Value, &volume))
+					volumes = append(volumes, volume)
+				}
+			}
+			for _, volume := range volumes {
+				if volume.Name != volumeName {
+					tokenVolumes = append(tokenVolumes, volume)
+				}
+			}
+			require.Equal(tt.Expected, tokenVolumes)
+		})
+	}
+}
+
+// Test that pods in the system namespaces and the injector's namespace are
+// skipped unless the handler allows them.
+func TestHandlerHandle_systemNamespaces(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Namespace string
+		Allow     bool
+		Injected  bool
+	}{
+		{"kube-system", "kube-system", false, false},
+		{"kube-public", "kube-public", false, false},
+		{"kube-node-lease", "kube-node-lease", false, false},
+		{"injector namespace", "consul", false, false},
+		{"other namespace", "default", false, true},
+		{"kube-system allowed", "kube-system", true, true},
+		{"kube-public allowed", "kube-public", true, true},
+		{"kube-node-lease allowed", "kube-node-lease", true, true},
+		{"injector namespace allowed", "consul", true, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{
+				Namespace:             "consul",
+				AllowSystemNamespaces: tt.Allow,
+				Log:                   hclog.Default().Named("handler"),
+			}
+			req := v1beta1.AdmissionRequest{
+				Namespace: tt.Namespace,
+				Object: encodeRaw(t, &corev1.Pod{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{
+								Name: "web",
+							},
+						},
+					},
+				}),
+			}
+			resp := h.Mutate(&req)
+			require.True(resp.Allowed)
+			if tt.Injected {
+				require.NotEmpty(resp.Patch)
+			} else {
+				require.Empty(resp.Patch)
+			}
+		})
+	}
+}
+
+// Test that dry run requests get the same patch as other requests.
+func TestHandlerHandle_dryRun(t *testing.T) {
+	require := require.New(t)
+	h := Handler{Log: hclog.Default().Named("handler")}
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+
+	resp := h.Mutate(&v1beta1.AdmissionRequest{
+		Namespace: "default",
+		Object:    encodeRaw(t, pod),
+	})
+	require.True(resp.Allowed)
+	require.NotEmpty(resp.Patch)
+
+	dryRun := true
+	dryRunResp := h.Mutate(&v1beta1.AdmissionRequest{
+		Namespace: "default",
+		Object:    encodeRaw(t, pod),
+		DryRun:    &dryRun,
+	})
+	require.True(dryRunResp.Allowed)
+	require.Equal(resp.Patch, dryRunResp.Patch)
+}
+
+// Test that pods with metrics enabled are annotated to be scraped by
+// Prometheus without overriding the pod's own scrape annotations.
+func TestHandlerHandle_prometheusAnnotations(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Annotations map[string]string
+		Expected    map[string]string
+	}{
+		{
+			"metrics disabled",
+			map[string]string{annotationEnableMetrics: "false"},
+			nil,
+		},
+
+		{
+			"metrics enabled",
+			nil,
+			map[string]string{
+				annotationPrometheusScrape: "true",
+				annotationPrometheusPort:   "20200",
+				annotationPrometheusPath:   "/metrics",
+			},
+		},
+
+		{
+			"custom port and path",
+			map[string]string{
+				annotationMetricsPort:          "9102",
+				annotationPrometheusScrapePath: "/stats/prometheus",
+			},
+			map[string]string{
+				annotationPrometheusScrape: "true",
+				annotationPrometheusPort:   "9102",
+				annotationPrometheusPath:   "/stats/prometheus",
+			},
+		},
+
+		{
+			"pod sets scrape annotations",
+			map[string]string{
+				annotationPrometheusScrape: "false",
+				annotationPrometheusPort:   "9090",
+			},
+			map[string]string{
+				annotationPrometheusPath: "/metrics",
+			},
+		},
 	}
 
 	for _, tt := range cases {
 		t.Run(tt.Name, func(t *testing.T) {
 			require := require.New(t)
-			resp := tt.Handler.Mutate(&tt.Req)
-			if (tt.Err == "") != resp.Allowed {
-				t.Fatalf("allowed: %v, expected err: %v", resp.Allowed, tt.Err)
+			h := Handler{
+				DefaultEnableMetrics: true,
+				Log:                  hclog.Default().Named("handler"),
+			}
+			req := v1beta1.AdmissionRequest{
+				Namespace: "default",
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: tt.Annotations,
+					},
+
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{
+								Name: "web",
+							},
+						},
+					},
+				}),
+			}
+			resp := h.Mutate(&req)
+			require.True(resp.Allowed)
+
+			var patches []jsonpatch.JsonPatchOperation
+			require.NoError(json.Unmarshal(resp.Patch, &patches))
+			actual := make(map[string]string)
+			for _, p := range patches {
+				for _, k := range []string{annotationPrometheusScrape, annotationPrometheusPort, annotationPrometheusPath} {
+					if p.Path == "/metadata/annotations/"+escapeJSONPointer(k) {
+						actual[k] = p.Value.(string)
+					}
+				}
+			}
+			if tt.Expected == nil {
+				require.Empty(actual)
+				return
+			}
+			require.Equal(tt.Expected, actual)
+		})
+	}
+}
+
+// Test that injected containers and volumes that collide with the pod's
+// own are either renamed or rejected, and that already injected pods are
+// left alone.
+func TestHandlerHandle_nameConflicts(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Rename      bool
+		Annotations map[string]string
+		Volumes     []string
+		Init        []string
+		Containers  []string
+		Expected    []string // names of the added volume and containers
+		Err         string
+	}{
+		{
+			"already injected",
+			false,
+			map[string]string{annotationStatus: "injected"},
+			[]string{volumeName},
+			[]string{"consul-connect-inject-init"},
+			[]string{"web", "consul-connect-envoy-sidecar"},
+			nil,
+			"",
+		},
+
+		{
+			"container conflict",
+			false,
+			nil,
+			nil,
+			nil,
+			[]string{"web", "consul-connect-envoy-sidecar"},
+			nil,
+			"the pod already has a container named consul-connect-envoy-sidecar that wasn't added by the injector",
+		},
+
+		{
+			"volume conflict",
+			false,
+			nil,
+			[]string{volumeName},
+			nil,
+			[]string{"web"},
+			nil,
+			"the pod already has a volume named consul-connect-inject-data that wasn't added by the injector",
+		},
+
+		{
+			"container conflict renamed",
+			true,
+			nil,
+			nil,
+			nil,
+			[]string{"web", "consul-connect-envoy-sidecar", "consul-connect-envoy-sidecar-injected-1"},
+			[]string{
+				volumeName,
+				"consul-connect-inject-init",
+				"consul-connect-envoy-sidecar-injected-2",
+			},
+			"",
+		},
+
+		{
+			"volume conflict renamed",
+			true,
+			nil,
+			[]string{volumeName},
+			nil,
+			[]string{"web"},
+			[]string{
+				"consul-connect-inject-data-injected-1",
+				"consul-connect-inject-init",
+				"consul-connect-envoy-sidecar",
+			},
+			"",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{
+				RenameConflictingNames: tt.Rename,
+				Log:                    hclog.Default().Named("handler"),
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tt.Annotations,
+				},
+			}
+			for _, name := range tt.Volumes {
+				pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: name})
+			}
+			for _, name := range tt.Init {
+				pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{Name: name})
 			}
+			for _, name := range tt.Containers {
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name})
+			}
+			req := v1beta1.AdmissionRequest{
+				Namespace: "default",
+				Object:    encodeRaw(t, pod),
+			}
+			resp := h.Mutate(&req)
 			if tt.Err != "" {
+				require.False(resp.Allowed)
 				require.Contains(resp.Result.Message, tt.Err)
 				return
 			}
+			require.True(resp.Allowed)
+			if tt.Expected == nil {
+				require.Empty(resp.Patch)
+				return
+			}
 
-			var actual []jsonpatch.JsonPatchOperation
-			if len(resp.Patch) > 0 {
-				require.NoError(json.Unmarshal(resp.Patch, &actual))
-				for i, _ := range actual {
-					actual[i].Value = nil
+			var patches []struct {
+				Path  string
+				Value json.RawMessage
+			}
+			require.NoError(json.Unmarshal(resp.Patch, &patches))
+			var actual []string
+			var mounts []corev1.VolumeMount
+			for _, patch := range patches {
+				switch patch.Path {
+				case "/spec/initContainers":
+					var containers []corev1.Container
+					require.NoError(json.Unmarshal(patch.Value, &containers))
+					for _, container := range containers {
+						actual = append(actual, container.Name)
+						mounts = append(mounts, container.VolumeMounts...)
+					}
+				case "/spec/containers/-":
+					var container corev1.Container
+					require.NoError(json.Unmarshal(patch.Value, &container))
+					actual = append(actual, container.Name)
+					mounts = append(mounts, container.VolumeMounts...)
+				case "/spec/volumes/-":
+					var volume corev1.Volume
+					require.NoError(json.Unmarshal(patch.Value, &volume))
+					actual = append(actual, volume.Name)
+				case "/spec/volumes":
+					var volumes []corev1.Volume
+					require.NoError(json.Unmarshal(patch.Value, &volumes))
+					for _, volume := range volumes {
+						actual = append(actual, volume.Name)
+					}
+				}
+			}
+			require.Equal(tt.Expected, actual)
+
+			// The injected containers mount the injected volume
+			volume := tt.Expected[0]
+			for _, mount := range mounts {
+				if mount.MountPath == "/consul/connect-inject" {
+					require.Equal(volume, mount.Name)
 				}
 			}
-			require.Equal(tt.Patches, actual)
 		})
 	}
 }
 
 // Test that an incorrect content type results in an error.
+// Test that pods without proxies don't get any of the proxy's containers,
+// probes or metrics, even if the handler enables them by default.
+func TestHandlerHandle_serviceOnly(t *testing.T) {
+	require := require.New(t)
+	h := Handler{
+		EnableTransparentProxy: true,
+		OverwriteProbes:        true,
+		DefaultEnableMetrics:   true,
+		Log:                    hclog.Default().Named("handler"),
+	}
+	pod := reinvocationPod(map[string]string{annotationInjectProxy: "false"})
+
+	injected := mutateAndApply(t, &h, pod)
+	var initContainers, containers []string
+	for _, c := range injected.Spec.InitContainers {
+		initContainers = append(initContainers, c.Name)
+	}
+	for _, c := range injected.Spec.Containers {
+		containers = append(containers, c.Name)
+	}
+	require.Equal([]string{"consul-connect-inject-init"}, initContainers)
+	require.Equal([]string{"web", "consul-connect-inject-registration"}, containers)
+	require.Equal(intstr.FromString("http"), injected.Spec.Containers[0].LivenessProbe.HTTPGet.Port)
+	require.NotContains(injected.Annotations, annotationPrometheusScrape)
+}
+
+// Test that pods without any ports, such as pure clients, are injected
+// with a service on port 0, with or without a sidecar proxy.
+func TestHandlerHandle_noServicePort(t *testing.T) {
+	for _, annotations := range []map[string]string{
+		{annotationUpstreams: "db:1234"},
+		{annotationInjectProxy: "false"},
+	} {
+		require := require.New(t)
+		h := Handler{
+			OverwriteProbes: true,
+			Log:             hclog.Default().Named("handler"),
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: annotations,
+			},
+
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name: "client",
+					},
+				},
+			},
+		}
+
+		injected := mutateAndApply(t, &h, pod)
+		require.Equal("injected; service name from container client; no service port",
+			injected.Annotations[annotationStatus])
+		require.NotContains(injected.Annotations, annotationPort)
+		require.Len(injected.Spec.InitContainers, 1)
+		actual := strings.Join(injected.Spec.InitContainers[0].Command, " ")
+		require.Contains(actual, `
+  name = "client"
+  address = "${POD_IP}"
+  port = 0`)
+		require.NotContains(actual, "local_service_port")
+	}
+}
+
 func TestHandlerHandle_badContentType(t *testing.T) {
 	req, err := http.NewRequest("POST", "/", nil)
 	require.NoError(t, err)
@@ -454,6 +1526,35 @@ func TestHandlerDefaultAnnotations(t *testing.T) {
 			"",
 		},
 
+		{
+			"basic pod, multiple services",
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "web,web-admin",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						corev1.Container{
+							Name: "web",
+							Ports: []corev1.ContainerPort{
+								corev1.ContainerPort{
+									Name:          "http",
+									ContainerPort: 8080,
+								},
+							},
+						},
+					},
+				},
+			},
+			map[string]string{
+				annotationService: "web,web-admin",
+			},
+			"",
+		},
+
 		{
 			"basic pod, with unnamed ports",
 			&corev1.Pod{
@@ -548,7 +1649,7 @@ func TestHandlerPortValue(t *testing.T) {
 			&corev1.Pod{},
 			"",
 			0,
-			"strconv.ParseInt: parsing \"\": invalid syntax",
+			`no container port named "", the pod has no named ports`,
 		},
 
 		{
@@ -601,6 +1702,64 @@ func TestHandlerPortValue(t *testing.T) {
 			int32(8080),
 			"",
 		},
+
+		{
+			"basic pod, unknown port name",
+			&corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						corev1.Container{
+							Name: "web",
+							Ports: []corev1.ContainerPort{
+								corev1.ContainerPort{
+									Name:          "http",
+									ContainerPort: 8080,
+								},
+								corev1.ContainerPort{
+									Name:          "grpc",
+									ContainerPort: 9090,
+								},
+							},
+						},
+					},
+				},
+			},
+			"admin",
+			0,
+			`no container port named "admin", available port names are http, grpc`,
+		},
+
+		{
+			"port name in multiple containers",
+			&corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						corev1.Container{
+							Name: "web",
+							Ports: []corev1.ContainerPort{
+								corev1.ContainerPort{
+									Name:          "http",
+									ContainerPort: 8080,
+								},
+							},
+						},
+
+						corev1.Container{
+							Name: "web-side",
+							Ports: []corev1.ContainerPort{
+								corev1.ContainerPort{
+									Name:          "http",
+									ContainerPort: 9090,
+								},
+							},
+						},
+					},
+				},
+			},
+			"http",
+			0,
+			`port name "http" is ambiguous, it is used by containers web, web-side`,
+		},
 	}
 
 	for _, tt := range cases {
@@ -621,6 +1780,117 @@ func TestHandlerPortValue(t *testing.T) {
 	}
 }
 
+func TestHandlerConsulNamespace(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Handler     Handler
+		Annotations map[string]string
+		Expected    string
+		Err         string
+	}{
+		{
+			"no namespaces",
+			Handler{},
+			nil,
+			"",
+			"",
+		},
+
+		{
+			"destination namespace",
+			Handler{ConsulDestinationNamespace: "dest"},
+			nil,
+			"dest",
+			"",
+		},
+
+		{
+			"mirroring",
+			Handler{ConsulDestinationNamespace: "dest", EnableK8SNSMirroring: true},
+			nil,
+			"k8snamespace",
+			"",
+		},
+
+		{
+			"mirroring with prefix",
+			Handler{EnableK8SNSMirroring: true, K8SNSMirroringPrefix: "k8s-"},
+			nil,
+			"k8s-k8snamespace",
+			"",
+		},
+
+		{
+			"annotation not allowed",
+			Handler{ConsulDestinationNamespace: "dest"},
+			map[string]string{annotationConsulNamespace: "other"},
+			"",
+			"consul.hashicorp.com/consul-namespace annotation is not allowed, the Consul namespace is chosen by the injector",
+		},
+
+		{
+			"annotation allowed",
+			Handler{EnableK8SNSMirroring: true, AllowConsulNamespaceAnnotation: true},
+			map[string]string{annotationConsulNamespace: "other"},
+			"other",
+			"",
+		},
+
+		{
+			"empty annotation",
+			Handler{AllowConsulNamespaceAnnotation: true},
+			map[string]string{annotationConsulNamespace: ""},
+			"",
+			"consul.hashicorp.com/consul-namespace annotation must not be empty",
+		},
+
+		{
+			"invalid annotation",
+			Handler{AllowConsulNamespaceAnnotation: true},
+			map[string]string{annotationConsulNamespace: `ns" $(id)`},
+			"",
+			`consul.hashicorp.com/consul-namespace annotation value of "ns\" $(id)" is not a valid Consul namespace name`,
+		},
+
+		{
+			"annotation ending with a dash",
+			Handler{AllowConsulNamespaceAnnotation: true},
+			map[string]string{annotationConsulNamespace: "other-"},
+			"",
+			`consul.hashicorp.com/consul-namespace annotation value of "other-" is not a valid Consul namespace name`,
+		},
+
+		{
+			"mirrored name too long",
+			Handler{EnableK8SNSMirroring: true, K8SNSMirroringPrefix: strings.Repeat("a", 60)},
+			nil,
+			"",
+			`Consul namespace "` + strings.Repeat("a", 60) + `k8snamespace" mirrored from Kubernetes ` +
+				`namespace "k8snamespace" is not a valid Consul namespace name`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "k8snamespace",
+					Annotations: tt.Annotations,
+				},
+			}
+
+			actual, err := tt.Handler.consulNamespace(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.Expected, actual)
+		})
+	}
+}
+
 // encodeRaw is a helper to encode some data into a RawExtension.
 func encodeRaw(t *testing.T, input interface{}) runtime.RawExtension {
 	data, err := json.Marshal(input)
@@ -0,0 +1,257 @@
+package connectinject
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mattbaird/jsonpatch"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// injectedObjects are the volumes, init containers and sidecar containers
+// that are added to a pod.
+type injectedObjects struct {
+	Volumes        []corev1.Volume
+	InitContainers []corev1.Container
+	Containers     []corev1.Container
+}
+
+// injectedObjects returns the volumes, init containers and sidecar
+// containers to add to the pod. They are named so that they don't collide
+// with the volumes and containers the pod already has.
+func (h *Handler) injectedObjects(pod *corev1.Pod) (*injectedObjects, error) {
+	usedContainers := make(map[string]bool)
+	for _, c := range pod.Spec.InitContainers {
+		usedContainers[c.Name] = true
+	}
+	for _, c := range pod.Spec.Containers {
+		usedContainers[c.Name] = true
+	}
+	usedVolumes := make(map[string]bool)
+	for _, v := range pod.Spec.Volumes {
+		usedVolumes[v.Name] = true
+	}
+
+	// Add our volume that will be shared by the init container and
+	// the sidecar for passing data in the pod.
+	var objects injectedObjects
+	objects.Volumes = []corev1.Volume{h.containerVolume()}
+	mountPaths := []string{"/consul/connect-inject"}
+	if h.AuthMethod != "" && h.ServiceAccountTokenAudience != "" {
+		objects.Volumes = append(objects.Volumes, h.containerTokenVolume())
+		mountPaths = append(mountPaths, tokenMountPath)
+	}
+	injectedVolumes := make(map[string]string)
+	for i := range objects.Volumes {
+		name, err := h.injectedName(objects.Volumes[i].Name, "volume", usedVolumes)
+		if err != nil {
+			return nil, fmt.Errorf("Error configuring injection volume: %s", err)
+		}
+		objects.Volumes[i].Name = name
+		usedVolumes[name] = true
+		injectedVolumes[mountPaths[i]] = name
+	}
+
+	// If ACLs are enabled, add the init container that logs in with the
+	// auth method. It must run before the other init container since
+	// that uses the ACL token.
+	if h.AuthMethod != "" {
+		aclContainer, err := h.containerACLInit(pod)
+		if err != nil {
+			return nil, fmt.Errorf("Error configuring ACL init container: %s", err)
+		}
+		objects.InitContainers = append(objects.InitContainers, aclContainer)
+	}
+
+	// Add the init container that registers the service and sets up
+	// the Envoy configuration.
+	container, err := h.containerInit(pod)
+	if err != nil {
+		return nil, fmt.Errorf("Error configuring injection init container: %s", err)
+	}
+	objects.InitContainers = append(objects.InitContainers, container)
+
+	// Add the init container that redirects the pod's traffic through the
+	// Envoy sidecar last, since it would redirect the traffic of the other
+	// init containers too.
+	tproxy, err := h.transparentProxy(pod)
+	if err != nil {
+		return nil, err
+	}
+	if tproxy {
+		tproxyContainer, err := h.containerTProxyInit(pod)
+		if err != nil {
+			return nil, fmt.Errorf("Error configuring transparent proxy init container: %s", err)
+		}
+		objects.InitContainers = append(objects.InitContainers, tproxyContainer)
+	}
+	if err := h.nameInjectedContainers(objects.InitContainers, usedContainers, injectedVolumes); err != nil {
+		return nil, fmt.Errorf("Error configuring injection init container: %s", err)
+	}
+
+	// Add the Envoy sidecars, or the registration sidecar of pods without
+	// proxies
+	objects.Containers, err = h.containerSidecars(pod)
+	if err != nil {
+		return nil, fmt.Errorf("Error configuring injection sidecar container: %s", err)
+	}
+	if err := h.nameInjectedContainers(objects.Containers, usedContainers, injectedVolumes); err != nil {
+		return nil, fmt.Errorf("Error configuring injection sidecar container: %s", err)
+	}
+
+	return &objects, nil
+}
+
+// injectedNames are the names of the volumes and containers the injector
+// adds, before they are renamed to avoid conflicts. The names of the
+// sidecars are sidecarNamePrefix, followed by -<N> for all but the first
+// service of the pod.
+var injectedNames = []string{
+	volumeName,
+	tokenVolumeName,
+	"consul-connect-inject-acl-init",
+	"consul-connect-inject-init",
+	"consul-connect-inject-tproxy-init",
+	"consul-connect-inject-registration",
+}
+
+const sidecarNamePrefix = "consul-connect-envoy-sidecar"
+
+// isInjectedName returns true if the volume or container name is one that
+// the injector adds to a pod with the given number of services, possibly
+// renamed to avoid a conflict.
+func isInjectedName(name string, services int) bool {
+	names := append([]string{sidecarNamePrefix}, injectedNames...)
+	for i := 1; i < services; i++ {
+		names = append(names, fmt.Sprintf("%s-%d", sidecarNamePrefix, i))
+	}
+	for _, injected := range names {
+		if name == injected {
+			return true
+		}
+		suffix := strings.TrimPrefix(name, injected+"-injected-")
+		if suffix == name {
+			continue
+		}
+		if i, err := strconv.Atoi(suffix); err == nil && i > 0 && strconv.Itoa(i) == suffix {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reinjectionPatches returns the patches for a pod that already has the
+// status annotation. Only the volumes and containers that were removed
+// from the pod since it was injected, for example by a later webhook, are
+// added back, so invoking the webhook again is idempotent. Pods with none
+// of the injected volumes and containers were copied from an injected pod
+// rather than injected, and are left alone.
+func (h *Handler) reinjectionPatches(pod *corev1.Pod) ([]jsonpatch.JsonPatchOperation, error) {
+	// Compute what the injector adds to the pod without its injected
+	// volumes and containers. The pod has a sidecar for each of its
+	// services.
+	services := 1
+	if raw := pod.Annotations[annotationService]; raw != "" {
+		services = len(strings.Split(raw, ","))
+	}
+	clean := *pod
+	clean.Spec.Volumes = nil
+	for _, v := range pod.Spec.Volumes {
+		if !isInjectedName(v.Name, services) {
+			clean.Spec.Volumes = append(clean.Spec.Volumes, v)
+		}
+	}
+	clean.Spec.InitContainers = uninjectedContainers(pod.Spec.InitContainers, services)
+	clean.Spec.Containers = uninjectedContainers(pod.Spec.Containers, services)
+	if len(clean.Spec.Volumes) == len(pod.Spec.Volumes) &&
+		len(clean.Spec.InitContainers) == len(pod.Spec.InitContainers) &&
+		len(clean.Spec.Containers) == len(pod.Spec.Containers) {
+		return nil, nil
+	}
+
+	// The annotations the objects depend on may have been removed too, and
+	// are only added back along with missing objects.
+	var patches []jsonpatch.JsonPatchOperation
+	if err := h.defaultAnnotations(&clean, &patches); err != nil {
+		return nil, err
+	}
+	objects, err := h.injectedObjects(&clean)
+	if err != nil {
+		return nil, err
+	}
+
+	present := make(map[string]bool)
+	for _, c := range pod.Spec.InitContainers {
+		present[c.Name] = true
+	}
+	for _, c := range pod.Spec.Containers {
+		present[c.Name] = true
+	}
+	for _, v := range pod.Spec.Volumes {
+		present[v.Name] = true
+	}
+	var volumes []corev1.Volume
+	for _, v := range objects.Volumes {
+		if !present[v.Name] {
+			volumes = append(volumes, v)
+		}
+	}
+	var initContainers, containers []corev1.Container
+	for _, c := range objects.InitContainers {
+		if !present[c.Name] {
+			initContainers = append(initContainers, c)
+		}
+	}
+	for _, c := range objects.Containers {
+		if !present[c.Name] {
+			containers = append(containers, c)
+		}
+	}
+
+	if len(volumes) == 0 && len(initContainers) == 0 && len(containers) == 0 {
+		return nil, nil
+	}
+
+	// The init containers can't be rendered again once the probes were
+	// pointed at the proxy, since the original ports of the probes are
+	// gone.
+	if len(initContainers) > 0 {
+		probes, err := h.exposedProbes(&clean)
+		if err != nil {
+			return nil, err
+		}
+		if len(probes) > 0 {
+			return nil, fmt.Errorf("init container %s was removed after injection and can't be "+
+				"added back since the pod's probes were rewritten", initContainers[0].Name)
+		}
+	}
+
+	patches = append(patches, addVolume(
+		pod.Spec.Volumes,
+		volumes,
+		"/spec/volumes")...)
+	patches = append(patches, addContainer(
+		pod.Spec.InitContainers,
+		initContainers,
+		"/spec/initContainers")...)
+	patches = append(patches, addContainer(
+		pod.Spec.Containers,
+		containers,
+		"/spec/containers")...)
+	return patches, nil
+}
+
+// uninjectedContainers returns the containers that the injector didn't add
+// to a pod with the given number of services.
+func uninjectedContainers(containers []corev1.Container, services int) []corev1.Container {
+	var result []corev1.Container
+	for _, c := range containers {
+		if !isInjectedName(c.Name, services) {
+			result = append(result, c)
+		}
+	}
+
+	return result
+}
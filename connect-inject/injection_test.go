@@ -0,0 +1,333 @@
+package connectinject
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Test that running an injected pod through the handler again results in
+// an empty patch, for various kinds of injection.
+func TestHandlerHandle_reinvocation(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Handler     Handler
+		Annotations map[string]string
+		Containers  []string // added to the pod's own containers
+	}{
+		{
+			"basic",
+			Handler{},
+			nil,
+			nil,
+		},
+
+		{
+			"ACLs with bound token",
+			Handler{AuthMethod: "auth-method", ServiceAccountTokenAudience: "consul"},
+			nil,
+			nil,
+		},
+
+		{
+			"transparent proxy and probes",
+			Handler{EnableTransparentProxy: true, OverwriteProbes: true},
+			nil,
+			nil,
+		},
+
+		{
+			"multiple services with metrics",
+			Handler{DefaultEnableMetrics: true},
+			map[string]string{
+				annotationService: "web,web-admin",
+				annotationPort:    "8080,9090",
+			},
+			nil,
+		},
+
+		{
+			"renamed conflicts",
+			Handler{RenameConflictingNames: true},
+			nil,
+			[]string{"consul-connect-envoy-sidecar"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := tt.Handler
+			h.Log = hclog.Default().Named("handler")
+			pod := reinvocationPod(tt.Annotations)
+			for _, name := range tt.Containers {
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name})
+			}
+
+			injected := mutateAndApply(t, &h, pod)
+			require.NotEmpty(injected.Annotations[annotationStatus])
+
+			resp := h.Mutate(&v1beta1.AdmissionRequest{
+				Namespace: "default",
+				Object:    encodeRaw(t, injected),
+			})
+			require.True(resp.Allowed, "%v", resp.Result)
+			require.Empty(resp.Patch)
+		})
+	}
+}
+
+// Test that objects removed from an injected pod are added back, and that
+// adding them back reaches the same pod as the first injection.
+func TestHandlerHandle_reinvocationRemoved(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Handler Handler
+		Remove  func(*corev1.Pod)
+		Err     string
+	}{
+		{
+			"sidecar",
+			Handler{},
+			func(pod *corev1.Pod) {
+				pod.Spec.Containers = pod.Spec.Containers[:1]
+			},
+			"",
+		},
+
+		{
+			"volume",
+			Handler{},
+			func(pod *corev1.Pod) {
+				pod.Spec.Volumes = nil
+			},
+			"",
+		},
+
+		{
+			"init containers and service annotation",
+			Handler{AuthMethod: "auth-method", EnableTransparentProxy: true},
+			func(pod *corev1.Pod) {
+				pod.Spec.InitContainers = nil
+				delete(pod.Annotations, annotationService)
+			},
+			"",
+		},
+
+		{
+			"bound token volume",
+			Handler{AuthMethod: "auth-method", ServiceAccountTokenAudience: "consul"},
+			func(pod *corev1.Pod) {
+				pod.Spec.Volumes = pod.Spec.Volumes[:1]
+			},
+			"",
+		},
+
+		{
+			"init container with rewritten probes",
+			Handler{OverwriteProbes: true},
+			func(pod *corev1.Pod) {
+				pod.Spec.InitContainers = nil
+			},
+			"init container consul-connect-inject-init was removed after injection and can't be added back since the pod's probes were rewritten",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := tt.Handler
+			h.Log = hclog.Default().Named("handler")
+			injected := mutateAndApply(t, &h, reinvocationPod(nil))
+
+			removed := applyPatch(t, injected, nil)
+			tt.Remove(removed)
+			resp := h.Mutate(&v1beta1.AdmissionRequest{
+				Namespace: "default",
+				Object:    encodeRaw(t, removed),
+			})
+			if tt.Err != "" {
+				require.False(resp.Allowed)
+				require.Contains(resp.Result.Message, tt.Err)
+				return
+			}
+			require.True(resp.Allowed, "%v", resp.Result)
+			require.NotEmpty(resp.Patch)
+
+			restored := applyPatch(t, removed, resp.Patch)
+			require.Equal(injected, restored)
+		})
+	}
+}
+
+// Test that pods that have the status annotation but none of the injected
+// objects, such as pods copied from an injected pod, are left alone.
+func TestHandlerHandle_reinvocationCopied(t *testing.T) {
+	require := require.New(t)
+	h := Handler{Log: hclog.Default().Named("handler")}
+	pod := reinvocationPod(map[string]string{annotationStatus: "injected"})
+	resp := h.Mutate(&v1beta1.AdmissionRequest{
+		Namespace: "default",
+		Object:    encodeRaw(t, pod),
+	})
+	require.True(resp.Allowed)
+	require.Empty(resp.Patch)
+}
+
+// Test that the pod's own containers are not mistaken for injected ones
+// because their names start like the injected names.
+func TestHandlerHandle_reinvocationLookalikeNames(t *testing.T) {
+	require := require.New(t)
+	h := Handler{Log: hclog.Default().Named("handler")}
+	pod := reinvocationPod(map[string]string{annotationStatus: "injected"})
+	pod.Spec.Containers = append(pod.Spec.Containers,
+		corev1.Container{Name: "consul-connect-envoy-sidecar-debug"},
+		corev1.Container{Name: "consul-connect-inject-init-injected-x"})
+	resp := h.Mutate(&v1beta1.AdmissionRequest{
+		Namespace: "default",
+		Object:    encodeRaw(t, pod),
+	})
+	require.True(resp.Allowed)
+	require.Empty(resp.Patch)
+}
+
+func TestIsInjectedName(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Services int
+		Expected bool
+	}{
+		{"consul-connect-inject-init", 1, true},
+		{"consul-connect-inject-init-injected-2", 1, true},
+		{"consul-connect-inject-init-injected-0", 1, false},
+		{"consul-connect-inject-init-injected-02", 1, false},
+		{"consul-connect-inject-init-injected-", 1, false},
+		{"consul-connect-inject-data", 1, true},
+		{"consul-connect-envoy-sidecar", 1, true},
+		{"consul-connect-envoy-sidecar-injected-1", 1, true},
+		{"consul-connect-envoy-sidecar-1", 1, false},
+		{"consul-connect-envoy-sidecar-1", 2, true},
+		{"consul-connect-envoy-sidecar-1-injected-1", 2, true},
+		{"consul-connect-envoy-sidecar-2", 2, false},
+		{"consul-connect-envoy-sidecar-debug", 2, false},
+		{"web", 1, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require.Equal(t, tt.Expected, isInjectedName(tt.Name, tt.Services))
+		})
+	}
+}
+
+func reinvocationPod(annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: annotations,
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+					Ports: []corev1.ContainerPort{
+						{Name: "http", ContainerPort: 8080},
+					},
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      "default-token-podid",
+							ReadOnly:  true,
+							MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+						},
+					},
+					LivenessProbe: httpProbe("/health", intstr.FromString("http")),
+				},
+			},
+		},
+	}
+}
+
+// mutateAndApply runs the pod through the handler and returns the pod with
+// the resulting patch applied.
+func mutateAndApply(t *testing.T, h *Handler, pod *corev1.Pod) *corev1.Pod {
+	t.Helper()
+	resp := h.Mutate(&v1beta1.AdmissionRequest{
+		Namespace: "default",
+		Object:    encodeRaw(t, pod),
+	})
+	require.True(t, resp.Allowed, "%v", resp.Result)
+	return applyPatch(t, pod, resp.Patch)
+}
+
+// applyPatch applies a JSON patch of add and replace operations, as
+// created by the handler, to the pod.
+func applyPatch(t *testing.T, pod *corev1.Pod, patch []byte) *corev1.Pod {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	require.NoError(t, err)
+	var doc interface{}
+	require.NoError(t, json.Unmarshal(raw, &doc))
+
+	var ops []struct {
+		Op    string
+		Path  string
+		Value interface{}
+	}
+	if len(patch) > 0 {
+		require.NoError(t, json.Unmarshal(patch, &ops))
+	}
+	for _, op := range ops {
+		require.Contains(t, []string{"add", "replace"}, op.Op)
+		var keys []string
+		for _, key := range strings.Split(op.Path, "/")[1:] {
+			key = strings.Replace(key, "~1", "/", -1)
+			keys = append(keys, strings.Replace(key, "~0", "~", -1))
+		}
+		doc = setJSONPointer(t, doc, keys, op.Value)
+	}
+
+	raw, err = json.Marshal(doc)
+	require.NoError(t, err)
+	var result corev1.Pod
+	require.NoError(t, json.Unmarshal(raw, &result))
+	return &result
+}
+
+// setJSONPointer sets the value at the path of keys in the decoded JSON
+// document and returns the updated document. The key "-" appends to an
+// array.
+func setJSONPointer(t *testing.T, doc interface{}, keys []string, value interface{}) interface{} {
+	if len(keys) == 0 {
+		return value
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[keys[0]] = setJSONPointer(t, node[keys[0]], keys[1:], value)
+		return node
+	case []interface{}:
+		if keys[0] == "-" {
+			require.Len(t, keys, 1)
+			return append(node, value)
+		}
+		i, err := strconv.Atoi(keys[0])
+		require.NoError(t, err)
+		node[i] = setJSONPointer(t, node[i], keys[1:], value)
+		return node
+	case nil:
+		// Only the last key may create a value
+		require.Len(t, keys, 1)
+		return map[string]interface{}{keys[0]: value}
+	default:
+		t.Fatalf("can't set %v in %v", keys, doc)
+		return nil
+	}
+}
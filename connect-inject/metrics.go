@@ -0,0 +1,58 @@
+package connectinject
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The outcomes of admission requests that the requests counter is
+// labeled with.
+const (
+	outcomeInjected          = "injected"
+	outcomeSkippedNamespace  = "skipped_namespace"
+	outcomeSkippedAnnotation = "skipped_annotation"
+	outcomeError             = "error"
+)
+
+// Metrics are the Prometheus metrics of the admission requests the handler
+// serves.
+type Metrics struct {
+	requests *prometheus.CounterVec
+	duration prometheus.Histogram
+}
+
+// NewMetrics creates the metrics of the handler and registers them with
+// the registerer.
+func NewMetrics(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "consul_connect_inject",
+			Name:      "requests_total",
+			Help:      "Admission requests for pods by Kubernetes namespace and outcome.",
+		}, []string{"namespace", "outcome"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "consul_connect_inject",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to handle admission requests for pods.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+	for _, c := range []prometheus.Collector{m.requests, m.duration} {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// observe records an admission request. It does nothing if the metrics
+// are nil so that handlers without metrics don't need to check.
+func (m *Metrics) observe(namespace, outcome string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(namespace, outcome).Inc()
+	m.duration.Observe(duration.Seconds())
+}
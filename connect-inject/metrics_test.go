@@ -0,0 +1,116 @@
+package connectinject
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Test that each admission request is counted by namespace and outcome.
+func TestHandlerHandle_metrics(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Namespace   string
+		Annotations map[string]string
+		Outcome     string
+	}{
+		{
+			"injected",
+			"default",
+			nil,
+			outcomeInjected,
+		},
+
+		{
+			"system namespace",
+			"kube-system",
+			nil,
+			outcomeSkippedNamespace,
+		},
+
+		{
+			"inject annotation",
+			"default",
+			map[string]string{annotationInject: "false"},
+			outcomeSkippedAnnotation,
+		},
+
+		{
+			"already injected",
+			"default",
+			map[string]string{annotationStatus: "injected"},
+			outcomeSkippedAnnotation,
+		},
+
+		{
+			"error",
+			"apps",
+			map[string]string{annotationInject: "maybe"},
+			outcomeError,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			metrics, err := NewMetrics(prometheus.NewRegistry())
+			require.NoError(err)
+			h := Handler{
+				Metrics: metrics,
+				Log:     hclog.Default().Named("handler"),
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tt.Annotations,
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+
+			h.Mutate(&v1beta1.AdmissionRequest{
+				Namespace: tt.Namespace,
+				Object:    encodeRaw(t, pod),
+			})
+
+			for _, outcome := range []string{
+				outcomeInjected,
+				outcomeSkippedNamespace,
+				outcomeSkippedAnnotation,
+				outcomeError,
+			} {
+				var expected float64
+				if outcome == tt.Outcome {
+					expected = 1
+				}
+				var metric dto.Metric
+				require.NoError(metrics.requests.WithLabelValues(tt.Namespace, outcome).Write(&metric))
+				require.Equal(expected, metric.Counter.GetValue(), outcome)
+			}
+
+			var metric dto.Metric
+			require.NoError(metrics.duration.Write(&metric))
+			require.Equal(uint64(1), metric.Histogram.GetSampleCount())
+		})
+	}
+}
+
+// Test that the metrics can't be registered twice with a registry.
+func TestNewMetrics_duplicate(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	_, err := NewMetrics(registry)
+	require.NoError(t, err)
+	_, err = NewMetrics(registry)
+	require.Error(t, err)
+}
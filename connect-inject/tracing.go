@@ -0,0 +1,185 @@
+package connectinject
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultTracingServiceNameTemplate is the name the proxies report
+	// their spans under if no other template is configured.
+	DefaultTracingServiceNameTemplate = "{{ .Service }}"
+
+	// tracingClusterName is the name of the static Envoy cluster of the
+	// tracing collector.
+	tracingClusterName = "consul-connect-tracing"
+)
+
+// validTracingProviders are the tracing collectors the proxies can send
+// spans to. Both receive spans in the Zipkin format, but Jaeger doesn't
+// support spans that are shared between client and server.
+var validTracingProviders = []string{"zipkin", "jaeger"}
+
+var tracingServiceNameFormat = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// tracingServiceNameData is the data the service name template of the
+// tracing configuration is rendered with.
+type tracingServiceNameData struct {
+	// Service is the name of the Consul service of the proxy.
+	Service string
+
+	// Namespace is the Kubernetes namespace of the pod.
+	Namespace string
+}
+
+// ValidateTracing returns an error if the tracing provider, collector
+// address and service name template can't be used to configure the
+// proxies. It renders the configuration for an example service so that
+// a bad configuration is rejected at startup rather than for every pod.
+func ValidateTracing(provider, address, nameTemplate string) error {
+	h := Handler{
+		TracingProvider:            provider,
+		TracingCollectorAddress:    address,
+		TracingServiceNameTemplate: nameTemplate,
+	}
+	_, _, err := h.tracingConfig("example", "default")
+	return err
+}
+
+// tracingEnabled returns true if the proxies of the pod should send spans
+// to the tracing collector. Tracing is opt-in with an annotation and
+// requires a collector to be configured on the handler.
+func (h *Handler) tracingEnabled(pod *corev1.Pod) (bool, error) {
+	if serviceOnly, err := h.serviceOnly(pod); err != nil || serviceOnly {
+		return false, err
+	}
+	raw, ok := pod.Annotations[annotationEnableTracing]
+	if !ok {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("%s annotation value of %q is not a valid boolean",
+			annotationEnableTracing, raw)
+	}
+	if enabled && h.TracingProvider == "" {
+		return false, fmt.Errorf("%s annotation is set but no tracing collector is configured",
+			annotationEnableTracing)
+	}
+
+	return enabled, nil
+}
+
+// tracingServiceName returns the name the proxy of the service reports
+// its spans under.
+func (h *Handler) tracingServiceName(service, namespace string) (string, error) {
+	nameTemplate := h.TracingServiceNameTemplate
+	if nameTemplate == "" {
+		nameTemplate = DefaultTracingServiceNameTemplate
+	}
+	tpl, err := template.New("root").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return "", fmt.Errorf("tracing service name template %q is invalid: %s", nameTemplate, err)
+	}
+
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, &tracingServiceNameData{
+		Service:   service,
+		Namespace: namespace,
+	})
+	if err != nil {
+		return "", fmt.Errorf("tracing service name template %q is invalid: %s", nameTemplate, err)
+	}
+	name := strings.TrimSpace(buf.String())
+	if !tracingServiceNameFormat.MatchString(name) {
+		return "", fmt.Errorf("tracing service name %q rendered from template %q must only "+
+			"contain letters, digits, dots, dashes and underscores", name, nameTemplate)
+	}
+
+	return name, nil
+}
+
+// tracingConfig returns the values of the envoy_tracing_json and
+// envoy_extra_static_clusters_json keys of the proxy config that make the
+// proxy of the service send its spans to the tracing collector.
+func (h *Handler) tracingConfig(service, namespace string) (string, string, error) {
+	if !validTracingProvider(h.TracingProvider) {
+		return "", "", fmt.Errorf("tracing provider %q is invalid, must be one of %s",
+			h.TracingProvider, strings.Join(validTracingProviders, ", "))
+	}
+	host, rawPort, err := net.SplitHostPort(h.TracingCollectorAddress)
+	if err != nil || host == "" || strings.ContainsAny(host, " \t\n") {
+		return "", "", fmt.Errorf("tracing collector address %q must be of the form host:port",
+			h.TracingCollectorAddress)
+	}
+	port, err := strconv.Atoi(rawPort)
+	if err != nil || port < 1 || port > 65535 {
+		return "", "", fmt.Errorf("tracing collector address %q has an invalid port",
+			h.TracingCollectorAddress)
+	}
+	if _, err := h.tracingServiceName(service, namespace); err != nil {
+		return "", "", err
+	}
+
+	tracing, err := json.Marshal(map[string]interface{}{
+		"http": map[string]interface{}{
+			"name": "envoy.zipkin",
+			"config": map[string]interface{}{
+				"collector_cluster":   tracingClusterName,
+				"collector_endpoint":  "/api/v1/spans",
+				"shared_span_context": h.TracingProvider != "jaeger",
+			},
+		},
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	cluster, err := json.Marshal(map[string]interface{}{
+		"name":            tracingClusterName,
+		"type":            "STRICT_DNS",
+		"connect_timeout": "5s",
+		"lb_policy":       "ROUND_ROBIN",
+		"load_assignment": map[string]interface{}{
+			"cluster_name": tracingClusterName,
+			"endpoints": []interface{}{
+				map[string]interface{}{
+					"lb_endpoints": []interface{}{
+						map[string]interface{}{
+							"endpoint": map[string]interface{}{
+								"address": map[string]interface{}{
+									"socket_address": map[string]interface{}{
+										"address":    host,
+										"port_value": port,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(tracing), string(cluster), nil
+}
+
+func validTracingProvider(provider string) bool {
+	for _, p := range validTracingProviders {
+		if provider == p {
+			return true
+		}
+	}
+	return false
+}
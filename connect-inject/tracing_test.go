@@ -0,0 +1,277 @@
+package connectinject
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Test the tracing config of the proxy against the expected JSON for each
+// provider.
+func TestHandlerTracingConfig(t *testing.T) {
+	cluster := `{
+  "name": "consul-connect-tracing",
+  "type": "STRICT_DNS",
+  "connect_timeout": "5s",
+  "lb_policy": "ROUND_ROBIN",
+  "load_assignment": {
+    "cluster_name": "consul-connect-tracing",
+    "endpoints": [
+      {
+        "lb_endpoints": [
+          {
+            "endpoint": {
+              "address": {
+                "socket_address": {
+                  "address": "collector.tracing",
+                  "port_value": 9411
+                }
+              }
+            }
+          }
+        ]
+      }
+    ]
+  }
+}`
+
+	cases := []struct {
+		Provider string
+		Tracing  string
+	}{
+		{
+			"zipkin",
+			`{
+  "http": {
+    "name": "envoy.zipkin",
+    "config": {
+      "collector_cluster": "consul-connect-tracing",
+      "collector_endpoint": "/api/v1/spans",
+      "shared_span_context": true
+    }
+  }
+}`,
+		},
+
+		{
+			"jaeger",
+			`{
+  "http": {
+    "name": "envoy.zipkin",
+    "config": {
+      "collector_cluster": "consul-connect-tracing",
+      "collector_endpoint": "/api/v1/spans",
+      "shared_span_context": false
+    }
+  }
+}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Provider, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{
+				TracingProvider:         tt.Provider,
+				TracingCollectorAddress: "collector.tracing:9411",
+			}
+			tracing, clusters, err := h.tracingConfig("web", "default")
+			require.NoError(err)
+			require.JSONEq(tt.Tracing, tracing)
+			require.JSONEq(cluster, clusters)
+		})
+	}
+}
+
+func TestValidateTracing(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Provider string
+		Address  string
+		Template string
+		Err      string
+	}{
+		{
+			"valid",
+			"jaeger",
+			"10.0.0.1:9411",
+			"{{ .Service }}.{{ .Namespace }}",
+			"",
+		},
+
+		{
+			"default template",
+			"zipkin",
+			"zipkin:9411",
+			"",
+			"",
+		},
+
+		{
+			"unknown provider",
+			"datadog",
+			"zipkin:9411",
+			"",
+			`tracing provider "datadog" is invalid, must be one of zipkin, jaeger`,
+		},
+
+		{
+			"no port",
+			"zipkin",
+			"zipkin",
+			"",
+			`tracing collector address "zipkin" must be of the form host:port`,
+		},
+
+		{
+			"invalid port",
+			"zipkin",
+			"zipkin:http",
+			"",
+			`tracing collector address "zipkin:http" has an invalid port`,
+		},
+
+		{
+			"unparseable template",
+			"zipkin",
+			"zipkin:9411",
+			"{{ .Service",
+			`tracing service name template "{{ .Service" is invalid`,
+		},
+
+		{
+			"unknown template field",
+			"zipkin",
+			"zipkin:9411",
+			"{{ .Pod }}",
+			`tracing service name template "{{ .Pod }}" is invalid`,
+		},
+
+		{
+			"invalid rendered name",
+			"zipkin",
+			"zipkin:9411",
+			`{{ .Service }}"`,
+			`tracing service name "example\"" rendered from template "{{ .Service }}\"" must only contain letters, digits, dots, dashes and underscores`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			err := ValidateTracing(tt.Provider, tt.Address, tt.Template)
+			if tt.Err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.Err)
+		})
+	}
+}
+
+// Test that pods opt into tracing with the annotation, which adds the
+// tracing config to the proxy and names the proxy's spans.
+func TestHandlerTracing_injection(t *testing.T) {
+	cases := []struct {
+		Name       string
+		Provider   string
+		Annotation string
+		Cluster    []string
+		Err        string
+	}{
+		{
+			"no annotation",
+			"zipkin",
+			"",
+			nil,
+			"",
+		},
+
+		{
+			"enabled",
+			"jaeger",
+			"true",
+			[]string{"--service-cluster", "web.default"},
+			"",
+		},
+
+		{
+			"disabled",
+			"jaeger",
+			"false",
+			nil,
+			"",
+		},
+
+		{
+			"not configured",
+			"",
+			"true",
+			nil,
+			"consul.hashicorp.com/enable-tracing annotation is set but no tracing collector is configured",
+		},
+
+		{
+			"invalid annotation",
+			"zipkin",
+			"yes please",
+			nil,
+			`consul.hashicorp.com/enable-tracing annotation value of "yes please" is not a valid boolean`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := Handler{
+				TracingProvider:            tt.Provider,
+				TracingCollectorAddress:    "collector.tracing:9411",
+				TracingServiceNameTemplate: "{{ .Service }}.{{ .Namespace }}",
+				Log:                        hclog.Default().Named("handler"),
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Annotations: map[string]string{
+						annotationService: "web",
+					},
+				},
+
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			if tt.Annotation != "" {
+				pod.Annotations[annotationEnableTracing] = tt.Annotation
+			}
+
+			initContainer, err := h.containerInit(pod)
+			if tt.Err != "" {
+				require.EqualError(err, tt.Err)
+				return
+			}
+			require.NoError(err)
+			containers, err := h.containerSidecars(pod)
+			require.NoError(err)
+
+			command := strings.Join(initContainer.Command, " ")
+			sidecarCommand := containers[0].Command
+			if tt.Cluster == nil {
+				require.NotContains(command, "envoy_tracing_json")
+				require.NotContains(sidecarCommand, "--service-cluster")
+				return
+			}
+			require.Contains(command, `envoy_tracing_json = "{\\"http\\":{\\"config\\":{\\"collector_cluster\\":\\"consul-connect-tracing\\"`)
+			require.Contains(command, `envoy_extra_static_clusters_json = "{\\"connect_timeout\\":\\"5s\\"`)
+			require.Equal(tt.Cluster, sidecarCommand[len(sidecarCommand)-2:])
+		})
+	}
+}
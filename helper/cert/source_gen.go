@@ -41,10 +41,53 @@ type GenSource struct {
 
 	mu             sync.Mutex
 	caCert         []byte
+	caKey          []byte
 	caCertTemplate *x509.Certificate
 	caSigner       crypto.Signer
 }
 
+// CA returns the PEM-encoded CA certificate and private key, generating
+// them if the source has no CA yet. This is used to share the CA with other
+// sources through SetCA.
+func (s *GenSource) CA() ([]byte, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.caCert) == 0 {
+		if err := s.generateCA(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return s.caCert, s.caKey, nil
+}
+
+// SetCA sets the PEM-encoded CA certificate and private key that the leaf
+// certificates are signed with, replacing the CA of the source. This should
+// be called before the first call to Certificate.
+func (s *GenSource) SetCA(certPEM, keyPEM []byte) error {
+	cert, err := parseCert(certPEM)
+	if err != nil {
+		return fmt.Errorf("error parsing CA certificate: %s", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return fmt.Errorf("error parsing CA private key: no EC PRIVATE KEY PEM block found")
+	}
+	signer, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("error parsing CA private key: %s", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.caCert = certPEM
+	s.caKey = keyPEM
+	s.caCertTemplate = cert
+	s.caSigner = signer
+	return nil
+}
+
 // Certificate implements Source
 func (s *GenSource) Certificate(ctx context.Context, last *Bundle) (Bundle, error) {
 	s.mu.Lock()
@@ -161,11 +204,12 @@ func (s *GenSource) generateCert() (string, string, error) {
 
 func (s *GenSource) generateCA() error {
 	// Create the private key we'll use for this CA cert.
-	signer, _, err := s.privateKey()
+	signer, keyPEM, err := s.privateKey()
 	if err != nil {
 		return err
 	}
 	s.caSigner = signer
+	s.caKey = []byte(keyPEM)
 
 	// The serial number for the cert
 	sn, err := serialNumber()
@@ -65,6 +65,45 @@ func TestGenSource_expiry(t *testing.T) {
 	testBundleVerify(t, &bundle)
 }
 
+// Test that a source can sign its certificates with the CA of another
+func TestGenSource_sharedCA(t *testing.T) {
+	t.Parallel()
+
+	if !hasOpenSSL {
+		t.Skip("openssl not found")
+		return
+	}
+
+	source := testGenSource()
+	caCert, caKey, err := source.CA()
+	require.NoError(t, err)
+
+	other := testGenSource()
+	require.NoError(t, other.SetCA(caCert, caKey))
+	bundle, err := other.Certificate(context.Background(), nil)
+	require.NoError(t, err)
+	require.Equal(t, caCert, bundle.CACert)
+	testBundleVerify(t, &bundle)
+
+	// The original source keeps using the same CA
+	bundle, err = source.Certificate(context.Background(), nil)
+	require.NoError(t, err)
+	require.Equal(t, caCert, bundle.CACert)
+}
+
+// Test that invalid CAs are rejected
+func TestGenSource_setCAInvalid(t *testing.T) {
+	t.Parallel()
+
+	caCert, caKey, err := testGenSource().CA()
+	require.NoError(t, err)
+
+	source := testGenSource()
+	require.Error(t, source.SetCA(caKey, caKey))
+	require.Error(t, source.SetCA(caCert, caCert))
+	require.Error(t, source.SetCA(caCert, []byte("not a key")))
+}
+
 func testGenSource() *GenSource {
 	return &GenSource{
 		Name:  "Test",
@@ -1,23 +1,34 @@
 package subcommand
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
-	"encoding/base64"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/consul-k8s/connect-inject"
 	"github.com/hashicorp/consul-k8s/helper/cert"
+	"github.com/hashicorp/consul-k8s/version"
 	"github.com/hashicorp/consul/command/flags"
 	"github.com/hashicorp/go-hclog"
 	"github.com/mitchellh/cli"
-	"k8s.io/apimachinery/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -26,8 +37,10 @@ type Command struct {
 	UI cli.Ui
 
 	flagListen          string
+	flagMetricsListen   string // Address of the Prometheus metrics listener
 	flagAutoName        string // MutatingWebhookConfiguration for updating
 	flagAutoHosts       string // SANs for the auto-generated TLS cert.
+	flagAutoCASecret    string // Secret holding the CA shared by replicas
 	flagCertFile        string // TLS cert for listening (PEM)
 	flagKeyFile         string // TLS cert private key (PEM)
 	flagDefaultInject   bool   // True to inject by default
@@ -36,21 +49,112 @@ type Command struct {
 	flagACLAuthMethod   string // Auth Method to use for ACLs, if enabled
 	flagCentralConfig   bool   // True to enable central config injection
 	flagDefaultProtocol string // Default protocol for use with central config
-	flagSet             *flag.FlagSet
+	flagConsulHTTPPort  int    // Port of the Consul client agents' HTTP API
+	flagConsulCACert    string // Path to the Consul CA certificate (PEM)
+	flagConsulHTTPSPort int    // Port of the Consul client agents' HTTPS API
+	flagSidecarUID      int64  // User ID the Envoy sidecar runs as
+	flagSidecarGID      int64  // Group ID the Envoy sidecar runs as
 
-	once sync.Once
-	help string
-	cert atomic.Value
+	// True to not set a security context on the Envoy sidecar
+	flagDisableSidecarSecurityContext bool
+
+	// True to make the injected containers compatible with OpenShift
+	flagEnableOpenShift bool
+
+	// Bound service account token for the ACL login
+	flagACLServiceAccountTokenAudience   string
+	flagACLServiceAccountTokenExpiration flags.DurationValue
+
+	// How long the sidecar's preStop hook retries deregistering services
+	flagSidecarPreStopTimeout flags.DurationValue
+
+	// Transparent proxy flags
+	flagEnableTransparentProxy     bool
+	flagTProxyOutboundListenerPort int
+
+	// True to rewrite HTTP probes to go through the Envoy sidecar
+	flagOverwriteProbes bool
+
+	// Prometheus metrics of the Envoy sidecar
+	flagDefaultEnableMetrics        bool
+	flagDefaultMetricsPort          int
+	flagDefaultPrometheusScrapePath string
+
+	// Tracing collector the Envoy sidecar sends spans to
+	flagTracingProvider            string
+	flagTracingCollectorAddress    string
+	flagTracingServiceNameTemplate string
+
+	// Consul DNS for pods with the use-consul-dns annotation
+	flagConsulDNSAddress      string
+	flagClusterDNSNameservers flags.AppendSliceValue
+	flagClusterDomain         string
+	flagMergePodDNSConfig     bool
+
+	// Defaults of the generated health checks
+	flagCheckInterval                flags.DurationValue
+	flagCheckTimeout                 flags.DurationValue
+	flagCheckDeregisterCriticalAfter flags.DurationValue
+
+	// Default port, resources and concurrency of the Envoy sidecar
+	flagDefaultProxyPort          int
+	flagDefaultProxyCPURequest    string
+	flagDefaultProxyCPULimit      string
+	flagDefaultProxyMemoryRequest string
+	flagDefaultProxyMemoryLimit   string
+	flagDefaultProxyConcurrency   int
+
+	// Pod labels to copy into service metadata
+	flagCopyLabelsToMeta flags.AppendSliceValue
+
+	// Tags added to every injected service
+	flagDefaultServiceTags flags.AppendSliceValue
+
+	// Pod label to take the service name from if it isn't annotated
+	flagDefaultServiceNameLabel string
+
+	// True to rename injected containers and volumes on name conflicts
+	flagRenameConflictingNames bool
+
+	// True to inject in the K8s system namespaces and the injector's own
+	flagDangerouslyAllowSystemNamespaces bool
+
+	// K8s namespaces to inject in and not inject in
+	flagAllowK8sNamespaces flags.AppendSliceValue
+	flagDenyK8sNamespaces  flags.AppendSliceValue
+
+	// Consul Enterprise namespace flags
+	flagConsulDestinationNamespace     string // Consul namespace to register services in
+	flagEnableK8SNSMirroring           bool   // True to mirror k8s namespaces in Consul
+	flagK8SNSMirroringPrefix           string // Prefix of the mirrored Consul namespaces
+	flagAllowConsulNamespaceAnnotation bool   // True to let pods choose their Consul namespace
+
+	// Consul Enterprise admin partition to register services in
+	flagConsulPartition string
+
+	flagSet *flag.FlagSet
+
+	once  sync.Once
+	help  string
+	cert  atomic.Value
+	sigCh chan os.Signal
 }
 
 func (c *Command) init() {
 	c.flagSet = flag.NewFlagSet("", flag.ContinueOnError)
 	c.flagSet.BoolVar(&c.flagDefaultInject, "default-inject", true, "Inject by default.")
 	c.flagSet.StringVar(&c.flagListen, "listen", ":8080", "Address to bind listener to.")
+	c.flagSet.StringVar(&c.flagMetricsListen, "metrics-listen", "",
+		"Address to serve Prometheus metrics of the injector on, at /metrics. "+
+			"Metrics aren't served if this isn't set.")
 	c.flagSet.StringVar(&c.flagAutoName, "tls-auto", "",
 		"MutatingWebhookConfiguration name. If specified, will auto generate cert bundle.")
 	c.flagSet.StringVar(&c.flagAutoHosts, "tls-auto-hosts", "",
 		"Comma-separated hosts for auto-generated TLS cert. If specified, will auto generate cert bundle.")
+	c.flagSet.StringVar(&c.flagAutoCASecret, "tls-auto-ca-secret", "",
+		"Name of the Secret in the injector's namespace that stores the CA of the "+
+			"auto-generated TLS certs. The first replica to start creates it and the others "+
+			"sign their certs with the same CA, so that multiple replicas can run with -tls-auto.")
 	c.flagSet.StringVar(&c.flagCertFile, "tls-cert-file", "",
 		"PEM-encoded TLS certificate to serve. If blank, will generate random cert.")
 	c.flagSet.StringVar(&c.flagKeyFile, "tls-key-file", "",
@@ -61,10 +165,159 @@ func (c *Command) init() {
 		"Docker image for Envoy. Defaults to Envoy 1.8.0.")
 	c.flagSet.StringVar(&c.flagACLAuthMethod, "acl-auth-method", "",
 		"The name of the Kubernetes Auth Method to use for connectInjection if ACLs are enabled.")
+	c.flagSet.StringVar(&c.flagACLServiceAccountTokenAudience, "acl-service-account-token-audience", "",
+		"If set, the login with the Auth Method uses a service account token bound to the pod "+
+			"and this audience, projected into a volume of the pod, instead of the pod's "+
+			"auto-mounted service account token.")
+	c.flagSet.Var(&c.flagACLServiceAccountTokenExpiration, "acl-service-account-token-expiration",
+		"How long the projected service account token of -acl-service-account-token-audience "+
+			"is valid for, formatted as a time.Duration. Must be at least 10 minutes (10m). "+
+			"Defaults to 1 hour (1h).")
 	c.flagSet.BoolVar(&c.flagCentralConfig, "enable-central-config", false,
 		"Write a service-defaults config for every Connect service using protocol from -default-protocol or Pod annotation.")
 	c.flagSet.StringVar(&c.flagDefaultProtocol, "default-protocol", "",
 		"The default protocol to use in central config registrations.")
+	c.flagSet.IntVar(&c.flagConsulHTTPPort, "consul-http-port", connectinject.DefaultConsulHTTPPort,
+		"The port the Consul client agents serve their HTTP API on. This can be "+
+			"overridden per pod with the consul.hashicorp.com/consul-http-port annotation.")
+	c.flagSet.StringVar(&c.flagConsulCACert, "consul-ca-cert", "",
+		"Path to a file containing the PEM-encoded CA certificate of the Consul client "+
+			"agents. If specified, injected containers talk to the agents over HTTPS on "+
+			"-consul-https-port.")
+	c.flagSet.IntVar(&c.flagConsulHTTPSPort, "consul-https-port", connectinject.DefaultConsulHTTPSPort,
+		"The port the Consul client agents serve their HTTPS API on.")
+	c.flagSet.Int64Var(&c.flagSidecarUID, "sidecar-run-as-user", connectinject.DefaultSidecarUID,
+		"The non-root user ID the Envoy sidecar runs as. This can be overridden per pod "+
+			"with the consul.hashicorp.com/sidecar-run-as-user annotation.")
+	c.flagSet.Int64Var(&c.flagSidecarGID, "sidecar-run-as-group", connectinject.DefaultSidecarGID,
+		"The group ID the Envoy sidecar runs as.")
+	c.flagSet.BoolVar(&c.flagDisableSidecarSecurityContext, "disable-sidecar-security-context", false,
+		"Don't set a security context on the Envoy sidecar. By default the sidecar runs "+
+			"as a non-root user without capabilities and with a read-only root filesystem.")
+	c.flagSet.BoolVar(&c.flagEnableOpenShift, "enable-openshift", false,
+		"Make the injected containers compatible with OpenShift by leaving their user "+
+			"and group IDs to the platform. -sidecar-run-as-user, -sidecar-run-as-group "+
+			"and the consul.hashicorp.com/sidecar-run-as-user annotation are ignored.")
+	c.flagSet.Var(&c.flagSidecarPreStopTimeout, "sidecar-prestop-timeout",
+		"How long the preStop hook of the Envoy sidecar retries deregistering the "+
+			"services if the Consul client agent is unreachable, formatted as a "+
+			"time.Duration. Defaults to 30 seconds (30s).")
+	c.flagSet.BoolVar(&c.flagEnableTransparentProxy, "enable-transparent-proxy", false,
+		"Redirect the traffic of injected pods through the Envoy sidecar with iptables. "+
+			"Requires Consul 1.10 or later. This can be overridden per pod with the "+
+			"consul.hashicorp.com/transparent-proxy annotation.")
+	c.flagSet.IntVar(&c.flagTProxyOutboundListenerPort, "transparent-proxy-outbound-listener-port",
+		connectinject.DefaultTProxyOutboundListenerPort,
+		"The port of the Envoy listener that outbound traffic is redirected to in "+
+			"transparent proxy mode.")
+	c.flagSet.BoolVar(&c.flagOverwriteProbes, "overwrite-probes", false,
+		"Rewrite the HTTP liveness and readiness probes of injected pods to go through "+
+			"expose path listeners of the Envoy sidecar. This can be overridden per pod "+
+			"with the consul.hashicorp.com/overwrite-probes annotation.")
+	c.flagSet.BoolVar(&c.flagDefaultEnableMetrics, "default-enable-metrics", false,
+		"Make the Envoy sidecar serve Prometheus metrics and annotate pods to be scraped. "+
+			"This can be overridden per pod with the consul.hashicorp.com/enable-metrics annotation.")
+	c.flagSet.IntVar(&c.flagDefaultMetricsPort, "default-metrics-port", connectinject.DefaultMetricsPort,
+		"The port the Envoy sidecar serves Prometheus metrics on. This can be overridden "+
+			"per pod with the consul.hashicorp.com/metrics-port annotation.")
+	c.flagSet.StringVar(&c.flagDefaultPrometheusScrapePath, "default-prometheus-scrape-path",
+		connectinject.DefaultPrometheusScrapePath,
+		"The path the Envoy sidecar serves Prometheus metrics on. This can be overridden "+
+			"per pod with the consul.hashicorp.com/prometheus-scrape-path annotation.")
+	c.flagSet.StringVar(&c.flagTracingProvider, "tracing-provider", "",
+		"The kind of tracing collector, zipkin or jaeger, that the Envoy sidecars of pods "+
+			"with the consul.hashicorp.com/enable-tracing annotation send spans to. "+
+			"Tracing is unavailable if this isn't set.")
+	c.flagSet.StringVar(&c.flagTracingCollectorAddress, "tracing-collector-address", "",
+		"The host:port of the Zipkin-compatible endpoint of the tracing collector.")
+	c.flagSet.StringVar(&c.flagTracingServiceNameTemplate, "tracing-service-name-template",
+		connectinject.DefaultTracingServiceNameTemplate,
+		"The template of the name the Envoy sidecars report spans under. It is rendered "+
+			"with the {{ .Service }} name and Kubernetes {{ .Namespace }} of the proxy.")
+	c.flagSet.StringVar(&c.flagConsulDNSAddress, "consul-dns-address", "",
+		"IP address, such as the cluster IP of a Service in front of the DNS ports of the "+
+			"Consul client agents, that pods with the consul.hashicorp.com/use-consul-dns "+
+			"annotation resolve names with before the cluster's DNS.")
+	c.flagSet.Var(&c.flagClusterDNSNameservers, "cluster-dns-nameserver",
+		"IP address of the cluster's DNS that resolves the names Consul DNS doesn't. "+
+			"May be specified multiple times. Defaults to the nameservers of the "+
+			"injector's own /etc/resolv.conf.")
+	c.flagSet.StringVar(&c.flagClusterDomain, "cluster-domain", connectinject.DefaultClusterDomain,
+		"DNS domain of the cluster, used for the search domains of pods that use Consul DNS.")
+	c.flagSet.BoolVar(&c.flagMergePodDNSConfig, "merge-pod-dns-config", false,
+		"Merge the dnsConfig of pods that use Consul DNS into the generated one. "+
+			"Otherwise such pods are rejected.")
+	c.flagSet.Var(&c.flagCheckInterval, "check-interval",
+		"The interval of the health checks generated for the sidecar proxies, formatted "+
+			"as a time.Duration. Defaults to 10 seconds (10s). This can be overridden per "+
+			"pod with the consul.hashicorp.com/check-interval annotation.")
+	c.flagSet.Var(&c.flagCheckTimeout, "check-timeout",
+		"The timeout of the health checks generated for the sidecar proxies, formatted "+
+			"as a time.Duration. Defaults to Consul's default. This can be overridden per "+
+			"pod with the consul.hashicorp.com/check-timeout annotation.")
+	c.flagSet.Var(&c.flagCheckDeregisterCriticalAfter, "check-deregister-critical-after",
+		"How long the services of a pod may be critical before Consul deregisters them, "+
+			"formatted as a time.Duration of at least 1m. Defaults to 10 minutes (10m). This "+
+			"can be overridden per pod with the "+
+			"consul.hashicorp.com/check-deregister-critical-after annotation.")
+	c.flagSet.IntVar(&c.flagDefaultProxyPort, "default-sidecar-proxy-port", connectinject.DefaultProxyPort,
+		"The port of the public listener of the Envoy sidecar. This can be overridden per "+
+			"pod with the consul.hashicorp.com/connect-sidecar-proxy-port annotation.")
+	c.flagSet.StringVar(&c.flagDefaultProxyCPURequest, "default-sidecar-proxy-cpu-request", "",
+		"The CPU request of the Envoy sidecar, e.g. 100m. This can be overridden per pod "+
+			"with the consul.hashicorp.com/sidecar-proxy-cpu-request annotation.")
+	c.flagSet.StringVar(&c.flagDefaultProxyCPULimit, "default-sidecar-proxy-cpu-limit", "",
+		"The CPU limit of the Envoy sidecar, e.g. 500m. This can be overridden per pod "+
+			"with the consul.hashicorp.com/sidecar-proxy-cpu-limit annotation.")
+	c.flagSet.StringVar(&c.flagDefaultProxyMemoryRequest, "default-sidecar-proxy-memory-request", "",
+		"The memory request of the Envoy sidecar, e.g. 64Mi. This can be overridden per pod "+
+			"with the consul.hashicorp.com/sidecar-proxy-memory-request annotation.")
+	c.flagSet.StringVar(&c.flagDefaultProxyMemoryLimit, "default-sidecar-proxy-memory-limit", "",
+		"The memory limit of the Envoy sidecar, e.g. 128Mi. This can be overridden per pod "+
+			"with the consul.hashicorp.com/sidecar-proxy-memory-limit annotation.")
+	c.flagSet.IntVar(&c.flagDefaultProxyConcurrency, "default-sidecar-proxy-concurrency", 0,
+		"The number of worker threads of the Envoy sidecar. If not specified, Envoy "+
+			"starts one per CPU core of the node. This can be overridden per pod with "+
+			"the consul.hashicorp.com/sidecar-proxy-concurrency annotation.")
+	c.flagSet.Var(&c.flagCopyLabelsToMeta, "copy-label-to-meta",
+		"A pod label to copy into the metadata of the registered service, as "+
+			"labelKey=metaKey or as a bare label key that is also the metadata key. "+
+			"May be specified multiple times. Meta annotations take precedence.")
+	c.flagSet.Var(&c.flagDefaultServiceTags, "default-service-tags",
+		"A tag to add to every injected service and its proxy, before the tags from "+
+			"the consul.hashicorp.com/service-tags annotation. May be specified multiple times.")
+	c.flagSet.StringVar(&c.flagDefaultServiceNameLabel, "default-service-name-label", "",
+		"The key of the pod label, such as app.kubernetes.io/name, whose value is the service "+
+			"name of pods without the consul.hashicorp.com/connect-service annotation. "+
+			"Pods without the label default to the name of their first container.")
+	c.flagSet.BoolVar(&c.flagRenameConflictingNames, "rename-conflicting-names", false,
+		"Add a suffix to the names of injected containers and volumes if the pod "+
+			"already uses them. By default such pods are rejected.")
+	c.flagSet.BoolVar(&c.flagDangerouslyAllowSystemNamespaces, "dangerously-allow-system-namespaces", false,
+		"Inject pods in the kube-system, kube-public and kube-node-lease namespaces, and in "+
+			"the namespace of the injector given by the NAMESPACE environment variable. "+
+			"These are skipped by default since injecting them can break the cluster.")
+	c.flagSet.Var(&c.flagAllowK8sNamespaces, "allow-k8s-namespace",
+		"K8s namespaces to inject pods in. '*' allows all namespaces. May be "+
+			"specified multiple times. If not specified, all namespaces are allowed.")
+	c.flagSet.Var(&c.flagDenyK8sNamespaces, "deny-k8s-namespace",
+		"K8s namespaces to never inject pods in. Takes precedence over "+
+			"-allow-k8s-namespace. May be specified multiple times.")
+	c.flagSet.StringVar(&c.flagConsulDestinationNamespace, "consul-destination-namespace", "",
+		"[Enterprise Only] The Consul namespace to register injected services in. "+
+			"If not specified, namespaces are not used.")
+	c.flagSet.BoolVar(&c.flagEnableK8SNSMirroring, "enable-k8s-namespace-mirroring", false,
+		"[Enterprise Only] Register injected services in a Consul namespace with the "+
+			"name of the pod's K8s namespace instead of -consul-destination-namespace.")
+	c.flagSet.StringVar(&c.flagK8SNSMirroringPrefix, "k8s-namespace-mirroring-prefix", "",
+		"[Enterprise Only] Prefix added to the names of the Consul namespaces when "+
+			"-enable-k8s-namespace-mirroring is set.")
+	c.flagSet.BoolVar(&c.flagAllowConsulNamespaceAnnotation, "allow-consul-namespace-annotation", false,
+		"[Enterprise Only] Allow pods to choose their Consul namespace with the "+
+			"consul.hashicorp.com/consul-namespace annotation.")
+	c.flagSet.StringVar(&c.flagConsulPartition, "consul-partition", "",
+		"[Enterprise Only] The Consul admin partition to register injected services in. "+
+			"Pods can't choose another partition. If not specified, partitions are not used.")
 	c.help = flags.Usage(help, c.flagSet)
 }
 
@@ -74,6 +327,171 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	if c.flagDefaultProtocol != "" && !connectinject.ValidProtocol(c.flagDefaultProtocol) {
+		c.UI.Error(fmt.Sprintf("-default-protocol %q is not a valid protocol", c.flagDefaultProtocol))
+		return 1
+	}
+	if c.flagConsulDestinationNamespace != "" &&
+		!connectinject.ValidConsulNamespace(c.flagConsulDestinationNamespace) {
+		c.UI.Error(fmt.Sprintf("-consul-destination-namespace %q is not a valid Consul namespace name",
+			c.flagConsulDestinationNamespace))
+		return 1
+	}
+	// The prefix is the start of a namespace name, so it must be valid with
+	// any Kubernetes namespace name appended, which can end it.
+	if c.flagK8SNSMirroringPrefix != "" &&
+		!connectinject.ValidConsulNamespace(c.flagK8SNSMirroringPrefix+"a") {
+		c.UI.Error(fmt.Sprintf("-k8s-namespace-mirroring-prefix %q is not a valid prefix of "+
+			"Consul namespace names", c.flagK8SNSMirroringPrefix))
+		return 1
+	}
+	if c.flagConsulHTTPPort < 1 || c.flagConsulHTTPPort > 65535 {
+		c.UI.Error(fmt.Sprintf("-consul-http-port %d is not a valid port", c.flagConsulHTTPPort))
+		return 1
+	}
+	if c.flagConsulHTTPSPort < 1 || c.flagConsulHTTPSPort > 65535 {
+		c.UI.Error(fmt.Sprintf("-consul-https-port %d is not a valid port", c.flagConsulHTTPSPort))
+		return 1
+	}
+
+	if c.flagSidecarUID < 1 {
+		c.UI.Error(fmt.Sprintf("-sidecar-run-as-user %d is not a valid non-root user ID", c.flagSidecarUID))
+		return 1
+	}
+	if c.flagSidecarGID < 0 {
+		c.UI.Error(fmt.Sprintf("-sidecar-run-as-group %d is not a valid group ID", c.flagSidecarGID))
+		return 1
+	}
+
+	var preStopTimeout time.Duration
+	c.flagSidecarPreStopTimeout.Merge(&preStopTimeout)
+	if preStopTimeout < 0 {
+		c.UI.Error(fmt.Sprintf("-sidecar-prestop-timeout %s must not be negative", preStopTimeout))
+		return 1
+	}
+
+	var tokenExpiration time.Duration
+	c.flagACLServiceAccountTokenExpiration.Merge(&tokenExpiration)
+	if tokenExpiration != 0 && tokenExpiration < 10*time.Minute {
+		c.UI.Error(fmt.Sprintf("-acl-service-account-token-expiration %s must be at least 10m",
+			tokenExpiration))
+		return 1
+	}
+
+	if c.flagEnableTransparentProxy && (c.flagEnableOpenShift || c.flagDisableSidecarSecurityContext) {
+		c.UI.Error("-enable-transparent-proxy can't be used with -enable-openshift or " +
+			"-disable-sidecar-security-context since the user ID of the Envoy sidecar must be known")
+		return 1
+	}
+	if c.flagTProxyOutboundListenerPort < 1 || c.flagTProxyOutboundListenerPort > 65535 {
+		c.UI.Error(fmt.Sprintf("-transparent-proxy-outbound-listener-port %d is not a valid port",
+			c.flagTProxyOutboundListenerPort))
+		return 1
+	}
+	if c.flagDefaultMetricsPort < 1 || c.flagDefaultMetricsPort > 65535 {
+		c.UI.Error(fmt.Sprintf("-default-metrics-port %d is not a valid port", c.flagDefaultMetricsPort))
+		return 1
+	}
+	if !strings.HasPrefix(c.flagDefaultPrometheusScrapePath, "/") {
+		c.UI.Error(fmt.Sprintf("-default-prometheus-scrape-path %q must be an absolute path",
+			c.flagDefaultPrometheusScrapePath))
+		return 1
+	}
+	if c.flagTracingProvider != "" {
+		err := connectinject.ValidateTracing(c.flagTracingProvider,
+			c.flagTracingCollectorAddress, c.flagTracingServiceNameTemplate)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Invalid tracing configuration: %s", err))
+			return 1
+		}
+	}
+	clusterDNSNameservers := []string(c.flagClusterDNSNameservers)
+	if c.flagConsulDNSAddress != "" {
+		if net.ParseIP(c.flagConsulDNSAddress) == nil {
+			c.UI.Error(fmt.Sprintf("-consul-dns-address %q is not an IP address",
+				c.flagConsulDNSAddress))
+			return 1
+		}
+		if len(clusterDNSNameservers) == 0 {
+			f, err := os.Open("/etc/resolv.conf")
+			if err != nil {
+				c.UI.Error(fmt.Sprintf("Error reading the cluster's DNS nameservers: %s", err))
+				return 1
+			}
+			clusterDNSNameservers, err = connectinject.ResolvConfNameservers(f)
+			f.Close()
+			if err != nil {
+				c.UI.Error(fmt.Sprintf("Error reading the cluster's DNS nameservers: %s", err))
+				return 1
+			}
+		}
+	}
+
+	var checkInterval, checkTimeout, checkDeregisterCriticalAfter time.Duration
+	c.flagCheckInterval.Merge(&checkInterval)
+	c.flagCheckTimeout.Merge(&checkTimeout)
+	c.flagCheckDeregisterCriticalAfter.Merge(&checkDeregisterCriticalAfter)
+	if checkInterval < 0 {
+		c.UI.Error(fmt.Sprintf("-check-interval %s must not be negative", checkInterval))
+		return 1
+	}
+	if checkTimeout < 0 {
+		c.UI.Error(fmt.Sprintf("-check-timeout %s must not be negative", checkTimeout))
+		return 1
+	}
+	if checkDeregisterCriticalAfter != 0 && checkDeregisterCriticalAfter < time.Minute {
+		c.UI.Error(fmt.Sprintf("-check-deregister-critical-after %s must be at least 1m",
+			checkDeregisterCriticalAfter))
+		return 1
+	}
+
+	copyLabelsToMeta, err := connectinject.ParseCopyLabelsToMeta(c.flagCopyLabelsToMeta)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error parsing -copy-label-to-meta: %s", err))
+		return 1
+	}
+
+	if c.flagDefaultProxyPort < 1 || c.flagDefaultProxyPort > 65535 {
+		c.UI.Error(fmt.Sprintf("-default-sidecar-proxy-port %d is not a valid port", c.flagDefaultProxyPort))
+		return 1
+	}
+
+	var proxyResources [4]resource.Quantity
+	for i, f := range []struct {
+		name  string
+		value string
+	}{
+		{"default-sidecar-proxy-cpu-request", c.flagDefaultProxyCPURequest},
+		{"default-sidecar-proxy-cpu-limit", c.flagDefaultProxyCPULimit},
+		{"default-sidecar-proxy-memory-request", c.flagDefaultProxyMemoryRequest},
+		{"default-sidecar-proxy-memory-limit", c.flagDefaultProxyMemoryLimit},
+	} {
+		if f.value == "" {
+			continue
+		}
+		var err error
+		proxyResources[i], err = resource.ParseQuantity(f.value)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("-%s %q is invalid: %s", f.name, f.value, err))
+			return 1
+		}
+	}
+	if c.flagDefaultProxyConcurrency < 0 {
+		c.UI.Error(fmt.Sprintf("-default-sidecar-proxy-concurrency %d must not be negative",
+			c.flagDefaultProxyConcurrency))
+		return 1
+	}
+
+	var consulCACert []byte
+	if c.flagConsulCACert != "" {
+		var err error
+		consulCACert, err = ioutil.ReadFile(c.flagConsulCACert)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error reading Consul's CA cert file %q: %s", c.flagConsulCACert, err))
+			return 1
+		}
+	}
+
 	// We must have an in-cluster K8S client
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -87,15 +505,26 @@ func (c *Command) Run(args []string) int {
 	}
 
 	// Determine where to source the certificates from
-	var certSource cert.Source = &cert.GenSource{
+	genSource := &cert.GenSource{
 		Name:  "Connect Inject",
 		Hosts: strings.Split(c.flagAutoHosts, ","),
 	}
+	var certSource cert.Source = genSource
 	if c.flagCertFile != "" {
 		certSource = &cert.DiskSource{
 			CertPath: c.flagCertFile,
 			KeyPath:  c.flagKeyFile,
 		}
+	} else if c.flagAutoCASecret != "" {
+		namespace := os.Getenv("NAMESPACE")
+		if namespace == "" {
+			c.UI.Error("-tls-auto-ca-secret requires the NAMESPACE environment variable to be set")
+			return 1
+		}
+		if err := loadSharedCA(clientset, namespace, c.flagAutoCASecret, genSource); err != nil {
+			c.UI.Error(fmt.Sprintf("Error loading CA from secret %q: %s", c.flagAutoCASecret, err))
+			return 1
+		}
 	}
 
 	// Create the certificate notifier so we can update for certificates,
@@ -116,8 +545,81 @@ func (c *Command) Run(args []string) int {
 		AuthMethod:           c.flagACLAuthMethod,
 		WriteServiceDefaults: c.flagCentralConfig,
 		DefaultProtocol:      c.flagDefaultProtocol,
+		ConsulHTTPPort:       c.flagConsulHTTPPort,
+		ConsulCACert:         string(consulCACert),
+		ConsulHTTPSPort:      c.flagConsulHTTPSPort,
+		SidecarUID:           c.flagSidecarUID,
+		SidecarGID:           c.flagSidecarGID,
+		Version:              version.GetHumanVersion(),
 		Log:                  hclog.Default().Named("handler"),
+
+		DisableSidecarSecurityContext: c.flagDisableSidecarSecurityContext,
+		EnableOpenShift:               c.flagEnableOpenShift,
+		SidecarPreStopTimeout:         preStopTimeout,
+		ServiceAccountTokenAudience:   c.flagACLServiceAccountTokenAudience,
+		ServiceAccountTokenExpiration: tokenExpiration,
+		EnableTransparentProxy:        c.flagEnableTransparentProxy,
+		TProxyOutboundListenerPort:    c.flagTProxyOutboundListenerPort,
+		OverwriteProbes:               c.flagOverwriteProbes,
+		DefaultEnableMetrics:          c.flagDefaultEnableMetrics,
+		DefaultMetricsPort:            c.flagDefaultMetricsPort,
+		DefaultPrometheusScrapePath:   c.flagDefaultPrometheusScrapePath,
+		TracingProvider:               c.flagTracingProvider,
+		TracingCollectorAddress:       c.flagTracingCollectorAddress,
+		TracingServiceNameTemplate:    c.flagTracingServiceNameTemplate,
+		ConsulDNSAddress:              c.flagConsulDNSAddress,
+		ClusterDNSNameservers:         clusterDNSNameservers,
+		ClusterDomain:                 c.flagClusterDomain,
+		MergePodDNSConfig:             c.flagMergePodDNSConfig,
+		CheckInterval:                 checkInterval,
+		CheckTimeout:                  checkTimeout,
+		CheckDeregisterCriticalAfter:  checkDeregisterCriticalAfter,
+		DefaultProxyPort:              c.flagDefaultProxyPort,
+		DefaultProxyCPURequest:        proxyResources[0],
+		DefaultProxyCPULimit:          proxyResources[1],
+		DefaultProxyMemoryRequest:     proxyResources[2],
+		DefaultProxyMemoryLimit:       proxyResources[3],
+		DefaultProxyConcurrency:       c.flagDefaultProxyConcurrency,
+		DefaultServiceNameLabel:       c.flagDefaultServiceNameLabel,
+		CopyLabelsToMeta:              copyLabelsToMeta,
+		DefaultServiceTags:            c.flagDefaultServiceTags,
+		RenameConflictingNames:        c.flagRenameConflictingNames,
+		AllowK8sNamespaces:            c.flagAllowK8sNamespaces,
+		DenyK8sNamespaces:             c.flagDenyK8sNamespaces,
+		Namespace:                     os.Getenv("NAMESPACE"),
+		AllowSystemNamespaces:         c.flagDangerouslyAllowSystemNamespaces,
+
+		ConsulDestinationNamespace:     c.flagConsulDestinationNamespace,
+		EnableK8SNSMirroring:           c.flagEnableK8SNSMirroring,
+		K8SNSMirroringPrefix:           c.flagK8SNSMirroringPrefix,
+		AllowConsulNamespaceAnnotation: c.flagAllowConsulNamespaceAnnotation,
+		ConsulPartition:                c.flagConsulPartition,
 	}
+
+	// Serve the metrics on their own listener, without TLS, so that
+	// Prometheus can scrape them without the webhook's certificate.
+	errCh := make(chan error, 2)
+	var servers []*http.Server
+	if c.flagMetricsListen != "" {
+		registry := prometheus.NewRegistry()
+		injector.Metrics, err = connectinject.NewMetrics(registry)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error creating metrics: %s", err))
+			return 1
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		metricsServer := &http.Server{
+			Addr:    c.flagMetricsListen,
+			Handler: mux,
+		}
+		servers = append(servers, metricsServer)
+		go func() {
+			c.UI.Info(fmt.Sprintf("Serving metrics on %q...", c.flagMetricsListen))
+			errCh <- metricsServer.ListenAndServe()
+		}()
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mutate", injector.Handle)
 	mux.HandleFunc("/health/ready", c.handleReady)
@@ -127,14 +629,37 @@ func (c *Command) Run(args []string) int {
 		Handler:   handler,
 		TLSConfig: &tls.Config{GetCertificate: c.getCertificate},
 	}
+	servers = append(servers, server)
+	go func() {
+		c.UI.Info(fmt.Sprintf("Listening on %q...", c.flagListen))
+		errCh <- server.ListenAndServeTLS("", "")
+	}()
 
-	c.UI.Info(fmt.Sprintf("Listening on %q...", c.flagListen))
-	if err := server.ListenAndServeTLS("", ""); err != nil {
+	// Wait on an interrupt to exit
+	c.sigCh = make(chan os.Signal, 1)
+	signal.Notify(c.sigCh, os.Interrupt, syscall.SIGTERM)
+	exitCode := 0
+	select {
+	// Unexpected exit
+	case err := <-errCh:
 		c.UI.Error(fmt.Sprintf("Error listening: %s", err))
-		return 1
+		exitCode = 1
+
+	// Interrupted, gracefully exit
+	case <-c.sigCh:
 	}
 
-	return 0
+	// Let the requests in flight finish before exiting
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			c.UI.Error(fmt.Sprintf("Error shutting down server: %s", err))
+			exitCode = 1
+		}
+	}
+
+	return exitCode
 }
 
 func (c *Command) handleReady(rw http.ResponseWriter, req *http.Request) {
@@ -153,7 +678,7 @@ func (c *Command) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
 	return certRaw.(*tls.Certificate), nil
 }
 
-func (c *Command) certWatcher(ctx context.Context, ch <-chan cert.Bundle, clientset *kubernetes.Clientset) {
+func (c *Command) certWatcher(ctx context.Context, ch <-chan cert.Bundle, clientset kubernetes.Interface) {
 	var bundle cert.Bundle
 	for {
 		select {
@@ -178,20 +703,11 @@ func (c *Command) certWatcher(ctx context.Context, ch <-chan cert.Bundle, client
 			continue
 		}
 
-		// If there is a MWC name set, then update the CA bundle.
+		// If there is a MWC name set, then update the CA bundle. This
+		// happens before the new certificate is served so that the API
+		// server trusts it.
 		if c.flagAutoName != "" && len(bundle.CACert) > 0 {
-			// The CA Bundle value must be base64 encoded
-			value := base64.StdEncoding.EncodeToString(bundle.CACert)
-
-			_, err := clientset.Admissionregistration().
-				MutatingWebhookConfigurations().
-				Patch(c.flagAutoName, types.JSONPatchType, []byte(fmt.Sprintf(
-					`[{
-						"op": "add",
-						"path": "/webhooks/0/clientConfig/caBundle",
-						"value": %q
-					}]`, value)))
-			if err != nil {
+			if err := updateCABundle(clientset, c.flagAutoName, bundle.CACert); err != nil {
 				c.UI.Error(fmt.Sprintf(
 					"Error updating MutatingWebhookConfiguration: %s",
 					err))
@@ -199,11 +715,76 @@ func (c *Command) certWatcher(ctx context.Context, ch <-chan cert.Bundle, client
 			}
 		}
 
-		// Update the certificate
+		// Update the certificate. Only new TLS handshakes get it, so
+		// admission requests in flight aren't affected.
 		c.cert.Store(&cert)
 	}
 }
 
+// updateCABundle sets the caBundle of the webhooks of the config to the CA
+// certificate. The config is only updated if a caBundle differs, and the
+// update fails if another replica updated the config concurrently, in
+// which case the caller tries again later.
+func updateCABundle(clientset kubernetes.Interface, name string, caCert []byte) error {
+	configs := clientset.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
+	config, err := configs.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for i := range config.Webhooks {
+		if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caCert) {
+			config.Webhooks[i].ClientConfig.CABundle = caCert
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	_, err = configs.Update(config)
+	return err
+}
+
+// loadSharedCA makes the source sign its certificates with the CA stored
+// in the secret, so that the caBundle of the webhook config is valid for
+// the certificates of all replicas of the injector. The first replica to
+// start generates the CA and creates the secret, the others load it.
+func loadSharedCA(clientset kubernetes.Interface, namespace, name string, source *cert.GenSource) error {
+	secrets := clientset.CoreV1().Secrets(namespace)
+	secret, err := secrets.Get(name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		var caCert, caKey []byte
+		caCert, caKey, err = source.CA()
+		if err != nil {
+			return err
+		}
+		_, err = secrets.Create(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Type:       corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				corev1.TLSCertKey:       caCert,
+				corev1.TLSPrivateKeyKey: caKey,
+			},
+		})
+		if err == nil {
+			return nil
+		}
+		if !k8serrors.IsAlreadyExists(err) {
+			return err
+		}
+
+		// Another replica created the secret first, so use its CA.
+		secret, err = secrets.Get(name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	return source.SetCA(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+}
+
 func (c *Command) Synopsis() string { return synopsis }
 func (c *Command) Help() string {
 	c.once.Do(c.init)
@@ -0,0 +1,201 @@
+package subcommand
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-k8s/helper/cert"
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+	"github.com/mitchellh/cli"
+	"github.com/stretchr/testify/require"
+	admissionv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// Test that the caBundle of the webhooks is updated when the CA changes,
+// and that the TLS server serves the new certificate after a rotation.
+func TestCommand_certWatcher(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	clientset := fake.NewSimpleClientset(testWebhookConfig("inject"))
+	cmd := Command{UI: cli.NewMockUi(), flagAutoName: "inject"}
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	ch := make(chan cert.Bundle)
+	go cmd.certWatcher(ctx, ch, clientset)
+
+	// Leaves are rotated right away since they're always within the
+	// expiry window.
+	source := &cert.GenSource{
+		Name:         "Test",
+		Hosts:        []string{"inject.default.svc"},
+		Expiry:       time.Hour,
+		ExpiryWithin: 2 * time.Hour,
+	}
+	first, err := source.Certificate(ctx, nil)
+	require.NoError(err)
+	ch <- first
+	requireCertificate(t, &cmd, clientset, &first)
+
+	// Rotating the leaf keeps the CA
+	next, err := source.Certificate(ctx, &first)
+	require.NoError(err)
+	require.Equal(first.CACert, next.CACert)
+	require.NotEqual(first.Cert, next.Cert)
+	ch <- next
+	requireCertificate(t, &cmd, clientset, &next)
+
+	// A new CA is patched into the webhooks
+	other, err := testGenSource().Certificate(ctx, nil)
+	require.NoError(err)
+	require.NotEqual(first.CACert, other.CACert)
+	ch <- other
+	requireCertificate(t, &cmd, clientset, &other)
+}
+
+// Test that all replicas share the CA stored in the secret.
+func TestLoadSharedCA(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	clientset := fake.NewSimpleClientset()
+
+	// The first replica creates the secret
+	first := testGenSource()
+	require.NoError(loadSharedCA(clientset, "default", "inject-ca", first))
+	secret, err := clientset.CoreV1().Secrets("default").Get("inject-ca", metav1.GetOptions{})
+	require.NoError(err)
+	require.Equal(corev1.SecretTypeTLS, secret.Type)
+	caCert, _, err := first.CA()
+	require.NoError(err)
+	require.Equal(caCert, secret.Data[corev1.TLSCertKey])
+
+	// The others load it
+	second := testGenSource()
+	require.NoError(loadSharedCA(clientset, "default", "inject-ca", second))
+	firstBundle, err := first.Certificate(context.Background(), nil)
+	require.NoError(err)
+	secondBundle, err := second.Certificate(context.Background(), nil)
+	require.NoError(err)
+	require.Equal(firstBundle.CACert, secondBundle.CACert)
+	require.NotEqual(firstBundle.Cert, secondBundle.Cert)
+}
+
+// Test that a secret without a valid CA is an error.
+func TestLoadSharedCA_invalid(t *testing.T) {
+	t.Parallel()
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "inject-ca", Namespace: "default"},
+		Data: map[string][]byte{
+			corev1.TLSCertKey: []byte("not a cert"),
+		},
+	})
+	err := loadSharedCA(clientset, "default", "inject-ca", testGenSource())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error parsing CA certificate")
+}
+
+// Test that the webhook config is only updated if a caBundle differs.
+func TestUpdateCABundle(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	clientset := fake.NewSimpleClientset(testWebhookConfig("inject"))
+
+	require.NoError(updateCABundle(clientset, "inject", []byte("ca")))
+	require.Len(clientset.Actions(), 2)
+	config, err := clientset.AdmissionregistrationV1beta1().
+		MutatingWebhookConfigurations().Get("inject", metav1.GetOptions{})
+	require.NoError(err)
+	for _, webhook := range config.Webhooks {
+		require.Equal([]byte("ca"), webhook.ClientConfig.CABundle)
+	}
+
+	clientset.ClearActions()
+	require.NoError(updateCABundle(clientset, "inject", []byte("ca")))
+	require.Len(clientset.Actions(), 1)
+	require.Equal("get", clientset.Actions()[0].GetVerb())
+
+	require.Error(updateCABundle(clientset, "missing", []byte("ca")))
+}
+
+// Test that namespace flags that aren't valid Consul namespace names are
+// rejected.
+func TestRun_invalidNamespaceFlags(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Flags []string
+		Err   string
+	}{
+		{
+			[]string{"-consul-destination-namespace", `ns"$(id)`},
+			`-consul-destination-namespace "ns\"$(id)" is not a valid Consul namespace name`,
+		},
+		{
+			[]string{"-consul-destination-namespace", "ns-"},
+			`-consul-destination-namespace "ns-" is not a valid Consul namespace name`,
+		},
+		{
+			[]string{"-k8s-namespace-mirroring-prefix", "k8s_"},
+			`-k8s-namespace-mirroring-prefix "k8s_" is not a valid prefix of Consul namespace names`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Flags[1], func(t *testing.T) {
+			ui := cli.NewMockUi()
+			cmd := Command{UI: ui}
+			require.Equal(t, 1, cmd.Run(tt.Flags))
+			require.Contains(t, ui.ErrorWriter.String(), tt.Err)
+		})
+	}
+}
+
+// requireCertificate waits until the command serves the certificate of the
+// bundle and the webhooks have its CA.
+func requireCertificate(t *testing.T, cmd *Command, clientset kubernetes.Interface, bundle *cert.Bundle) {
+	t.Helper()
+	expected, err := tls.X509KeyPair(bundle.Cert, bundle.Key)
+	require.NoError(t, err)
+	retry.Run(t, func(r *retry.R) {
+		actual, err := cmd.getCertificate(nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if !bytes.Equal(expected.Certificate[0], actual.Certificate[0]) {
+			r.Fatal("certificate not updated")
+		}
+
+		config, err := clientset.AdmissionregistrationV1beta1().
+			MutatingWebhookConfigurations().Get("inject", metav1.GetOptions{})
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		for _, webhook := range config.Webhooks {
+			if !bytes.Equal(bundle.CACert, webhook.ClientConfig.CABundle) {
+				r.Fatalf("caBundle of %s not updated", webhook.Name)
+			}
+		}
+	})
+}
+
+func testWebhookConfig(name string) *admissionv1beta1.MutatingWebhookConfiguration {
+	return &admissionv1beta1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Webhooks: []admissionv1beta1.Webhook{
+			{Name: "inject.consul.hashicorp.com"},
+			{Name: "inject-namespaces.consul.hashicorp.com"},
+		},
+	}
+}
+
+func testGenSource() *cert.GenSource {
+	return &cert.GenSource{
+		Name:  "Test",
+		Hosts: []string{"inject.default.svc"},
+	}
+}